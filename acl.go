@@ -0,0 +1,62 @@
+// Controle de acesso por IP (-allow / -deny), verificado no accept antes
+// de qualquer limite.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Separa uma lista de faixas CIDR ("10.0.0.0/8,192.168.1.10"); um IP sem
+// máscara vale como faixa de um endereço só
+func parseCIDRList(list string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, cidr := range strings.Split(list, ",") {
+		cidr = strings.TrimSpace(cidr)
+		if cidr == "" {
+			continue
+		}
+		if !strings.Contains(cidr, "/") {
+			if ip := net.ParseIP(cidr); ip != nil && ip.To4() != nil {
+				cidr += "/32"
+			} else {
+				cidr += "/128"
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("faixa inválida %q: %w", cidr, err)
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+func matchIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Aplica -deny, -allow e -allow-file: quem está no -deny é recusado; com
+// -allow ou -allow-file configurado, só passa quem está em um dos dois
+func (p *Proxy) allowedAddr(addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return true
+	}
+	live := p.live.Load()
+	if matchIP(live.Deny, tcpAddr.IP) {
+		return false
+	}
+	// Com -allow-file a lista vale mesmo vazia: arquivo vazio não libera todos
+	if p.allowFile != nil {
+		return matchIP(live.Allow, tcpAddr.IP) || matchIP(p.allowFile.list(), tcpAddr.IP)
+	}
+	return len(live.Allow) == 0 || matchIP(live.Allow, tcpAddr.IP)
+}
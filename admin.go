@@ -0,0 +1,333 @@
+// Rotas de administração no servidor HTTP (-stats-addr), só registradas
+// com -admin-token e só atendidas com "Authorization: Bearer <token>":
+// GET /cache lista o cache de respostas, POST /cache/flush esvazia, POST
+// /drain tira o proxy do ar para conexões novas (as ativas seguem), POST
+// /undrain volta, GET /bans lista os IPs banidos pelo -ban-threshold, POST
+// /bans/unban?ip=X tira um deles, POST /connections/{id}/close fecha uma
+// conexão (o id é o de /connections), POST /targets/drain?addr=X e
+// /targets/undrain?addr=X tiram um destino da rotação e devolvem e GET
+// /config mostra a configuração em vigor, sem os segredos.
+
+package main
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+func (p *Proxy) registerAdmin(mux *http.ServeMux) {
+	mux.HandleFunc("/cache", p.requireAdmin(p.handleCache))
+	mux.HandleFunc("/cache/flush", p.requireAdmin(p.handleCacheFlush))
+	mux.HandleFunc("/drain", p.requireAdmin(p.handleDrain))
+	mux.HandleFunc("/undrain", p.requireAdmin(p.handleUndrain))
+	mux.HandleFunc("/bans", p.requireAdmin(p.handleBans))
+	mux.HandleFunc("/bans/unban", p.requireAdmin(p.handleUnban))
+	mux.HandleFunc("/connections/", p.requireAdmin(p.handleCloseConnection))
+	mux.HandleFunc("/targets/drain", p.requireAdmin(p.handleTargetDrain(true)))
+	mux.HandleFunc("/targets/undrain", p.requireAdmin(p.handleTargetDrain(false)))
+	mux.HandleFunc("/config", p.requireAdmin(p.handleConfig))
+}
+
+// Recusa a requisição sem o token; a comparação é em tempo constante
+func (p *Proxy) requireAdmin(h http.HandlerFunc) http.HandlerFunc {
+	want := []byte("Bearer " + p.config.AdminToken)
+	return func(w http.ResponseWriter, r *http.Request) {
+		got := []byte(r.Header.Get("Authorization"))
+		if subtle.ConstantTimeCompare(got, want) != 1 {
+			p.log.Warnf("⚠️  Rota de administração sem token válido: %s %s de %s", r.Method, r.URL.Path, r.RemoteAddr)
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "token inválido", http.StatusUnauthorized)
+			return
+		}
+		h(w, r)
+	}
+}
+
+// Entradas em cache de todos os destinos, por destino e comando
+func (p *Proxy) CacheEntries() []CacheEntrySnapshot {
+	list := []CacheEntrySnapshot{}
+	for _, t := range p.targetList() {
+		if t.cache != nil {
+			list = append(list, t.cache.snapshot(t.addr)...)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Target != list[j].Target {
+			return list[i].Target < list[j].Target
+		}
+		if list[i].Command != list[j].Command {
+			return list[i].Command < list[j].Command
+		}
+		return list[i].Scope < list[j].Scope
+	})
+	return list
+}
+
+// Esvazia o cache de todos os destinos; devolve quantas entradas saíram
+func (p *Proxy) FlushCache() int {
+	n := 0
+	for _, t := range p.targetList() {
+		if t.cache != nil {
+			n += t.cache.flush()
+		}
+	}
+	return n
+}
+
+func (p *Proxy) handleCache(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "método não permitido", http.StatusMethodNotAllowed)
+		return
+	}
+	p.writeJSON(w, p.CacheEntries())
+}
+
+func (p *Proxy) handleCacheFlush(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "método não permitido", http.StatusMethodNotAllowed)
+		return
+	}
+	n := p.FlushCache()
+	p.log.Infof("🧹 Cache esvaziado via HTTP por %s: %d entradas", r.RemoteAddr, n)
+	p.writeJSON(w, struct{ Flushed int }{n})
+}
+
+// Estado devolvido por /drain e /undrain
+type drainStatus struct {
+	Draining          bool
+	ActiveConnections int64
+}
+
+// Para de aceitar conexões novas (recusadas com uma linha de erro) sem
+// tocar nas ativas; /ready passa a responder 503. Devolve false se já
+// estava em drain.
+func (p *Proxy) Drain() bool {
+	return !p.notReady.Swap(true)
+}
+
+// Volta a aceitar conexões novas; false se não estava em drain
+func (p *Proxy) Undrain() bool {
+	return p.notReady.Swap(false)
+}
+
+func (p *Proxy) handleDrain(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "método não permitido", http.StatusMethodNotAllowed)
+		return
+	}
+	if p.Drain() {
+		p.log.Infof("🚧 Drain via HTTP por %s: conexões novas recusadas, %d ativas seguem",
+			r.RemoteAddr, atomic.LoadInt64(&p.stats.ActiveConnections))
+	}
+	p.writeJSON(w, drainStatus{Draining: true, ActiveConnections: atomic.LoadInt64(&p.stats.ActiveConnections)})
+}
+
+func (p *Proxy) handleUndrain(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "método não permitido", http.StatusMethodNotAllowed)
+		return
+	}
+	if p.Undrain() {
+		p.log.Infof("▶️  Undrain via HTTP por %s: aceitando conexões novas de novo", r.RemoteAddr)
+	}
+	p.writeJSON(w, drainStatus{Draining: false, ActiveConnections: atomic.LoadInt64(&p.stats.ActiveConnections)})
+}
+
+// IPs banidos pelo -ban-threshold (lista vazia sem ele)
+func (p *Proxy) Bans() []BanSnapshot {
+	if p.bans == nil {
+		return []BanSnapshot{}
+	}
+	return p.bans.snapshot()
+}
+
+// Tira o banimento do IP. Aceita a chave como aparece em /bans ou um IP
+// solto, que é agregado como no rate limit (um IPv6 vira o /64 dele).
+func (p *Proxy) Unban(ip string) bool {
+	if p.bans == nil {
+		return false
+	}
+	if parsed := net.ParseIP(ip); parsed != nil {
+		ip = p.ipKey(&net.TCPAddr{IP: parsed})
+	}
+	return p.bans.unban(ip)
+}
+
+// Configuração em vigor: a da inicialização com o que o SIGHUP trocou, sem
+// os segredos (como no log de -log debug)
+func (p *Proxy) EffectiveConfig() Config {
+	c := p.config.redacted()
+	live := p.live.Load()
+	c.MaxConns, c.ConnRate, c.Allow, c.Deny = live.MaxConns, live.ConnRate, live.Allow, live.Deny
+	return c
+}
+
+// Config em JSON legível: durações como "30s", redes como "10.0.0.0/8" e
+// TLS pelos nomes ("TLS 1.3", "TLS_ECDHE_..."); o encoding/json daria
+// nanossegundos, máscaras em base64 e números
+func configJSON(c Config) map[string]any {
+	v := reflect.ValueOf(c)
+	out := make(map[string]any, v.NumField())
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		switch x := v.Field(i).Interface().(type) {
+		case time.Duration:
+			out[field.Name] = x.String()
+		case []*net.IPNet:
+			nets := make([]string, len(x))
+			for j, n := range x {
+				nets[j] = n.String()
+			}
+			out[field.Name] = nets
+		case []uint16: // suítes TLS
+			names := make([]string, len(x))
+			for j, id := range x {
+				names[j] = tls.CipherSuiteName(id)
+			}
+			out[field.Name] = names
+		case uint16: // versões TLS
+			out[field.Name] = tls.VersionName(minTLSVersion(x))
+		default:
+			out[field.Name] = x
+		}
+	}
+	return out
+}
+
+func (p *Proxy) handleConfig(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "método não permitido", http.StatusMethodNotAllowed)
+		return
+	}
+	p.writeJSON(w, configJSON(p.EffectiveConfig()))
+}
+
+func (p *Proxy) handleBans(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "método não permitido", http.StatusMethodNotAllowed)
+		return
+	}
+	p.writeJSON(w, p.Bans())
+}
+
+func (p *Proxy) handleUnban(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "método não permitido", http.StatusMethodNotAllowed)
+		return
+	}
+	ip := r.FormValue("ip")
+	if ip == "" {
+		http.Error(w, "parâmetro ip obrigatório", http.StatusBadRequest)
+		return
+	}
+	unbanned := p.Unban(ip)
+	if unbanned {
+		p.log.Infof("🔓 Banimento de %s retirado via HTTP por %s", ip, r.RemoteAddr)
+	}
+	p.writeJSON(w, struct {
+		IP       string
+		Unbanned bool
+	}{ip, unbanned})
+}
+
+// Conexão ativa pelo id de /connections (nil se não existe mais)
+func (p *Proxy) findConn(id uint64) *activeConn {
+	p.connsMu.Lock()
+	defer p.connsMu.Unlock()
+	for c := range p.conns {
+		if c.id == id {
+			return c
+		}
+	}
+	return nil
+}
+
+// Fecha uma conexão com "error id=1 msg=closed\sby\sadministrator" antes.
+// Espera a resposta em andamento por até -close-grace e depois fecha à
+// força. Devolve false se a conexão não existe (ou já
+// estava fechando).
+func (p *Proxy) CloseConnection(id uint64) bool {
+	c := p.findConn(id)
+	return c != nil && p.closeConn(c)
+}
+
+func (p *Proxy) closeConn(c *activeConn) bool {
+	closed, _ := c.closeGracefully("closed by administrator", p.config.CloseGrace)
+	if !closed {
+		return false
+	}
+	atomic.AddUint64(&p.stats.ClosedByAdmin, 1)
+	return true
+}
+
+// POST /connections/{id}/close
+func (p *Proxy) handleCloseConnection(w http.ResponseWriter, r *http.Request) {
+	rest := strings.TrimPrefix(r.URL.Path, "/connections/")
+	idText, ok := strings.CutSuffix(rest, "/close")
+	id, err := strconv.ParseUint(idText, 10, 64)
+	if !ok || err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "método não permitido", http.StatusMethodNotAllowed)
+		return
+	}
+	c := p.findConn(id)
+	if c == nil || !p.closeConn(c) {
+		http.Error(w, "conexão não encontrada", http.StatusNotFound)
+		return
+	}
+	p.log.With(logFields{"conn_id": id, "client": c.clientAddr}).
+		Infof("✂️  Conexão #%d fechada via HTTP por %s: %s", id, r.RemoteAddr, c.who())
+	p.writeJSON(w, struct {
+		ID     uint64
+		Closed bool
+	}{id, true})
+}
+
+// POST /targets/drain?addr=X tira um destino da rotação para manutenção:
+// conexões novas vão para os outros e as ativas nele seguem até fecharem.
+// POST /targets/undrain?addr=X devolve.
+func (p *Proxy) handleTargetDrain(draining bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "método não permitido", http.StatusMethodNotAllowed)
+			return
+		}
+		addr := r.FormValue("addr")
+		if addr == "" {
+			http.Error(w, "parâmetro addr obrigatório", http.StatusBadRequest)
+			return
+		}
+		t := p.findTarget(addr)
+		if t == nil {
+			http.Error(w, "destino não encontrado", http.StatusNotFound)
+			return
+		}
+		active := atomic.LoadInt64(&t.active)
+		if t.setDraining(draining) {
+			if draining {
+				p.log.Infof("🚧 Destino %s em drain via HTTP por %s: sem conexões novas, %d ativas seguem", addr, r.RemoteAddr, active)
+			} else {
+				p.log.Infof("▶️  Destino %s de volta à rotação via HTTP por %s", addr, r.RemoteAddr)
+			}
+		}
+		p.writeJSON(w, struct {
+			Addr              string
+			State             string
+			ActiveConnections int64
+		}{addr, t.state(), active})
+	}
+}
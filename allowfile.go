@@ -0,0 +1,127 @@
+// Lista de IPs permitidos em arquivo (-allow-file), para quando ela é
+// mantida por outro sistema: uma faixa por linha, relida sozinha quando o
+// arquivo muda (verificado com Stat a cada allowFilePollInterval). Soma
+// com o -allow; o -deny continua valendo sobre as duas.
+//
+//	# escritórios
+//	203.0.113.0/24
+//	198.51.100.7
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const allowFilePollInterval = 2 * time.Second
+
+type allowFile struct {
+	path string
+	log  *Logger
+	nets atomic.Pointer[[]*net.IPNet]
+	info os.FileInfo // último arquivo lido; só a goroutine do watch mexe
+}
+
+func newAllowFile(path string, logger *Logger) *allowFile {
+	a := &allowFile{path: path, log: logger}
+	a.nets.Store(new([]*net.IPNet))
+	return a
+}
+
+// Primeira leitura, no Start(): arquivo que não abre é erro
+func (a *allowFile) load() error {
+	info, err := os.Stat(a.path)
+	if err != nil {
+		return err
+	}
+	if err := a.read(); err != nil {
+		return err
+	}
+	a.info = info
+	return nil
+}
+
+// Relê o arquivo e publica a lista nova. Linhas inválidas são puladas (e
+// logadas); se o arquivo não puder ser lido, a lista atual fica.
+func (a *allowFile) read() error {
+	data, err := os.ReadFile(a.path)
+	if err != nil {
+		return err
+	}
+	nets, bad := parseAllowFile(data)
+	for _, line := range bad {
+		a.log.Warnf("⚠️  %s: linha ignorada: %s", a.path, line)
+	}
+	a.nets.Store(&nets)
+	return nil
+}
+
+// Uma faixa ou IP por linha; linhas vazias e comentários (#) são ignorados.
+// Devolve as faixas válidas e o texto das linhas inválidas.
+func parseAllowFile(data []byte) (nets []*net.IPNet, bad []string) {
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	n := 0
+	for scanner.Scan() {
+		n++
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		parsed, err := parseCIDRList(line)
+		if err != nil || strings.Contains(line, ",") {
+			bad = append(bad, fmt.Sprintf("%d: %q", n, line))
+			continue
+		}
+		nets = append(nets, parsed...)
+	}
+	return nets, bad
+}
+
+// Verifica o arquivo a cada allowFilePollInterval (±jitterPct%) até stop
+// fechar. Conta como mudança outro arquivo no caminho (rename de um novo
+// por cima), outra data de modificação ou outro tamanho.
+func (a *allowFile) watch(stop <-chan struct{}, jitterPct int) {
+	failing := false
+	for {
+		select {
+		case <-time.After(jitter(allowFilePollInterval, jitterPct)):
+		case <-stop:
+			return
+		}
+
+		info, err := os.Stat(a.path)
+		if err == nil && a.info != nil && os.SameFile(info, a.info) &&
+			info.ModTime().Equal(a.info.ModTime()) && info.Size() == a.info.Size() {
+			continue
+		}
+		if err == nil {
+			err = a.read()
+		}
+		if err != nil {
+			// Avisa uma vez; a lista anterior continua valendo
+			if !failing {
+				a.log.Errorf("❌ -allow-file não relido, mantida a lista atual: %v", err)
+			}
+			failing = true
+			continue
+		}
+		failing = false
+		a.info = info
+		a.log.Infof("🔄 -allow-file relido: %d faixas", len(a.list()))
+	}
+}
+
+func (a *allowFile) list() []*net.IPNet {
+	return *a.nets.Load()
+}
@@ -0,0 +1,109 @@
+// Log de auditoria (-audit-log): arquivo separado, só com append, com uma
+// linha JSON por conexão aberta/fechada e por comando repassado ao TS. Do
+// comando vai só o nome, nunca os parâmetros (login leva a senha).
+//
+//	{"ts":"2026-01-10T12:00:01.5Z","event":"command","conn_id":17,"client":"203.0.113.7","verb":"clientlist"}
+
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+)
+
+type auditRecord struct {
+	TS     string `json:"ts"`
+	Event  string `json:"event"` // connect, command, disconnect
+	ConnID uint64 `json:"conn_id"`
+	Client string `json:"client"`
+	Target string `json:"target,omitempty"`
+	Verb   string `json:"verb,omitempty"`
+}
+
+type auditLog struct {
+	path string
+	log  *Logger
+
+	mu      sync.Mutex // serializa as escritas das conexões e o reopen
+	file    *os.File   // nil até o open() do Start()
+	failing bool       // já avisou do erro de escrita; avisa de novo só depois de voltar
+}
+
+func newAuditLog(path string, logger *Logger) *auditLog {
+	return &auditLog{path: path, log: logger}
+}
+
+func (a *auditLog) open() error {
+	f, err := openAppend(a.path)
+	if err != nil {
+		return err
+	}
+	a.mu.Lock()
+	a.file = f
+	a.mu.Unlock()
+	return nil
+}
+
+func openAppend(path string) (*os.File, error) {
+	return os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+}
+
+func (a *auditLog) record(event string, connID uint64, client, target, verb string) {
+	line, _ := json.Marshal(auditRecord{
+		TS:     time.Now().UTC().Format(time.RFC3339Nano),
+		Event:  event,
+		ConnID: connID,
+		Client: client,
+		Target: target,
+		Verb:   verb,
+	})
+	line = append(line, '\n')
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.file == nil {
+		return
+	}
+	if _, err := a.file.Write(line); err != nil {
+		if !a.failing {
+			a.log.Errorf("❌ Erro ao escrever no log de auditoria %s: %v", a.path, err)
+		}
+		a.failing = true
+		return
+	}
+	a.failing = false
+}
+
+// Reabre o arquivo (SIGHUP), para o logrotate poder mover o antigo. Se
+// não conseguir abrir, continua no arquivo atual.
+func (a *auditLog) reopen() {
+	a.mu.Lock()
+	started := a.file != nil
+	a.mu.Unlock()
+	if !started {
+		return
+	}
+
+	f, err := openAppend(a.path)
+	if err != nil {
+		a.log.Errorf("❌ Log de auditoria não reaberto, mantido o atual: %v", err)
+		return
+	}
+	a.mu.Lock()
+	old := a.file
+	a.file = f
+	a.mu.Unlock()
+	old.Close()
+	a.log.Infof("🔄 Log de auditoria reaberto: %s", a.path)
+}
+
+func (a *auditLog) close() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.file != nil {
+		a.file.Close()
+		a.file = nil
+	}
+}
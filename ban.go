@@ -0,0 +1,143 @@
+// Banimento automático (-ban-threshold): o IP que acumula N recusas dentro
+// de -ban-window (rate limit de conexões ou de comandos, linha grande
+// demais, comando malformado no -strict-protocol) fica banido por
+// -ban-duration. Enquanto isso, as conexões dele são recusadas logo no
+// accept, sem passar pelo rate limit. A chave é a mesma do rate limit
+// (ipKey), então um /64 IPv6 é banido inteiro.
+
+package main
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Recusas de um IP dentro da janela atual
+type strikes struct {
+	count int
+	first time.Time
+}
+
+type banList struct {
+	mu        sync.Mutex
+	threshold int
+	window    time.Duration
+	duration  time.Duration
+	strikes   map[string]*strikes
+	bans      map[string]time.Time // IP → fim do banimento
+}
+
+func newBanList(threshold int, window, duration time.Duration) *banList {
+	return &banList{
+		threshold: threshold,
+		window:    window,
+		duration:  duration,
+		strikes:   make(map[string]*strikes),
+		bans:      make(map[string]time.Time),
+	}
+}
+
+// Conta uma recusa do IP; devolve true se ela completou o limite e o IP
+// acabou de ser banido
+func (b *banList) strike(ip string) bool {
+	if ip == "" {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	if until, ok := b.bans[ip]; ok && now.Before(until) {
+		return false
+	}
+	s, ok := b.strikes[ip]
+	if !ok || now.Sub(s.first) > b.window {
+		s = &strikes{first: now}
+		b.strikes[ip] = s
+	}
+	s.count++
+	if s.count < b.threshold {
+		return false
+	}
+	delete(b.strikes, ip)
+	b.bans[ip] = now.Add(b.duration)
+	return true
+}
+
+// Fim do banimento do IP, se ele estiver banido agora
+func (b *banList) banned(ip string) (time.Time, bool) {
+	if ip == "" {
+		return time.Time{}, false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	until, ok := b.bans[ip]
+	if !ok || !time.Now().Before(until) {
+		return time.Time{}, false
+	}
+	return until, true
+}
+
+// Tira o banimento (e as recusas acumuladas) do IP; false se não estava banido
+func (b *banList) unban(ip string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.strikes, ip)
+	until, ok := b.bans[ip]
+	delete(b.bans, ip)
+	return ok && time.Now().Before(until)
+}
+
+// Banimento em GET /bans
+type BanSnapshot struct {
+	IP               string // IP ou rede, como no rate limit
+	Until            time.Time
+	RemainingSeconds float64
+}
+
+// Banimentos em vigor, do que termina antes para o que termina depois
+func (b *banList) snapshot() []BanSnapshot {
+	b.mu.Lock()
+	now := time.Now()
+	list := make([]BanSnapshot, 0, len(b.bans))
+	for ip, until := range b.bans {
+		if now.Before(until) {
+			list = append(list, BanSnapshot{IP: ip, Until: until, RemainingSeconds: until.Sub(now).Seconds()})
+		}
+	}
+	b.mu.Unlock()
+
+	sort.Slice(list, func(i, j int) bool { return list[i].Until.Before(list[j].Until) })
+	return list
+}
+
+// Remove os banimentos vencidos e as recusas de janelas já encerradas
+// (chamada pelo runCleanup do proxy)
+func (b *banList) sweep() {
+	b.mu.Lock()
+	now := time.Now()
+	for ip, until := range b.bans {
+		if !now.Before(until) {
+			delete(b.bans, ip)
+		}
+	}
+	for ip, s := range b.strikes {
+		if now.Sub(s.first) > b.window {
+			delete(b.strikes, ip)
+		}
+	}
+	b.mu.Unlock()
+}
+
+// Conta uma recusa do endereço no -ban-threshold; devolve true se o IP
+// acabou de ser banido (a conexão atual deve cair)
+func (p *Proxy) strike(ip string) bool {
+	if p.bans == nil || !p.bans.strike(ip) {
+		return false
+	}
+	atomic.AddUint64(&p.stats.Bans, 1)
+	p.log.Warnf("🔨 IP banido por %v: %s (%d recusas em %v)", p.config.BanDuration, ip, p.config.BanThreshold, p.config.BanWindow)
+	return true
+}
@@ -0,0 +1,98 @@
+// Limite de banda por conexão (-conn-bandwidth): cada direção lê no máximo
+// N bytes/s, com um token bucket na leitura do cliente e na do TS. Ler
+// devagar segura o TCP do outro lado, então um clientdblist enorme chega
+// ao cliente no ritmo do limite em vez de ocupar o link inteiro.
+
+package main
+
+import (
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// Rajada do bucket, em tempo de banda: leituras de no máximo 50ms do
+// limite, seguidas da pausa proporcional, em vez de um bloco grande e uma
+// pausa longa
+const bandwidthBurst = 50 * time.Millisecond
+
+// Menor leitura permitida, para limites baixos não virarem leituras de
+// poucos bytes
+const minBandwidthChunk = 512
+
+// Token bucket em bytes. Só a goroutine da leitura mexe: sem lock.
+type byteBucket struct {
+	rate   float64 // bytes por segundo
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newByteBucket(rate int) *byteBucket {
+	burst := float64(rate) * bandwidthBurst.Seconds()
+	if burst < minBandwidthChunk {
+		burst = minBandwidthChunk
+	}
+	return &byteBucket{rate: float64(rate), burst: burst, tokens: burst, last: time.Now()}
+}
+
+// Desconta n bytes e devolve quanto esperar até o saldo voltar a zero
+func (b *byteBucket) take(n int) time.Duration {
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// Leitura limitada pelo bucket. A pausa vem depois de cada leitura, do
+// tamanho do que foi lido, e termina antes se a conexão fechar.
+type throttledReader struct {
+	r         io.Reader
+	bucket    *byteBucket
+	closed    <-chan struct{}
+	throttled func() // chamada a cada pausa (para as estatísticas)
+}
+
+func newThrottledReader(r io.Reader, rate int, closed <-chan struct{}, throttled func()) *throttledReader {
+	return &throttledReader{r: r, bucket: newByteBucket(rate), closed: closed, throttled: throttled}
+}
+
+func (t *throttledReader) Read(b []byte) (int, error) {
+	if max := int(t.bucket.burst); len(b) > max {
+		b = b[:max]
+	}
+	n, err := t.r.Read(b)
+	if n > 0 {
+		if wait := t.bucket.take(n); wait > 0 {
+			t.throttled()
+			timer := time.NewTimer(wait)
+			select {
+			case <-timer.C:
+			case <-t.closed:
+				timer.Stop()
+			}
+		}
+	}
+	return n, err
+}
+
+// Leitura de um lado da conexão, limitada pelo -conn-bandwidth quando
+// configurado. A conexão conta em ThrottledConnections na primeira pausa.
+func (p *Proxy) shaped(conn net.Conn, ac *activeConn) io.Reader {
+	if p.config.ConnBandwidth <= 0 {
+		return conn
+	}
+	return newThrottledReader(conn, p.config.ConnBandwidth, ac.closed, func() {
+		if atomic.CompareAndSwapUint32(&ac.throttled, 0, 1) {
+			atomic.AddUint64(&p.stats.ThrottledConnections, 1)
+		}
+	})
+}
@@ -0,0 +1,143 @@
+// Circuit breaker por destino (-breaker-threshold): depois de N falhas
+// seguidas (discagem de cliente ou health check), o destino fica de fora
+// por -breaker-cooldown, sem receber nem tentativa. Passado o cooldown, uma
+// única tentativa de teste (a próxima conexão ou o próximo health check)
+// decide: sucesso fecha o circuito, falha abre de novo.
+
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// Estados do circuito
+type breakerState int32
+
+const (
+	breakerClosed   breakerState = iota // normal
+	breakerOpen                         // destino pulado até o fim do cooldown
+	breakerHalfOpen                     // uma tentativa de teste em andamento
+)
+
+var breakerStateNames = [...]string{"closed", "open", "half-open"}
+
+func (s breakerState) String() string { return breakerStateNames[s] }
+
+type breaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	mu       sync.Mutex
+	state    breakerState
+	failures int       // falhas seguidas com o circuito fechado
+	openedAt time.Time // início do cooldown
+}
+
+func newBreaker(threshold int, cooldown time.Duration) *breaker {
+	return &breaker{threshold: threshold, cooldown: cooldown}
+}
+
+func (b *breaker) current() breakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+// Destino pode entrar na ordem de tentativa: fechado, ou aberto com o
+// cooldown vencido (a tentativa de teste ainda não saiu). Não muda nada;
+// quem for de fato tentar chama allow().
+func (b *breaker) available() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case breakerOpen:
+		return time.Since(b.openedAt) >= b.cooldown
+	case breakerHalfOpen:
+		return false
+	}
+	return true
+}
+
+// Reserva uma tentativa. Com o cooldown vencido, a primeira chamada vira a
+// tentativa de teste (halfOpened = true) e as seguintes esperam o resultado.
+// Toda tentativa permitida deve terminar em record().
+func (b *breaker) allow() (ok, halfOpened bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case breakerOpen:
+		if time.Since(b.openedAt) < b.cooldown {
+			return false, false
+		}
+		b.state = breakerHalfOpen
+		return true, true
+	case breakerHalfOpen:
+		return false, false
+	}
+	return true, false
+}
+
+// Resultado de uma tentativa (err == nil é sucesso). Devolve o estado
+// depois dela e se mudou.
+func (b *breaker) record(err error) (breakerState, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	prev := b.state
+	switch {
+	case err == nil:
+		b.state = breakerClosed
+		b.failures = 0
+	case b.state == breakerHalfOpen:
+		b.state = breakerOpen
+		b.openedAt = time.Now()
+	case b.state == breakerClosed:
+		b.failures++
+		if b.failures >= b.threshold {
+			b.state = breakerOpen
+			b.openedAt = time.Now()
+			b.failures = 0
+		}
+	}
+	return b.state, b.state != prev
+}
+
+// Reserva uma tentativa no destino (sem -breaker-threshold, sempre pode)
+func (p *Proxy) breakerAllow(t *target) bool {
+	if t.breaker == nil {
+		return true
+	}
+	ok, halfOpened := t.breaker.allow()
+	if halfOpened {
+		p.log.With(logFields{"target": t.addr}).Infof("🔎 Circuito de %s meio aberto: testando o destino", t.addr)
+	}
+	return ok
+}
+
+// Registra o resultado de uma tentativa no destino; loga só as mudanças
+func (p *Proxy) breakerRecord(t *target, err error) {
+	if t.breaker == nil {
+		return
+	}
+	state, changed := t.breaker.record(err)
+	if !changed {
+		return
+	}
+	tlog := p.log.With(logFields{"target": t.addr})
+	switch state {
+	case breakerOpen:
+		tlog.Errorf("⛔ Circuito de %s aberto: destino pulado por %v (%v)", t.addr, p.config.BreakerCooldown, err)
+		p.publish(eventTargetDown, 0, "", t.addr, "circuit open: "+err.Error())
+	case breakerClosed:
+		tlog.Infof("✅ Circuito de %s fechado: destino de volta", t.addr)
+		p.publish(eventTargetUp, 0, "", t.addr, "circuit closed")
+	}
+}
+
+// Estado do circuito para /stats ("closed" sem -breaker-threshold)
+func (t *target) circuit() string {
+	if t.breaker == nil {
+		return breakerClosed.String()
+	}
+	return t.breaker.current().String()
+}
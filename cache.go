@@ -0,0 +1,190 @@
+// Cache de respostas de comandos de leitura (-cache-ttl). Um comando
+// cacheável com resposta fresca é respondido pelo proxy sem tocar no TS.
+
+package main
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Máximo de entradas por cache, para o mapa não crescer sem limite
+const maxCacheEntries = 1000
+
+// -cache-error-line: o que vai no fim de uma resposta servida do cache
+const (
+	cacheErrorVerbatim   = "verbatim"   // a linha "error id=" que o TS mandou
+	cacheErrorRegenerate = "regenerate" // sempre "error id=0 msg=ok", gerada pelo proxy
+)
+
+// Comandos cujas respostas podem ser servidas do cache
+var cacheableCommands = map[string]bool{
+	"serverinfo": true, "channellist": true, "clientlist": true,
+}
+
+// Comandos que só leem estado do TS: não invalidam o cache. Qualquer outro
+// comando pode alterar o servidor e limpa o cache do destino.
+var readOnlyCommands = map[string]bool{
+	"serverinfo": true, "channellist": true, "clientlist": true,
+	"channelinfo": true, "clientinfo": true, "serverlist": true,
+	"servergrouplist": true, "channelgrouplist": true, "hostinfo": true,
+	"instanceinfo": true, "version": true, "whoami": true, "help": true,
+	"clientfind": true, "channelfind": true, "clientdblist": true,
+	"clientdbinfo": true, "clientgetids": true, "permissionlist": true,
+	"use": true, "login": true, "logout": true, "quit": true,
+	"servernotifyregister": true, "servernotifyunregister": true,
+}
+
+type cacheEntry struct {
+	response []byte
+	stored   time.Time
+	hits     uint64
+}
+
+// Cache de um destino, compartilhado por todas as conexões para ele
+type responseCache struct {
+	ttl        time.Duration
+	regenerate bool // -cache-error-line regenerate
+	mu         sync.Mutex
+	entries    map[string]cacheEntry
+}
+
+func newResponseCache(ttl time.Duration, errorLine string) *responseCache {
+	return &responseCache{
+		ttl:        ttl,
+		regenerate: errorLine == cacheErrorRegenerate,
+		entries:    make(map[string]cacheEntry),
+	}
+}
+
+// Resposta em cache, se ainda dentro do TTL
+func (c *responseCache) get(key string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	if time.Since(e.stored) > c.ttl {
+		delete(c.entries, key)
+		return nil, false
+	}
+	e.hits++
+	c.entries[key] = e
+	return e.response, true
+}
+
+func (c *responseCache) set(key string, response []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.entries) >= maxCacheEntries {
+		c.evictExpiredLocked()
+		if len(c.entries) >= maxCacheEntries {
+			return
+		}
+	}
+	if c.regenerate {
+		response = regenerateErrorLine(response)
+	}
+	c.entries[key] = cacheEntry{response: response, stored: time.Now()}
+}
+
+// Troca a linha "error id=" do fim da resposta por uma de sucesso gerada
+// pelo proxy, sem os campos extras que o TS tenha mandado nela
+func regenerateErrorLine(response []byte) []byte {
+	body := bytes.TrimRight(response, "\r\n")
+	start := bytes.LastIndexByte(body, '\n') + 1
+	if start < len(body) && body[start] == '\r' {
+		start++
+	}
+	out := make([]byte, 0, start+len(cachedErrorLine))
+	out = append(out, response[:start]...)
+	return append(out, cachedErrorLine...)
+}
+
+var cachedErrorLine = []byte("error id=0 msg=ok\n\r")
+
+// Limpa tudo (um comando que altera o servidor foi repassado, ou
+// POST /cache/flush); devolve quantas entradas havia
+func (c *responseCache) flush() int {
+	c.mu.Lock()
+	n := len(c.entries)
+	c.entries = make(map[string]cacheEntry)
+	c.mu.Unlock()
+	return n
+}
+
+// Entrada do cache em GET /cache
+type CacheEntrySnapshot struct {
+	Target     string
+	Scope      string // login e use da conexão que gravou a resposta
+	Command    string
+	AgeSeconds float64
+	Hits       uint64
+}
+
+// Entradas ainda dentro do TTL (as vencidas só saem no próximo get/set)
+func (c *responseCache) snapshot(target string) []CacheEntrySnapshot {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var list []CacheEntrySnapshot
+	for key, e := range c.entries {
+		age := time.Since(e.stored)
+		if age > c.ttl {
+			continue
+		}
+		scope, cmd, _ := strings.Cut(key, "\x00")
+		list = append(list, CacheEntrySnapshot{
+			Target:     target,
+			Scope:      strings.TrimSpace(scope),
+			Command:    cmd,
+			AgeSeconds: age.Seconds(),
+			Hits:       e.hits,
+		})
+	}
+	return list
+}
+
+func (c *responseCache) evictExpiredLocked() {
+	for key, e := range c.entries {
+		if time.Since(e.stored) > c.ttl {
+			delete(c.entries, key)
+		}
+	}
+}
+
+// Chave do cache: o comando exato, dentro do servidor virtual selecionado
+// pelo "use" e com o login da conexão (o mesmo serverinfo responde
+// diferente por sid, e o clientlist depende das permissões do login)
+func cacheKey(scope string, cmd []byte) string {
+	return scope + "\x00" + string(bytes.TrimSpace(cmd))
+}
+
+// Login ou "use" enviado ao TS. O escopo do cache da conexão só muda
+// quando a resposta chega com error id=0: um "login serveradmin senha-errada"
+// não pode ler o que uma sessão serveradmin de verdade guardou.
+type scopeChange struct {
+	login bool   // login (senão, use)
+	value string // usuário do login ou a linha do use
+}
+
+// Usuário de um comando login, nas formas "login usuario senha" e
+// "login client_login_name=usuario client_login_password=senha"; a senha
+// nunca entra na chave do cache
+func loginUser(line []byte) string {
+	fields := strings.Fields(string(line))
+	for _, f := range fields[1:] {
+		if strings.HasPrefix(f, "client_login_name=") {
+			return strings.TrimPrefix(f, "client_login_name=")
+		}
+	}
+	if len(fields) > 1 {
+		return fields[1]
+	}
+	return ""
+}
@@ -0,0 +1,151 @@
+// Parse dos comandos ServerQuery: nome, parâmetros chave=valor escapados,
+// opções "-nome" e listas separadas por '|'. Usado pelo -strict-protocol
+// para barrar linhas malformadas antes do TS.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// Erros de parse; todos envolvem ErrMalformedCommand
+var ErrMalformedCommand = errors.New("comando malformado")
+
+// Comando ServerQuery já com os valores sem escape. Em
+// "clientkick reasonid=5 clid=1|clid=2" há dois itens em Params.
+type Command struct {
+	Name    string
+	Args    []string            // parâmetros posicionais (ex: login usuario senha)
+	Params  []map[string]string // um mapa por item da lista separada por '|'
+	Options []string            // opções sem o '-' (ex: clientlist -uid)
+}
+
+// Sequências de escape do ServerQuery, na volta
+var tsUnescapes = map[byte]byte{
+	'\\': '\\', '/': '/', 's': ' ', 'p': '|',
+	'a': '\a', 'b': '\b', 'f': '\f', 'n': '\n', 'r': '\r', 't': '\t', 'v': '\v',
+}
+
+// Escapa um valor para o ServerQuery (inverso de tsUnescape)
+func tsEscape(s string) string {
+	return tsEscaper.Replace(s)
+}
+
+// Desfaz o escape do ServerQuery; barra invertida sem sequência válida é erro
+func tsUnescape(s string) (string, error) {
+	if !strings.Contains(s, `\`) {
+		return s, nil
+	}
+
+	var b strings.Builder
+	b.Grow(len(s))
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			b.WriteByte(s[i])
+			continue
+		}
+		if i+1 == len(s) {
+			return "", fmt.Errorf("%w: barra invertida no fim de %q", ErrMalformedCommand, s)
+		}
+		c, ok := tsUnescapes[s[i+1]]
+		if !ok {
+			return "", fmt.Errorf("%w: escape inválido \\%c", ErrMalformedCommand, s[i+1])
+		}
+		b.WriteByte(c)
+		i++
+	}
+	return b.String(), nil
+}
+
+// Maior identidade guardada por conexão (o TS limita o nickname a 30)
+const maxIdentityLen = 64
+
+// Identidade que o cliente declara no login (usuário) ou no clientupdate
+// (client_nickname), já sem escape e sem caracteres de controle, pronta
+// para ir ao log. Linha que não faz parse não identifica ninguém.
+func clientIdentity(line []byte) (login, nickname string) {
+	cmd, err := parseCommand(line)
+	if err != nil {
+		return "", ""
+	}
+	switch cmd.Name {
+	case "login":
+		if len(cmd.Params) > 0 && cmd.Params[0]["client_login_name"] != "" {
+			login = cmd.Params[0]["client_login_name"]
+		} else if len(cmd.Args) > 0 {
+			login = cmd.Args[0]
+		}
+	case "clientupdate":
+		if len(cmd.Params) > 0 {
+			nickname = cmd.Params[0]["client_nickname"]
+		}
+	}
+	return printableIdentity(login), printableIdentity(nickname)
+}
+
+func printableIdentity(s string) string {
+	s = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, s)
+	if r := []rune(s); len(r) > maxIdentityLen {
+		s = string(r[:maxIdentityLen])
+	}
+	return s
+}
+
+// Faz o parse de uma linha de comando (com ou sem o terminador)
+func parseCommand(line []byte) (Command, error) {
+	text := strings.TrimRight(strings.TrimLeft(string(line), "\r"), "\r\n")
+	for i := 0; i < len(text); i++ {
+		if c := text[i]; c < 0x20 || c == 0x7f {
+			return Command{}, fmt.Errorf("%w: caractere de controle 0x%02x", ErrMalformedCommand, c)
+		}
+	}
+
+	name, rest, _ := strings.Cut(strings.TrimSpace(text), " ")
+	if name == "" {
+		return Command{}, fmt.Errorf("%w: linha vazia", ErrMalformedCommand)
+	}
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_') {
+			return Command{}, fmt.Errorf("%w: nome de comando inválido %q", ErrMalformedCommand, name)
+		}
+	}
+
+	cmd := Command{Name: strings.ToLower(name)}
+	for _, item := range strings.Split(rest, "|") {
+		params := make(map[string]string)
+		for _, token := range strings.Fields(item) {
+			key, value, hasValue := strings.Cut(token, "=")
+			switch {
+			case !hasValue && strings.HasPrefix(token, "-") && len(token) > 1:
+				cmd.Options = append(cmd.Options, token[1:])
+			case !hasValue:
+				arg, err := tsUnescape(token)
+				if err != nil {
+					return Command{}, err
+				}
+				cmd.Args = append(cmd.Args, arg)
+			case key == "":
+				return Command{}, fmt.Errorf("%w: parâmetro sem nome %q", ErrMalformedCommand, token)
+			default:
+				v, err := tsUnescape(value)
+				if err != nil {
+					return Command{}, err
+				}
+				params[key] = v
+			}
+		}
+		if len(params) > 0 {
+			cmd.Params = append(cmd.Params, params)
+		}
+	}
+	return cmd, nil
+}
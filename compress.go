@@ -0,0 +1,123 @@
+// Compressão opcional do sentido TS → cliente (-allow-compression), para
+// clientes em link lento que puxam respostas enormes (clientdblist com
+// milhares de entradas). Não existe no ServerQuery: só liga se o cliente
+// pedir, antes do primeiro comando, com a linha
+//
+//	batqa-compress gzip
+//
+// (ou deflate). O proxy responde "error id=0 msg=ok" ainda em texto puro e,
+// dali em diante, tudo que vai para o cliente sai comprimido, com um flush
+// a cada linha. O sentido cliente → TS continua em texto puro.
+
+package main
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+// Comando do pedido de compressão; nunca chega no TS
+const compressCommand = "batqa-compress"
+
+type compressor interface {
+	io.Writer
+	Flush() error
+	Close() error
+}
+
+// Compressor do algoritmo pedido pelo cliente (nil se não for um conhecido)
+func newCompressor(algo string, w io.Writer) compressor {
+	switch algo {
+	case "gzip":
+		return gzip.NewWriter(w)
+	case "deflate":
+		z, _ := flate.NewWriter(w, flate.DefaultCompression)
+		return z
+	}
+	return nil
+}
+
+// Conta os bytes que de fato saem para a conexão
+type countingWriter struct {
+	w io.Writer
+	n uint64
+}
+
+func (c *countingWriter) Write(b []byte) (int, error) {
+	n, err := c.w.Write(b)
+	c.n += uint64(n)
+	return n, err
+}
+
+// Saída para o cliente, compartilhada pelas goroutines do pipe (respostas
+// do TS, erros do proxy e respostas do cache). Cada Write sai inteiro na
+// conexão, comprimido ou não.
+type clientWriter struct {
+	conn  net.Conn
+	stats *Stats
+
+	mu       sync.Mutex
+	z        compressor // nil = sem compressão
+	wire     countingWriter
+	finished bool // fluxo comprimido já fechado: nada mais sai
+}
+
+func newClientWriter(conn net.Conn, stats *Stats) *clientWriter {
+	return &clientWriter{conn: conn, stats: stats, wire: countingWriter{w: conn}}
+}
+
+func (w *clientWriter) Write(b []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.finished {
+		return 0, net.ErrClosed
+	}
+	if w.z == nil {
+		return w.conn.Write(b)
+	}
+
+	before := w.wire.n
+	n, err := w.z.Write(b)
+	if err == nil {
+		err = w.z.Flush()
+	}
+	atomic.AddUint64(&w.stats.UncompressedBytes, uint64(n))
+	atomic.AddUint64(&w.stats.CompressedBytes, w.wire.n-before)
+	return n, err
+}
+
+// Confirma o pedido em texto puro e liga a compressão para o que vier depois
+func (w *clientWriter) compress(algo string) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err := writeError(w.conn, 0, "ok"); err != nil {
+		return err
+	}
+	w.z = newCompressor(algo, &w.wire)
+	atomic.AddUint64(&w.stats.CompressedConnections, 1)
+	return nil
+}
+
+func (w *clientWriter) compressing() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.z != nil
+}
+
+// Fecha o fluxo comprimido (trailer do gzip), para o cliente ver o fim
+// dele antes do fim da conexão
+func (w *clientWriter) finish() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.z == nil {
+		return
+	}
+	before := w.wire.n
+	w.z.Close()
+	atomic.AddUint64(&w.stats.CompressedBytes, w.wire.n-before)
+	w.finished = true
+}
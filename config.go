@@ -0,0 +1,216 @@
+// Arquivo de configuração (-config): um JSON cujas chaves são os nomes das
+// flags, sem o hífen inicial. Os valores passam pelo mesmo parse das flags,
+// e uma flag passada na linha de comando vence o valor do arquivo.
+//
+//	{
+//	  "listen": ":10202",
+//	  "target": ["localhost:10011", "localhost:10021"],
+//	  "max-conns": 200,
+//	  "drain-timeout": "15s"
+//	}
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Aplica o arquivo nas flags que não foram passadas na linha de comando
+func loadConfigFile(fs *flag.FlagSet, path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var values map[string]json.RawMessage
+	if err := json.Unmarshal(data, &values); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	// Ordem fixa, para o mesmo arquivo dar sempre o mesmo erro
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if fs.Lookup(name) == nil || name == "config" {
+			return fmt.Errorf("%s: chave desconhecida %q", path, name)
+		}
+		if set[name] {
+			continue
+		}
+		value, err := configValue(values[name])
+		if err != nil {
+			return fmt.Errorf("%s: %s: %w", path, name, err)
+		}
+		if err := fs.Set(name, value); err != nil {
+			return fmt.Errorf("%s: %s: %w", path, name, err)
+		}
+	}
+	return nil
+}
+
+// Tamanho em bytes para flags, aceitando os sufixos k e m (base 1024),
+// também como kb e mb: "65536", "64k", "1m", "1MB"
+type byteSize int
+
+func (b *byteSize) String() string {
+	switch n := int(*b); {
+	case n > 0 && n%(1<<20) == 0:
+		return strconv.Itoa(n>>20) + "m"
+	case n > 0 && n%(1<<10) == 0:
+		return strconv.Itoa(n>>10) + "k"
+	default:
+		return strconv.Itoa(n)
+	}
+}
+
+func (b *byteSize) Set(s string) error {
+	num, mult := strings.ToLower(strings.TrimSpace(s)), 1
+	if strings.HasSuffix(num, "kb") || strings.HasSuffix(num, "mb") {
+		num = strings.TrimSuffix(num, "b")
+	}
+	switch {
+	case strings.HasSuffix(num, "k"):
+		num, mult = strings.TrimSuffix(num, "k"), 1<<10
+	case strings.HasSuffix(num, "m"):
+		num, mult = strings.TrimSuffix(num, "m"), 1<<20
+	}
+	n, err := strconv.Atoi(num)
+	if err != nil || n < 0 {
+		return fmt.Errorf("tamanho inválido %q (ex: 4096, 64k, 1m)", s)
+	}
+	*b = byteSize(n * mult)
+	return nil
+}
+
+// Limite de tamanho da resposta por verbo (-response-limit), no formato
+// "clientdblist=10m,channellist=1m". O verbo vai em minúsculas, como o
+// commandVerb devolve.
+type responseLimits map[string]int
+
+func (r *responseLimits) String() string {
+	verbs := make([]string, 0, len(*r))
+	for verb := range *r {
+		verbs = append(verbs, verb)
+	}
+	sort.Strings(verbs)
+	for i, verb := range verbs {
+		size := byteSize((*r)[verb])
+		verbs[i] = verb + "=" + size.String()
+	}
+	return strings.Join(verbs, ",")
+}
+
+func (r *responseLimits) Set(s string) error {
+	limits := make(responseLimits)
+	for _, item := range splitList(s) {
+		verb, value, ok := strings.Cut(item, "=")
+		verb = strings.ToLower(strings.TrimSpace(verb))
+		if !ok || verb == "" {
+			return fmt.Errorf("limite inválido %q (ex: clientdblist=10m)", item)
+		}
+		var size byteSize
+		if err := size.Set(value); err != nil {
+			return fmt.Errorf("%s: %w", verb, err)
+		}
+		if size > 0 {
+			limits[verb] = int(size)
+		}
+	}
+	*r = limits
+	return nil
+}
+
+// Destinos por nome do SNI (-sni-route), no formato
+// "querya.example.com=10.0.0.1:10011,queryb.example.com=10.0.0.2:10011".
+// Repetir o nome soma destinos a ele. O nome vai em minúsculas e sem o
+// ponto final, como o sniName compara.
+type sniRoutes map[string][]string
+
+func (r *sniRoutes) String() string {
+	names := make([]string, 0, len(*r))
+	for name := range *r {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var items []string
+	for _, name := range names {
+		for _, addr := range (*r)[name] {
+			items = append(items, name+"="+addr)
+		}
+	}
+	return strings.Join(items, ",")
+}
+
+func (r *sniRoutes) Set(s string) error {
+	routes := make(sniRoutes)
+	for _, item := range splitList(s) {
+		name, addr, ok := strings.Cut(item, "=")
+		name, addr = sniName(strings.TrimSpace(name)), strings.TrimSpace(addr)
+		if !ok || name == "" {
+			return fmt.Errorf("rota inválida %q (ex: querya.example.com=10.0.0.1:10011)", item)
+		}
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return fmt.Errorf("%s: destino inválido %q: %w", name, addr, err)
+		}
+		routes[name] = append(routes[name], addr)
+	}
+	*r = routes
+	return nil
+}
+
+// Nome do SNI como entra no -sni-route: DNS não diferencia maiúsculas, e
+// o ponto final do nome absoluto não muda o destino
+func sniName(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
+
+// Separa uma lista de flag ("a, b,c"), ignorando itens vazios
+func splitList(list string) []string {
+	var items []string
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// Converte um valor JSON no texto que a flag espera: strings como estão,
+// listas de strings juntadas por vírgula, números e booleanos literais
+func configValue(raw json.RawMessage) (string, error) {
+	var str string
+	if err := json.Unmarshal(raw, &str); err == nil {
+		return str, nil
+	}
+
+	var list []string
+	if err := json.Unmarshal(raw, &list); err == nil {
+		return strings.Join(list, ","), nil
+	}
+
+	var number json.Number
+	if err := json.Unmarshal(raw, &number); err == nil {
+		return number.String(), nil
+	}
+
+	var b bool
+	if err := json.Unmarshal(raw, &b); err == nil {
+		return fmt.Sprint(b), nil
+	}
+
+	return "", fmt.Errorf("valor inválido %s (use string, número, booleano ou lista de strings)", raw)
+}
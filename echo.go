@@ -0,0 +1,49 @@
+// Modo echo (-echo): no lugar do TS, um servidor falso em memória manda o
+// banner e responde "error id=0 msg=ok" a todo comando. Serve para testar
+// clientes e fazer teste de carga no próprio proxy sem um TeamSpeak.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+)
+
+const echoBanner = "TS3\n\rWelcome to the TeamSpeak 3 ServerQuery interface, type \"help\" for a list of commands and \"help <command>\" for information on a specific command.\n\r"
+
+var echoReply = []byte("error id=0 msg=ok\n\r")
+
+// Conexão com o TS falso; o proxy usa como uma conexão TCP qualquer
+func newEchoConn() net.Conn {
+	proxySide, echoSide := net.Pipe()
+	go serveEcho(echoSide)
+	return proxySide
+}
+
+func serveEcho(conn net.Conn) {
+	defer conn.Close()
+	if _, err := conn.Write([]byte(echoBanner)); err != nil {
+		return
+	}
+
+	reader := bufio.NewReader(conn)
+	var buf []byte
+	for {
+		line, err := readLineBuf(reader, buf, 0)
+		if err != nil {
+			return
+		}
+		buf = line[:0]
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		if _, err := conn.Write(echoReply); err != nil {
+			return
+		}
+		// Como o TS: responde o quit e fecha
+		if commandVerb(line) == "quit" {
+			return
+		}
+	}
+}
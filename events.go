@@ -0,0 +1,131 @@
+// Eventos em tempo real (GET /events no -stats-addr), como Server-Sent
+// Events: uma linha "data:" com um JSON por conexão aberta, fechada ou
+// recusada e por destino que cai ou volta. Para dashboards; quem quer
+// histórico usa o -audit-log.
+//
+//	data: {"ts":"2026-01-10T12:00:01.5Z","event":"connection_open","conn_id":17,"client":"203.0.113.7","target":"localhost:10011"}
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Tipos de evento
+const (
+	eventConnectionOpen  = "connection_open"
+	eventConnectionClose = "connection_close"
+	eventRejected        = "rejected"
+	eventTargetDown      = "target_down"
+	eventTargetUp        = "target_up"
+)
+
+// Eventos guardados por assinante enquanto ele não lê; passou disso, os
+// novos são descartados para esse assinante
+const eventBufferSize = 256
+
+// Intervalo do comentário de keepalive do stream, para proxies HTTP no
+// meio do caminho não fecharem a conexão parada
+const eventKeepaliveInterval = 30 * time.Second
+
+type Event struct {
+	TS     string `json:"ts"`
+	Event  string `json:"event"`
+	ConnID uint64 `json:"conn_id,omitempty"`
+	Client string `json:"client,omitempty"` // IP, sem a porta
+	Target string `json:"target,omitempty"`
+	Reason string `json:"reason,omitempty"` // motivo da recusa ou da queda do destino
+}
+
+// Assinantes de /events. publish nunca bloqueia: um assinante lento só
+// perde os próprios eventos.
+type eventHub struct {
+	mu      sync.Mutex
+	subs    map[chan Event]struct{}
+	dropped uint64 // eventos descartados em assinantes lentos (atomic)
+}
+
+func newEventHub() *eventHub {
+	return &eventHub{subs: make(map[chan Event]struct{})}
+}
+
+func (h *eventHub) subscribe() chan Event {
+	ch := make(chan Event, eventBufferSize)
+	h.mu.Lock()
+	h.subs[ch] = struct{}{}
+	h.mu.Unlock()
+	return ch
+}
+
+func (h *eventHub) unsubscribe(ch chan Event) {
+	h.mu.Lock()
+	delete(h.subs, ch)
+	h.mu.Unlock()
+}
+
+func (h *eventHub) publish(e Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.subs) == 0 {
+		return
+	}
+	e.TS = time.Now().UTC().Format(time.RFC3339Nano)
+	for ch := range h.subs {
+		select {
+		case ch <- e:
+		default:
+			atomic.AddUint64(&h.dropped, 1)
+		}
+	}
+}
+
+// Atalho para os pontos de publicação no proxy
+func (p *Proxy) publish(event string, connID uint64, client, target, reason string) {
+	p.events.publish(Event{Event: event, ConnID: connID, Client: client, Target: target, Reason: reason})
+}
+
+func (p *Proxy) handleEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "método não permitido", http.StatusMethodNotAllowed)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming não suportado", http.StatusInternalServerError)
+		return
+	}
+
+	ch := p.events.subscribe()
+	defer p.events.unsubscribe(ch)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepalive := time.NewTicker(eventKeepaliveInterval)
+	defer keepalive.Stop()
+	for {
+		select {
+		case e := <-ch:
+			data, _ := json.Marshal(e)
+			if _, err := fmt.Fprintf(w, "data: %s\n\n", data); err != nil {
+				return
+			}
+		case <-keepalive.C:
+			if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		case <-p.shutdown:
+			return
+		}
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,165 @@
+// Reinício sem queda (SIGUSR1): o processo passa o socket de escuta para
+// uma cópia nova do próprio binário (fd herdado, avisado pela variável
+// BATQA_LISTEN_FD), que começa a aceitar na hora. Quando o novo processo
+// está escutando, ele avisa por um pipe (BATQA_READY_FD); só então o
+// processo antigo para de aceitar, deixa as sessões que já tem terminarem
+// por até -handoff-timeout, drena o que sobrou (-drain-timeout) e sai. Se
+// o novo processo morre ou não avisa a tempo, o antigo segue no ar.
+//
+//	cp batqa-proxy.novo /usr/local/bin/batqa-proxy
+//	kill -USR1 $(pidof batqa-proxy)
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"time"
+)
+
+const (
+	listenFDEnv = "BATQA_LISTEN_FD"
+	readyFDEnv  = "BATQA_READY_FD"
+
+	// Quanto o processo antigo espera o novo ficar pronto
+	handoffReadyTimeout = 30 * time.Second
+)
+
+var ErrHandoff = errors.New("reinício sem queda falhou")
+
+// Listener herdado do processo anterior, ou nil se o processo foi
+// iniciado normalmente
+func inheritedListener() (net.Listener, error) {
+	v := os.Getenv(listenFDEnv)
+	if v == "" {
+		return nil, nil
+	}
+	// Não passa adiante para processos filhos (o próximo handoff define de novo)
+	os.Unsetenv(listenFDEnv)
+
+	fd, err := strconv.Atoi(v)
+	if err != nil || fd < 3 {
+		return nil, fmt.Errorf("%s inválido: %q", listenFDEnv, v)
+	}
+	f := os.NewFile(uintptr(fd), "listener")
+	defer f.Close() // o FileListener fica com uma cópia do fd
+	ln, err := net.FileListener(f)
+	if err != nil {
+		return nil, fmt.Errorf("fd %d herdado: %w", fd, err)
+	}
+	// O socket unix volta a ser apagado no Close(), como num início normal
+	if ul, ok := ln.(*net.UnixListener); ok {
+		ul.SetUnlinkOnClose(true)
+	}
+	return ln, nil
+}
+
+// Avisa o processo anterior que este já está aceitando conexões (e com o
+// servidor HTTP no ar). Sem handoff não faz nada.
+func notifyReady() error {
+	v := os.Getenv(readyFDEnv)
+	if v == "" {
+		return nil
+	}
+	os.Unsetenv(readyFDEnv)
+
+	fd, err := strconv.Atoi(v)
+	if err != nil || fd < 3 {
+		return fmt.Errorf("%s inválido: %q", readyFDEnv, v)
+	}
+	f := os.NewFile(uintptr(fd), "ready")
+	defer f.Close()
+	_, err = f.Write([]byte{1})
+	return err
+}
+
+// Inicia o novo processo com uma cópia do fd de escuta, espera ele ficar
+// pronto e devolve o pid. O servidor HTTP de estatísticas é parado antes,
+// para o novo processo conseguir abrir a mesma porta; se o novo processo
+// não sobe, ele volta e este processo segue aceitando. Quem chama deve
+// fazer o Stop() em seguida.
+func (p *Proxy) handoff() (int, error) {
+	p.mu.Lock()
+	ln := p.netListener
+	stopping := p.stopping()
+	p.mu.Unlock()
+	if ln == nil || stopping {
+		return 0, fmt.Errorf("%w: proxy não está aceitando conexões", ErrHandoff)
+	}
+
+	filer, ok := ln.(interface{ File() (*os.File, error) })
+	if !ok {
+		return 0, fmt.Errorf("%w: listener %T sem fd", ErrHandoff, ln)
+	}
+	f, err := filer.File()
+	if err != nil {
+		return 0, fmt.Errorf("%w: %w", ErrHandoff, err)
+	}
+	defer f.Close()
+
+	exe, err := os.Executable()
+	if err != nil {
+		return 0, fmt.Errorf("%w: %w", ErrHandoff, err)
+	}
+
+	readyR, readyW, err := os.Pipe()
+	if err != nil {
+		return 0, fmt.Errorf("%w: %w", ErrHandoff, err)
+	}
+	defer readyR.Close()
+
+	p.stopHTTP()
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = []*os.File{f, readyW} // viram os fds 3 e 4 no filho
+	cmd.Env = append(os.Environ(), listenFDEnv+"=3", readyFDEnv+"=4")
+	err = cmd.Start()
+	readyW.Close() // sobra só a cópia do filho: se ele morre, a leitura dá EOF
+	if err != nil {
+		p.restartHTTP()
+		return 0, fmt.Errorf("%w: %w", ErrHandoff, err)
+	}
+
+	// Até o aviso, os dois processos aceitam no mesmo socket
+	readyR.SetReadDeadline(time.Now().Add(handoffReadyTimeout))
+	if _, err := readyR.Read(make([]byte, 1)); err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		p.restartHTTP()
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			return 0, fmt.Errorf("%w: novo processo não ficou pronto em %v", ErrHandoff, handoffReadyTimeout)
+		}
+		return 0, fmt.Errorf("%w: novo processo saiu antes de ficar pronto (%s)", ErrHandoff, cmd.ProcessState)
+	}
+
+	// O novo processo é dono do arquivo de socket daqui em diante
+	if ul, ok := ln.(*net.UnixListener); ok {
+		ul.SetUnlinkOnClose(false)
+	}
+	p.handingOff.Store(true)
+	pid := cmd.Process.Pid
+	cmd.Process.Release()
+	return pid, nil
+}
+
+// Volta o servidor HTTP parado para um handoff que não deu certo
+func (p *Proxy) restartHTTP() {
+	if p.config.StatsAddr == "" {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.stopping() {
+		return
+	}
+	if err := p.startHTTP(); err != nil {
+		p.log.Errorf("❌ Servidor de estatísticas não voltou: %v", err)
+	}
+}
@@ -0,0 +1,117 @@
+// Health check dos destinos (-health-interval): em background, cada destino
+// é discado periodicamente e marcado como no ar ou fora do ar. Conexões
+// novas só vão para destinos no ar. O tempo de resposta de cada verificação
+// entra numa média móvel exponencial, usada pelo -balance latency.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Peso da medida nova na média de latência: 0.3 segue uma mudança real em
+// poucas verificações sem deixar uma medida lenta isolada trocar o destino
+const rttEWMAWeight = 0.3
+
+// Destino no ar segundo o último health check (sem health check, sempre)
+func (t *target) isHealthy() bool {
+	return atomic.LoadInt32(&t.down) == 0
+}
+
+// Média de latência do destino (0 = ainda sem medida)
+func (t *target) latency() time.Duration {
+	return time.Duration(atomic.LoadInt64(&t.rtt))
+}
+
+// Soma uma medida à média; só a goroutine do health check escreve
+func (t *target) observeRTT(rtt time.Duration) {
+	avg := t.latency()
+	if avg > 0 {
+		rtt = avg + time.Duration(rttEWMAWeight*float64(rtt-avg))
+	}
+	atomic.StoreInt64(&t.rtt, int64(rtt))
+}
+
+// Marca o estado do destino (err == nil é no ar); loga só as mudanças
+func (p *Proxy) setTargetHealth(t *target, err error) {
+	var down int32
+	if err != nil {
+		down = 1
+	}
+	if atomic.SwapInt32(&t.down, down) == down {
+		return
+	}
+	tlog := p.log.With(logFields{"target": t.addr})
+	if err == nil {
+		tlog.Infof("✅ Destino %s de volta", t.addr)
+		p.publish(eventTargetUp, 0, "", t.addr, "health check")
+	} else {
+		tlog.Errorf("❌ Destino %s fora do ar: %v", t.addr, err)
+		p.publish(eventTargetDown, 0, "", t.addr, err.Error())
+	}
+}
+
+// Verifica todos os destinos a cada HealthInterval (com jitter), até o Stop()
+func (p *Proxy) runHealthChecks() {
+	for {
+		for _, t := range p.targetList() {
+			// Circuito aberto: nem o health check toca no destino até o
+			// cooldown; depois, a verificação pode ser a tentativa de teste
+			if !p.breakerAllow(t) {
+				continue
+			}
+			rtt, err := p.checkTarget(t)
+			p.breakerRecord(t, err)
+			if err == nil {
+				t.observeRTT(rtt)
+			}
+			p.setTargetHealth(t, err)
+		}
+
+		select {
+		case <-time.After(jitter(p.config.HealthInterval, p.config.JitterPct)):
+		case <-p.shutdown:
+			return
+		}
+	}
+}
+
+// Disca o destino e espera o banner; com -health-probe, também exige
+// resposta de sucesso a um "version". Devolve o tempo de resposta: do
+// version, com -health-probe, ou da discagem até o banner.
+func (p *Proxy) checkTarget(t *target) (time.Duration, error) {
+	start := time.Now()
+	conn, err := p.dialTarget(t.addr)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(p.config.Timeout))
+	reader := bufio.NewReader(conn)
+	if _, err := readBanner(reader); err != nil {
+		return 0, fmt.Errorf("erro ao ler banner: %w", err)
+	}
+	if !p.config.HealthProbe {
+		return time.Since(start), nil
+	}
+
+	start = time.Now()
+	if _, err := conn.Write([]byte("version\n")); err != nil {
+		return 0, fmt.Errorf("erro ao enviar version: %w", err)
+	}
+	response, err := readResponse(reader)
+	if err != nil {
+		return 0, fmt.Errorf("erro ao ler resposta do version: %w", err)
+	}
+	rtt := time.Since(start)
+	if last := response[len(response)-1]; !strings.HasPrefix(last, "error id=0 ") {
+		return 0, fmt.Errorf("version recusado: %s", last)
+	}
+	conn.Write([]byte("quit\n"))
+	return rtt, nil
+}
@@ -0,0 +1,304 @@
+// Servidor HTTP opcional com as estatísticas do proxy (-stats-addr):
+// /stats em JSON, /metrics no formato do Prometheus, /connections com as
+// conexões ativas, /version com os dados do build, /healthz e /ready para
+// os probes do orquestrador e /events (events.go). As rotas de administração ficam em
+// admin.go.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// Foto das estatísticas em um instante, no formato servido em /stats
+type StatsSnapshot struct {
+	TotalConnections      uint64
+	ActiveConnections     int64
+	UpstreamConnections   int64
+	TotalCommands         uint64
+	TotalBytes            uint64
+	PacedCommands         uint64
+	RateLimitedCommands   uint64
+	SlowCommands          uint64
+	UnmatchedResponses    uint64
+	MalformedCommands     uint64
+	BlockedCommands       uint64
+	UpstreamClosedEarly   uint64
+	IdleTimeouts          uint64
+	SessionsExpired       uint64
+	ClosedByAdmin         uint64
+	WriteTimeouts         uint64
+	OversizedLines        uint64
+	TruncatedResponses    uint64
+	TSKeepalives          uint64
+	RejectedRateLimit     uint64
+	RejectedGlobalRate    uint64
+	DelayedRateLimit      uint64
+	RejectedUpstreamCap   uint64
+	RejectedMaxConns      uint64
+	RejectedIPCap         uint64
+	RejectedDenylist      uint64
+	RejectedBanned        uint64
+	Bans                  uint64 // banimentos automáticos (-ban-threshold)
+	RejectedDialFailed    uint64
+	RejectedShed          uint64 // -shed-latency
+	RejectedSNI           uint64 // -sni-route
+	DialRetries           uint64
+	RejectedNotReady      uint64
+	CacheHits             uint64
+	CacheMisses           uint64
+	CompressedConnections uint64
+	UncompressedBytes     uint64 // TS → cliente nas conexões comprimidas, antes
+	CompressedBytes       uint64 // e depois da compressão
+	ThrottledConnections  uint64 // seguradas pelo -conn-bandwidth
+	EventsDropped         uint64 // eventos de /events perdidos por assinantes lentos
+	StickyClients         int    // IPs com destino lembrado pelo -balance sticky
+	NearCapacity          bool
+	Draining              bool // POST /drain em vigor
+	UptimeSeconds         float64
+	Targets               []TargetSnapshot
+	Commands              map[string]CommandTiming // tempo de resposta por comando
+	Labels                map[string]LabelSnapshot `json:",omitempty"` // por rótulo (-allow-labels)
+}
+
+// Estado de um destino em /stats
+type TargetSnapshot struct {
+	Addr              string
+	TotalConnections  uint64 // conexões de clientes repassadas a este destino
+	ActiveConnections int64
+	TotalCommands     uint64
+	TotalBytes        uint64
+	Healthy           bool
+	State             string  // active, draining ou unhealthy
+	LatencyMs         float64 // média móvel do health check (0 = sem medida)
+	Circuit           string  // closed, open ou half-open (-breaker-threshold)
+	CommandLatencyMs  float64 // média móvel da resposta aos comandos dos clientes (0 = sem medida recente)
+	ShedRate          float64 // fração das conexões novas descartada agora (-shed-latency)
+	Shed              uint64  // conexões novas desviadas ou recusadas pelo -shed-latency
+}
+
+// Lê os contadores com atomic.Load*, seguro com conexões ativas
+func (p *Proxy) Snapshot() StatsSnapshot {
+	snap := StatsSnapshot{
+		TotalConnections:      atomic.LoadUint64(&p.stats.TotalConnections),
+		ActiveConnections:     atomic.LoadInt64(&p.stats.ActiveConnections),
+		UpstreamConnections:   atomic.LoadInt64(&p.stats.UpstreamConnections),
+		TotalCommands:         atomic.LoadUint64(&p.stats.TotalCommands),
+		TotalBytes:            atomic.LoadUint64(&p.stats.TotalBytes),
+		PacedCommands:         atomic.LoadUint64(&p.stats.PacedCommands),
+		RateLimitedCommands:   atomic.LoadUint64(&p.stats.RateLimitedCommands),
+		SlowCommands:          atomic.LoadUint64(&p.stats.SlowCommands),
+		UnmatchedResponses:    atomic.LoadUint64(&p.stats.UnmatchedResponses),
+		MalformedCommands:     atomic.LoadUint64(&p.stats.MalformedCommands),
+		BlockedCommands:       atomic.LoadUint64(&p.stats.BlockedCommands),
+		UpstreamClosedEarly:   atomic.LoadUint64(&p.stats.UpstreamClosedEarly),
+		IdleTimeouts:          atomic.LoadUint64(&p.stats.IdleTimeouts),
+		SessionsExpired:       atomic.LoadUint64(&p.stats.SessionsExpired),
+		ClosedByAdmin:         atomic.LoadUint64(&p.stats.ClosedByAdmin),
+		WriteTimeouts:         atomic.LoadUint64(&p.stats.WriteTimeouts),
+		OversizedLines:        atomic.LoadUint64(&p.stats.OversizedLines),
+		TruncatedResponses:    atomic.LoadUint64(&p.stats.TruncatedResponses),
+		TSKeepalives:          atomic.LoadUint64(&p.stats.TSKeepalives),
+		RejectedRateLimit:     atomic.LoadUint64(&p.stats.RejectedRateLimit),
+		RejectedGlobalRate:    atomic.LoadUint64(&p.stats.RejectedGlobalRate),
+		DelayedRateLimit:      atomic.LoadUint64(&p.stats.DelayedRateLimit),
+		RejectedUpstreamCap:   atomic.LoadUint64(&p.stats.RejectedUpstreamCap),
+		RejectedMaxConns:      atomic.LoadUint64(&p.stats.RejectedMaxConns),
+		RejectedIPCap:         atomic.LoadUint64(&p.stats.RejectedIPCap),
+		RejectedDenylist:      atomic.LoadUint64(&p.stats.RejectedDenylist),
+		RejectedBanned:        atomic.LoadUint64(&p.stats.RejectedBanned),
+		Bans:                  atomic.LoadUint64(&p.stats.Bans),
+		RejectedDialFailed:    atomic.LoadUint64(&p.stats.RejectedDialFailed),
+		RejectedShed:          atomic.LoadUint64(&p.stats.RejectedShed),
+		RejectedSNI:           atomic.LoadUint64(&p.stats.RejectedSNI),
+		DialRetries:           atomic.LoadUint64(&p.stats.DialRetries),
+		RejectedNotReady:      atomic.LoadUint64(&p.stats.RejectedNotReady),
+		CacheHits:             atomic.LoadUint64(&p.stats.CacheHits),
+		CacheMisses:           atomic.LoadUint64(&p.stats.CacheMisses),
+		CompressedConnections: atomic.LoadUint64(&p.stats.CompressedConnections),
+		UncompressedBytes:     atomic.LoadUint64(&p.stats.UncompressedBytes),
+		CompressedBytes:       atomic.LoadUint64(&p.stats.CompressedBytes),
+		ThrottledConnections:  atomic.LoadUint64(&p.stats.ThrottledConnections),
+		EventsDropped:         atomic.LoadUint64(&p.events.dropped),
+		StickyClients:         p.stickyClients(),
+		NearCapacity:          atomic.LoadInt32(&p.stats.NearCapacity) == 1,
+		Draining:              p.notReady.Load(),
+		UptimeSeconds:         time.Since(p.stats.StartTime).Seconds(),
+		Commands:              p.cmdTimings.Snapshot(),
+		Labels:                p.labels.snapshot(),
+		Targets:               p.targetSnapshots(),
+	}
+	return snap
+}
+
+// Contadores de cada destino, na ordem do -target (/stats e /metrics)
+func (p *Proxy) targetSnapshots() []TargetSnapshot {
+	var list []TargetSnapshot
+	for _, t := range p.targetList() {
+		list = append(list, TargetSnapshot{
+			Addr:              t.addr,
+			TotalConnections:  atomic.LoadUint64(&t.conns),
+			ActiveConnections: atomic.LoadInt64(&t.active),
+			TotalCommands:     atomic.LoadUint64(&t.commands),
+			TotalBytes:        atomic.LoadUint64(&t.bytes),
+			Healthy:           t.isHealthy(),
+			State:             t.state(),
+			LatencyMs:         float64(t.latency().Microseconds()) / 1000,
+			Circuit:           t.circuit(),
+			CommandLatencyMs:  float64(t.commandLatency().Microseconds()) / 1000,
+			ShedRate:          p.shedRate(t),
+			Shed:              atomic.LoadUint64(&t.shed),
+		})
+	}
+	return list
+}
+
+// Sobe o servidor HTTP de estatísticas. O bind é feito aqui (erro de
+// porta aparece na inicialização); o Serve roda em background.
+func (p *Proxy) startHTTP() error {
+	ln, err := net.Listen("tcp", p.config.StatsAddr)
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/stats", p.handleStats)
+	mux.HandleFunc("/metrics", p.handleMetrics)
+	mux.HandleFunc("/connections", p.handleConnections)
+	mux.HandleFunc("/version", p.handleVersion)
+	mux.HandleFunc("/healthz", p.handleHealthz)
+	mux.HandleFunc("/ready", p.handleReady)
+	mux.HandleFunc("/events", p.handleEvents)
+	if p.config.AdminToken != "" {
+		p.registerAdmin(mux)
+	}
+
+	srv := &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+	p.httpServer = srv
+
+	go func() {
+		if err := srv.Serve(ln); err != nil && err != http.ErrServerClosed {
+			p.log.Errorf("Erro no servidor HTTP: %v", err)
+		}
+	}()
+	return nil
+}
+
+// Encerra o servidor HTTP, esperando requisições em andamento por até 5s
+func (p *Proxy) stopHTTP() {
+	p.mu.Lock()
+	srv := p.httpServer
+	p.mu.Unlock()
+	if srv == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	srv.Shutdown(ctx)
+}
+
+func (p *Proxy) handleStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "método não permitido", http.StatusMethodNotAllowed)
+		return
+	}
+	p.writeJSON(w, p.Snapshot())
+}
+
+// Probe de vida (livenessProbe do Kubernetes): 200 enquanto o processo
+// responde, mesmo em drain ou sem destino no ar, para o orquestrador não
+// reiniciar um proxy que só saiu do balanceamento. Sem token, como /stats.
+func (p *Proxy) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "método não permitido", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Write([]byte("ok\n"))
+}
+
+// Probe de prontidão (readinessProbe do Kubernetes, check do HAProxy): 200
+// aceitando conexões com pelo menos um destino disponível, 503 depois do
+// POST /drain, durante o shutdown ou sem destino no ar. Sem token.
+func (p *Proxy) handleReady(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "método não permitido", http.StatusMethodNotAllowed)
+		return
+	}
+	if p.notReady.Load() || p.isDraining() {
+		http.Error(w, "draining", http.StatusServiceUnavailable)
+		return
+	}
+	if len(p.availableTargets()) == 0 {
+		http.Error(w, "no healthy target", http.StatusServiceUnavailable)
+		return
+	}
+	w.Write([]byte("ok\n"))
+}
+
+// Conexão ativa em /connections
+type ConnectionSnapshot struct {
+	ID              uint64
+	Client          string
+	Target          string
+	Login           string // usuário do último login do cliente (vazio = ainda não)
+	Nickname        string // do último clientupdate client_nickname
+	Label           string // batqa-label (-allow-labels)
+	ConnectedAt     time.Time
+	DurationSeconds float64
+	Commands        uint64
+	BytesToTS       uint64
+	BytesToClient   uint64
+}
+
+// Lista as conexões ativas, da mais antiga para a mais nova
+func (p *Proxy) Connections() []ConnectionSnapshot {
+	p.connsMu.Lock()
+	list := make([]ConnectionSnapshot, 0, len(p.conns))
+	for c := range p.conns {
+		var id connIdentity
+		if v := c.identity.Load(); v != nil {
+			id = *v
+		}
+		list = append(list, ConnectionSnapshot{
+			ID:              c.id,
+			Client:          c.clientAddr,
+			Target:          c.target,
+			Login:           id.login,
+			Nickname:        id.nickname,
+			Label:           id.label,
+			ConnectedAt:     c.started,
+			DurationSeconds: time.Since(c.started).Seconds(),
+			Commands:        atomic.LoadUint64(&c.commandCount),
+			BytesToTS:       atomic.LoadUint64(&c.bytesToTS),
+			BytesToClient:   atomic.LoadUint64(&c.bytesToClient),
+		})
+	}
+	p.connsMu.Unlock()
+
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+func (p *Proxy) handleConnections(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "método não permitido", http.StatusMethodNotAllowed)
+		return
+	}
+	p.writeJSON(w, p.Connections())
+}
+
+func (p *Proxy) writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		p.log.Errorf("❌ Erro ao serializar JSON: %v", err)
+	}
+}
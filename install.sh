@@ -45,7 +45,8 @@ echo -e "${YELLOW}📦 Arquitetura detectada: $ARCH${NC}"
 # Verifica se Go está instalado para compilar
 if command -v go &> /dev/null; then
     echo -e "${GREEN}✅ Go encontrado, compilando...${NC}"
-    go build -o $BINARY_NAME main.go
+    VERSION=$(git describe --tags --always 2>/dev/null || echo v1.0.0-dev)
+    go build -ldflags "-X main.version=$VERSION -X main.buildDate=$(date -u +%Y-%m-%dT%H:%M:%SZ)" -o $BINARY_NAME .
 else
     echo -e "${YELLOW}⚠️  Go não encontrado, baixando binário...${NC}"
     
@@ -126,6 +127,7 @@ Type=simple
 User=$TS_USER
 Group=$TS_USER
 ExecStart=$INSTALL_DIR/$BINARY_NAME -listen :$PROXY_PORT -target localhost:$TS_PORT
+ExecReload=/bin/kill -HUP \$MAINPID
 Restart=always
 RestartSec=5
 StandardOutput=journal
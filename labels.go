@@ -0,0 +1,118 @@
+// Rótulos de conexão (-allow-labels): um bot de automação se identifica
+// mandando, antes do primeiro comando, a linha
+//
+//	batqa-label meu-servico
+//
+// O proxy guarda o rótulo na conexão e não repassa a linha ao TS (nem
+// responde: é um cabeçalho, como o do PROXY protocol). O rótulo aparece
+// nos logs, em /connections e nos contadores por rótulo de /stats.
+
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// Comando do rótulo; nunca chega no TS
+const labelCommand = "batqa-label"
+
+// Tamanho máximo de um rótulo
+const maxLabelLen = 64
+
+// Rótulos distintos com contadores próprios; os que vierem depois disso
+// somam em labelOverflow, para um cliente não inflar o /stats sem limite
+const (
+	maxLabels     = 256
+	labelOverflow = "_other"
+)
+
+// Rótulo aceito: letras, dígitos e . _ - :, até maxLabelLen
+func validLabel(label string) bool {
+	if label == "" || len(label) > maxLabelLen {
+		return false
+	}
+	for i := 0; i < len(label); i++ {
+		c := label[i]
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		case c == '.' || c == '_' || c == '-' || c == ':':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// Contadores de um rótulo (atomic)
+type labelCounters struct {
+	connections   uint64
+	active        int64
+	commands      uint64
+	bytesToTS     uint64
+	bytesToClient uint64
+}
+
+type labelStats struct {
+	mu     sync.Mutex
+	labels map[string]*labelCounters
+}
+
+func newLabelStats() *labelStats {
+	return &labelStats{labels: make(map[string]*labelCounters)}
+}
+
+// Contadores do rótulo, criados na primeira conexão com ele
+func (s *labelStats) get(label string) *labelCounters {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.labels[label]
+	if !ok {
+		if len(s.labels) >= maxLabels {
+			label = labelOverflow
+			if c, ok = s.labels[label]; ok {
+				return c
+			}
+		}
+		c = &labelCounters{}
+		s.labels[label] = c
+	}
+	return c
+}
+
+// Contadores de um rótulo em /stats
+type LabelSnapshot struct {
+	Connections       uint64
+	ActiveConnections int64
+	Commands          uint64
+	BytesToTS         uint64
+	BytesToClient     uint64
+}
+
+func (s *labelStats) snapshot() map[string]LabelSnapshot {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.labels) == 0 {
+		return nil
+	}
+	snap := make(map[string]LabelSnapshot, len(s.labels))
+	for label, c := range s.labels {
+		snap[label] = LabelSnapshot{
+			Connections:       atomic.LoadUint64(&c.connections),
+			ActiveConnections: atomic.LoadInt64(&c.active),
+			Commands:          atomic.LoadUint64(&c.commands),
+			BytesToTS:         atomic.LoadUint64(&c.bytesToTS),
+			BytesToClient:     atomic.LoadUint64(&c.bytesToClient),
+		}
+	}
+	return snap
+}
+
+// Rotula a conexão e passa a contar o tráfego dela nos contadores do rótulo
+func (p *Proxy) labelConn(ac *activeConn, label string) {
+	c := p.labels.get(label)
+	atomic.AddUint64(&c.connections, 1)
+	atomic.AddInt64(&c.active, 1)
+	ac.setLabel(label)
+	ac.labelStats.Store(c)
+}
@@ -0,0 +1,147 @@
+// Logger do proxy: texto com emoji (padrão) ou JSON, um objeto por linha
+// (-log-format json), com filtro pelo nível de -log. Campos como client e
+// target só aparecem no JSON; no texto já fazem parte da mensagem.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+type logLevel int
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+var levelNames = [...]string{"debug", "info", "warn", "error"}
+
+func (l logLevel) String() string { return levelNames[l] }
+
+func parseLogLevel(name string) (logLevel, error) {
+	for i, n := range levelNames {
+		if n == name {
+			return logLevel(i), nil
+		}
+	}
+	return levelInfo, fmt.Errorf("nível de log inválido %q (use debug, info, warn ou error)", name)
+}
+
+// Formatos de -log-format
+const (
+	logFormatText = "text"
+	logFormatJSON = "json"
+)
+
+// Campos estruturados de uma linha de log
+type logFields map[string]any
+
+type Logger struct {
+	json   bool
+	level  logLevel
+	fields logFields
+
+	mu  *sync.Mutex // compartilhado com os loggers criados por With
+	out io.Writer
+}
+
+func newLogger(format string, level logLevel) *Logger {
+	return &Logger{
+		json:  format == logFormatJSON,
+		level: level,
+		mu:    &sync.Mutex{},
+		out:   os.Stderr,
+	}
+}
+
+// Logger com campos a mais em todas as linhas
+func (l *Logger) With(fields logFields) *Logger {
+	merged := make(logFields, len(l.fields)+len(fields))
+	for k, v := range l.fields {
+		merged[k] = v
+	}
+	for k, v := range fields {
+		if err, ok := v.(error); ok {
+			v = err.Error()
+		}
+		merged[k] = v
+	}
+	child := *l
+	child.fields = merged
+	return &child
+}
+
+func (l *Logger) Debugf(format string, args ...any) { l.logf(levelDebug, format, args...) }
+func (l *Logger) Infof(format string, args ...any)  { l.logf(levelInfo, format, args...) }
+func (l *Logger) Warnf(format string, args ...any)  { l.logf(levelWarn, format, args...) }
+func (l *Logger) Errorf(format string, args ...any) { l.logf(levelError, format, args...) }
+
+// Registra o erro e encerra o processo
+func (l *Logger) Fatalf(format string, args ...any) {
+	l.logf(levelError, format, args...)
+	os.Exit(1)
+}
+
+func (l *Logger) logf(level logLevel, format string, args ...any) {
+	if level < l.level {
+		return
+	}
+	msg := fmt.Sprintf(format, args...)
+	if !l.json {
+		log.Print(msg)
+		return
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(`{"ts":`)
+	writeJSONValue(&buf, time.Now().Format(time.RFC3339Nano))
+	buf.WriteString(`,"level":`)
+	writeJSONValue(&buf, level.String())
+	buf.WriteString(`,"msg":`)
+	writeJSONValue(&buf, plainMessage(msg))
+
+	keys := make([]string, 0, len(l.fields))
+	for k := range l.fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		buf.WriteByte(',')
+		writeJSONValue(&buf, k)
+		buf.WriteByte(':')
+		writeJSONValue(&buf, l.fields[k])
+	}
+	buf.WriteString("}\n")
+
+	l.mu.Lock()
+	l.out.Write(buf.Bytes())
+	l.mu.Unlock()
+}
+
+func writeJSONValue(buf *bytes.Buffer, v any) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		data, _ = json.Marshal(fmt.Sprint(v))
+	}
+	buf.Write(data)
+}
+
+// Mensagem sem o emoji e a indentação do início, que só servem no texto
+func plainMessage(msg string) string {
+	return strings.TrimLeftFunc(msg, func(r rune) bool {
+		return unicode.IsSpace(r) || unicode.IsSymbol(r) || unicode.Is(unicode.Mn, r)
+	})
+}
@@ -5,73 +5,1096 @@
 //
 // Uso: ./batqa-proxy -listen :10202 -target localhost:10011
 //
-// Build: go build -o batqa-proxy main.go
-// Build Linux (cross-compile): GOOS=linux GOARCH=amd64 go build -o batqa-proxy-linux-amd64 main.go
+// Replay: ./batqa-proxy -replay comandos.txt -target localhost:10202
+//
+// Build: go build -o batqa-proxy .
+// Build Linux (cross-compile): GOOS=linux GOARCH=amd64 go build -o batqa-proxy-linux-amd64 .
 
 package main
 
 import (
 	"bufio"
+	"bytes"
+	"crypto/tls"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"log"
+	"math/rand"
 	"net"
+	"net/http"
 	"os"
 	"os/signal"
+	"regexp"
+	"slices"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"syscall"
 	"time"
 )
 
+// Erros retornados pelo proxy, para quem o embute em outro serviço Go.
+// Quando há um erro de rede por trás, ele vai junto (%w) e dá para usar
+// errors.Is tanto com estes sentinelas quanto com o erro subjacente; os
+// que o próprio proxy decide, sem erro de rede, voltam sozinhos:
+//
+//	ErrListenFailed      - Start() não conseguiu abrir o listener
+//	ErrAddrInUse         - (junto com ErrListenFailed) porta já ocupada
+//	ErrTargetUnreachable - falha ao conectar no TeamSpeak
+//	ErrNoHealthyTarget   - nenhum destino passou no health check (sozinho)
+//	ErrServerBusy        - destinos lentos demais (-shed-latency) recusaram a conexão (sozinho)
+var (
+	ErrListenFailed      = errors.New("erro ao iniciar listener")
+	ErrAddrInUse         = errors.New("endereço já em uso")
+	ErrTargetUnreachable = errors.New("TeamSpeak inacessível")
+	ErrNoHealthyTarget   = errors.New("nenhum destino no ar")
+	ErrServerBusy        = errors.New("destino sobrecarregado")
+)
+
+// IDs de erro das linhas sintetizadas pelo proxy (numeração do ServerQuery)
+const (
+	errIDUndefined        = 1
+	errIDCommandNotFound  = 256
+	errIDFlooding         = 524
+	errIDInvalidParameter = 1538
+	errIDBanned           = 3329
+)
+
+// Prazo da linha de erro para uma conexão recusada no accept: curto e
+// fixo, para uma recusa lenta não ocupar uma vaga de maxRejectWriters
+const rejectWriteTimeout = 100 * time.Millisecond
+
+// Escritas de recusa em andamento ao mesmo tempo; com todas ocupadas, a
+// conexão recusada é só fechada, sem a linha de erro
+const maxRejectWriters = 64
+
+// Escape de valores do ServerQuery (espaço vira \s, barra vira \/ etc.)
+var tsEscaper = strings.NewReplacer(
+	`\`, `\\`, "/", `\/`, " ", `\s`, "|", `\p`,
+	"\a", `\a`, "\b", `\b`, "\f", `\f`, "\n", `\n`, "\r", `\r`, "\t", `\t`, "\v", `\v`,
+)
+
 // Configuração do proxy
 type Config struct {
-	ListenAddr    string
-	TargetAddr    string
-	MaxConns      int
-	Timeout       time.Duration
-	LogLevel      string
+	ListenAddr        string
+	ListenV4Only      bool
+	ListenV6Only      bool
+	Targets           []string
+	Balance           string
+	StickyStay        bool // -balance sticky: o cliente fica no destino novo quando o original volta
+	MaxConns          int
+	Timeout           time.Duration
+	DialRetries       int           // novas tentativas por destino se a discagem falhar
+	DialRetryMax      time.Duration // tempo total das tentativas de uma conexão
+	SRVRefresh        time.Duration // intervalo entre resoluções dos -target srv://
+	LogLevel          string
+	LogFormat         string
+	MinCmdInterval    time.Duration
+	HighWaterPct      int
+	JitterPct         int
+	TraceIO           bool
+	TraceIOMax        int
+	TraceConns        int          // -trace N: rastreia as próximas N conexões
+	TraceNets         []*net.IPNet // -trace IP/faixa: rastreia as conexões delas
+	GlobalConnRate    int
+	MaxUpstreamConns  int
+	MaxConnsPerIP     int
+	RateIPv4Prefix    int
+	RateIPv6Prefix    int
+	BanThreshold      int // recusas até o banimento automático (0 = desativado)
+	BanWindow         time.Duration
+	BanDuration       time.Duration
+	StatsAddr         string
+	AdminToken        string
+	DrainTimeout      time.Duration
+	CloseGrace        time.Duration // espera pela resposta em andamento ao fechar (0 = fecha na hora)
+	HandoffTimeout    time.Duration
+	IdleTimeout       time.Duration
+	MaxSession        time.Duration
+	ConnBandwidth     int // bytes/s por direção de cada conexão (0 = sem limite)
+	KeepAlive         time.Duration
+	TSKeepAlive       time.Duration
+	WriteTimeout      time.Duration
+	BufferSize        int
+	MaxCommandSize    int
+	MaxResponseSize   int
+	ResponseLimits    map[string]int // bytes máximos da resposta por verbo (-response-limit)
+	Echo              bool
+	AutoUse           int
+	OriginCommand     string // comando mandado ao TS com o IP do cliente no lugar de {ip} (-origin-command)
+	StripBanner       bool
+	AllowCompression  bool
+	AllowLabels       bool
+	AuditLog          string
+	TLSCert           string
+	TLSKey            string
+	SNIRoutes         map[string][]string // nome do SNI → destinos (-sni-route)
+	TargetTLS         bool
+	TLSMinVersion     uint16   // -tls-min-version (0 = TLS 1.2)
+	TLSCiphers        []uint16 // -tls-ciphers (nil = padrão do Go)
+	TargetTLSMin      uint16
+	TargetTLSCiphers  []uint16
+	TargetTLSInsecure bool
+	ProxyProtocol     bool
+	PoolSize          int
+	PoolUser          string
+	PoolPass          string
+	RewriteLogin      bool
+	LoginUser         string
+	LoginPass         string
+	CacheTTL          time.Duration
+	CacheErrorLine    string // -cache-error-line: verbatim ou regenerate
+	HealthInterval    time.Duration
+	BreakerThreshold  int
+	BreakerCooldown   time.Duration
+	HealthProbe       bool
+	Allow             []*net.IPNet
+	AllowFile         string
+	Deny              []*net.IPNet
+	ConnRate          int
+	RateWindow        time.Duration // janela do -conn-rate (padrão 1s)
+	RateMode          string
+	RateMaxWait       time.Duration
+	CmdRate           int
+	SlowCommand       time.Duration
+	ShedLatency       time.Duration // média de resposta do destino acima da qual conexões novas são descartadas
+	StrictProtocol    bool
+	AllowCommands     []string
+}
+
+// Cópia da configuração com os segredos trocados por "***", para o log
+func (c Config) redacted() Config {
+	for _, secret := range []*string{&c.PoolPass, &c.LoginPass, &c.AdminToken} {
+		if *secret != "" {
+			*secret = "***"
+		}
+	}
+	return c
 }
 
 // Estatísticas do proxy
 type Stats struct {
-	TotalConnections   uint64
-	ActiveConnections  int64
-	TotalCommands      uint64
-	TotalBytes         uint64
-	StartTime          time.Time
+	TotalConnections      uint64
+	ActiveConnections     int64
+	UpstreamConnections   int64
+	TotalCommands         uint64
+	TotalBytes            uint64
+	PacedCommands         uint64
+	RateLimitedCommands   uint64
+	SlowCommands          uint64 // respostas acima do -slow-command
+	UnmatchedResponses    uint64 // "error id=" do TS sem comando pendente
+	MalformedCommands     uint64
+	BlockedCommands       uint64
+	UpstreamClosedEarly   uint64
+	IdleTimeouts          uint64
+	SessionsExpired       uint64 // fechadas pelo -max-session
+	ClosedByAdmin         uint64 // fechadas pelo POST /connections/{id}/close
+	WriteTimeouts         uint64
+	OversizedLines        uint64
+	TruncatedResponses    uint64 // respostas cortadas pelo -response-limit
+	TSKeepalives          uint64 // "version" mandados pelo -ts-keepalive (sessões e pool)
+	RejectedRateLimit     uint64
+	RejectedGlobalRate    uint64
+	DelayedRateLimit      uint64 // seguradas pelo -rate-mode delay até o token
+	RejectedUpstreamCap   uint64
+	RejectedMaxConns      uint64
+	RejectedIPCap         uint64
+	RejectedDenylist      uint64 // fora do -allow/-allow-file ou dentro do -deny
+	RejectedBanned        uint64 // IP banido pelo -ban-threshold
+	Bans                  uint64 // banimentos automáticos aplicados
+	RejectedDialFailed    uint64 // TS não atendeu (ou nenhum destino no ar)
+	RejectedShed          uint64 // recusadas pelo -shed-latency
+	RejectedSNI           uint64 // SNI fora do -sni-route
+	DialRetries           uint64 // novas tentativas do -dial-retries
+	RejectedNotReady      uint64 // proxy fora do ar pelo POST /drain
+	CacheHits             uint64
+	CacheMisses           uint64
+	CompressedConnections uint64 // clientes que pediram compressão (-allow-compression)
+	UncompressedBytes     uint64 // TS → cliente nessas conexões, antes da compressão
+	CompressedBytes       uint64 // o mesmo, como saiu na rede
+	ThrottledConnections  uint64 // seguradas pelo -conn-bandwidth ao menos uma vez
+	NearCapacity          int32
+	StartTime             time.Time
 }
 
 // Proxy principal
 type Proxy struct {
-	config      Config
-	stats       Stats
-	listener    net.Listener
-	shutdown    chan struct{}
-	wg          sync.WaitGroup
+	config          Config
+	stats           Stats
+	log             *Logger
+	listener        net.Listener
+	netListener     net.Listener                    // o mesmo, sem o TLS; o fd dele vai no handoff (SIGUSR1)
+	clientTLS       *tls.Config                     // TLS aplicado depois do cabeçalho PROXY (-proxy-protocol)
+	tlsCert         atomic.Pointer[tls.Certificate] // certificado atual do -tls-cert (trocado no SIGHUP)
+	targetTLS       *tls.Config                     // TLS nas conexões com o TS (-target-tls; nil = texto puro)
+	live            atomic.Pointer[liveConfig]      // parte recarregável por SIGHUP
+	globalLimiter   *tokenBucket
+	httpServer      *http.Server
+	cmdTimings      *commandTimings
+	targets         atomic.Pointer[[]*target] // trocada quando o SRV (-target srv://) muda
+	srvNames        []string                  // nomes SRV do -target
+	srvCache        map[string][]srvRecord    // último resultado de cada nome SRV
+	lookupSRV       func(name string) ([]*net.SRV, error)
+	poolSetup       []string        // handshake das conexões do pool
+	allowedCommands map[string]bool // -allow-commands (nil = todos)
+	loginLine       []byte          // login que substitui o do cliente (-rewrite-login)
+	useLine         string          // use enviado pelo proxy em toda conexão nova (-auto-use)
+	audit           *auditLog       // -audit-log (nil = desativado)
+	events          *eventHub       // assinantes de /events
+	labels          *labelStats     // contadores por rótulo (-allow-labels)
+	allowFile       *allowFile      // -allow-file (nil = desativado)
+	bans            *banList        // -ban-threshold (nil = desativado)
+	sticky          *stickyTable    // destino de cada IP no -balance sticky (nil nos outros)
+	rejecting       chan struct{}   // vagas das escritas de recusa (maxRejectWriters)
+	shutdown        chan struct{}
+	draining        chan struct{} // fechado quando o drain para de aceitar comandos
+	handingOff      atomic.Bool   // Stop() depois de um handoff: sessões seguem até HandoffTimeout
+	notReady        atomic.Bool   // POST /drain: recusa conexões novas, as ativas seguem
+	stopOnce        sync.Once
+	mu              sync.Mutex // protege listener e wg.Add contra Stop() concorrente
+	wg              sync.WaitGroup
+	ipConnsMu       sync.Mutex
+	ipConns         map[string]int // conexões ativas por IP (-max-conns-per-ip)
+	connsMu         sync.Mutex
+	conns           map[*activeConn]struct{}
+
+	nextTarget        uint64 // contador do round-robin
+	lastHighWaterWarn int64  // UnixNano do último aviso de capacidade
+	nextConnID        uint64
+	traceLeft         int64 // conexões que o -trace N ainda vai rastrear
+}
+
+// Buffer de leitura das conexões (-buffer-size); abaixo do mínimo vale o padrão
+const (
+	defaultBufferSize = 4096
+	minBufferSize     = 16
+)
+
+// Limite padrão de uma linha do cliente (-max-command-size). Comandos de
+// verdade cabem com folga; só quem tenta estourar a memória passa disso.
+const defaultMaxCommandSize = 8 << 10
+
+// Intervalo mínimo entre avisos de proximidade do limite de conexões
+const highWaterWarnInterval = time.Minute
+
+// Frequência com que o drain procura conexões ociosas para fechar
+const drainPollInterval = 50 * time.Millisecond
+
+// Frequência com que o -max-session procura sessões vencidas
+const sessionSweepInterval = time.Second
+
+// Conexão ativa, registrada para que o drain do Stop() consiga fechá-la
+// e para a listagem em /connections
+type activeConn struct {
+	// Contadores, um por direção: cada goroutine do pipe escreve no seu, e
+	// o log final e o /connections leem (atomic)
+	bytesToTS     uint64 // cliente → TS
+	bytesToClient uint64 // TS → cliente
+	commandCount  uint64
+	lastTraffic   int64  // UnixNano da última linha em qualquer direção, para o -ts-keepalive
+	throttled     uint32 // 1 depois da primeira pausa do -conn-bandwidth
+
+	id         uint64
+	clientAddr string
+	target     string
+	started    time.Time
+	client     net.Conn
+	out        *clientWriter // escritas para o cliente (compressão, -max-session)
+	ts         net.Conn
+	pending    pendingCommands               // comandos enviados ainda sem resposta
+	identity   atomic.Pointer[connIdentity]  // nil até o cliente se identificar
+	labelStats atomic.Pointer[labelCounters] // contadores do -allow-labels (nil = sem rótulo)
+
+	mu     sync.Mutex // ordena beginCommand, closeIfIdle e detachTS
+	closed chan struct{}
+
+	expiring atomic.Bool // o -max-session já está esperando a resposta para fechar
+
+	// Escopo do cache: login e "use" que o TS aceitou, e quantos login/use
+	// ainda esperam resposta (sob mu)
+	cacheLogin   string
+	cacheUse     string
+	scopePending int
+}
+
+func newActiveConn(id uint64, clientAddr, target string, client net.Conn, out *clientWriter, ts net.Conn) *activeConn {
+	now := time.Now()
+	return &activeConn{
+		lastTraffic: now.UnixNano(),
+		id:          id,
+		clientAddr:  clientAddr,
+		target:      target,
+		started:     now,
+		client:      client,
+		out:         out,
+		ts:          ts,
+		closed:      make(chan struct{}),
+	}
+}
+
+// Quem o cliente diz ser, pelo login e pelo clientupdate client_nickname
+type connIdentity struct {
+	login    string
+	nickname string
+	label    string // batqa-label (-allow-labels)
+}
+
+// Guarda o que veio preenchido; só a goroutine cliente → TS escreve
+func (c *activeConn) setIdentity(login, nickname string) {
+	var id connIdentity
+	if old := c.identity.Load(); old != nil {
+		id = *old
+	}
+	if login != "" {
+		id.login = login
+	}
+	if nickname != "" {
+		id.nickname = nickname
+	}
+	c.identity.Store(&id)
+}
+
+// Guarda o rótulo do -allow-labels; também só da goroutine cliente → TS
+func (c *activeConn) setLabel(label string) {
+	var id connIdentity
+	if old := c.identity.Load(); old != nil {
+		id = *old
+	}
+	id.label = label
+	c.identity.Store(&id)
+}
+
+// Cliente nos logs: o endereço e, depois que se identificou, o nickname
+// (ou o login, se não mandou clientupdate), seguido do rótulo
+func (c *activeConn) who() string {
+	id := c.identity.Load()
+	if id == nil {
+		return c.clientAddr
+	}
+	who := c.clientAddr
+	switch {
+	case id.nickname != "":
+		who = fmt.Sprintf("%s (%s)", c.clientAddr, id.nickname)
+	case id.login != "":
+		who = fmt.Sprintf("%s (%s)", c.clientAddr, id.login)
+	}
+	if id.label != "" {
+		who += " [" + id.label + "]"
+	}
+	return who
+}
+
+// Logger da conexão com a identidade nos campos (no -log-format json)
+func (c *activeConn) logger(base *Logger) *Logger {
+	id := c.identity.Load()
+	if id == nil {
+		return base
+	}
+	fields := logFields{}
+	if id.login != "" {
+		fields["login"] = id.login
+	}
+	if id.nickname != "" {
+		fields["nickname"] = id.nickname
+	}
+	if id.label != "" {
+		fields["label"] = id.label
+	}
+	return base.With(fields)
+}
+
+// Registra o envio de um comando. Retorna false durante o drain: o
+// comando não deve ser repassado e a conexão será fechada pelo Stop().
+func (c *activeConn) beginCommand(draining bool, verb, cacheKey string, scope *scopeChange) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if draining {
+		return false
+	}
+	if scope != nil {
+		c.scopePending++
+	}
+	c.pending.push(pendingCommand{sent: time.Now(), verb: verb, cacheKey: cacheKey, scope: scope})
+	return true
+}
+
+// Escopo do cache para um comando novo; false enquanto um login/use não
+// tiver resposta (a conexão não usa o cache até saber se o TS aceitou)
+func (c *activeConn) cacheScope() (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.cacheLogin + " " + c.cacheUse, c.scopePending == 0
+}
+
+// Resposta de um login/use: o escopo só muda se o TS aceitou
+func (c *activeConn) endScope(scope *scopeChange, accepted bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.scopePending--
+	switch {
+	case !accepted:
+	case scope.login:
+		c.cacheLogin = scope.value
+	default:
+		c.cacheUse = scope.value
+	}
+}
+
+// Marca tráfego na conexão (adia o próximo keepalive)
+func (c *activeConn) markTraffic() {
+	atomic.StoreInt64(&c.lastTraffic, time.Now().UnixNano())
+}
+
+// Há quanto tempo não passa nada pela conexão
+func (c *activeConn) idleFor() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&c.lastTraffic)))
+}
+
+// Manda um comando do próprio proxy pro TS (keepalive, -origin-command), só
+// se nenhuma resposta estiver em andamento. Registro e envio ficam sob o
+// mesmo lock: um comando do cliente não entra entre os dois, então a ordem
+// da fila é a ordem em que o TS responde.
+func (c *activeConn) sendInternal(cmd string, write func() error) (bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	select {
+	case <-c.closed:
+		return false, nil
+	default:
+	}
+	if c.pending.len() > 0 {
+		return false, nil
+	}
+	c.pending.push(pendingCommand{sent: time.Now(), verb: commandVerb([]byte(cmd)), internal: true})
+	if err := write(); err != nil {
+		return false, err
+	}
+	c.markTraffic()
+	return true, nil
+}
+
+// Fecha a conexão se nenhuma resposta estiver em andamento
+func (c *activeConn) closeIfIdle() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.pending.len() > 0 {
+		return false
+	}
+	return c.closeLocked()
+}
+
+// Fecha com a linha de erro msg assim que a resposta em andamento
+// terminar, esperando por até grace (-close-grace); passado o prazo, fecha
+// no meio dela (forced). closed é false se a conexão já estava fechando.
+func (c *activeConn) closeGracefully(msg string, grace time.Duration) (closed, forced bool) {
+	deadline := time.Now().Add(grace)
+	for !c.closeWithError(msg, false) {
+		select {
+		case <-c.closed:
+			return false, false
+		default:
+		}
+		// Outro comando pode entrar assim que a fila esvazia: a espera
+		// continua, mas nunca além do prazo
+		if !c.waitResponse(time.Until(deadline)) {
+			return c.closeWithError(msg, true), true
+		}
+	}
+	return true, false
+}
+
+// Espera a resposta em andamento terminar, por até grace (-close-grace);
+// false se o prazo acabou antes
+func (c *activeConn) waitResponse(grace time.Duration) bool {
+	if grace <= 0 {
+		return false
+	}
+	timer := time.NewTimer(grace)
+	defer timer.Stop()
+	select {
+	case <-c.pending.whenEmpty():
+		return true
+	case <-c.closed:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+// Manda uma linha de erro ao cliente e fecha. Com force, fecha mesmo no
+// meio de uma resposta; sem, só se nada estiver pendente (false se não
+// fechou).
+func (c *activeConn) closeWithError(msg string, force bool) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.pending.len() > 0 && !force {
+		return false
+	}
+	select {
+	case <-c.closed:
+		return false
+	default:
+	}
+	c.client.SetWriteDeadline(time.Now().Add(rejectWriteTimeout))
+	writeError(c.out, errIDUndefined, msg)
+	return c.closeLocked()
+}
+
+// Fecha as duas pontas; retorna true só na primeira chamada
+func (c *activeConn) close() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.closeLocked()
+}
+
+func (c *activeConn) closeLocked() bool {
+	select {
+	case <-c.closed:
+		return false
+	default:
+	}
+	close(c.closed)
+	c.client.Close()
+	if c.ts != nil {
+		c.ts.Close()
+	}
+	return true
+}
+
+// Desvincula a conexão com o TS para devolvê-la ao pool; falha se a
+// conexão já foi fechada (ex: pelo drain)
+func (c *activeConn) detachTS() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	select {
+	case <-c.closed:
+		return false
+	default:
+	}
+	c.ts = nil
+	return true
+}
+
+// Token bucket: até `rate` tokens por segundo, com rajada de `rate`
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64) *tokenBucket {
+	return &tokenBucket{rate: rate, tokens: rate, last: time.Now()}
+}
+
+// Consome um token se houver; O(1) e sem alocação
+func (b *tokenBucket) Allow() bool {
+	_, ok := b.Reserve(0)
+	return ok
+}
+
+// Como Allow, mas sem token reserva o próximo e devolve a espera por ele,
+// se não passar de maxWait (mesma regra do RateLimiter.Reserve)
+func (b *tokenBucket) Reserve(maxWait time.Duration) (time.Duration, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.rate {
+		b.tokens = b.rate
+	}
+	b.last = now
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return 0, true
+	}
+	wait := time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+	if wait > maxWait {
+		return 0, false
+	}
+	b.tokens--
+	return wait, true
 }
 
 func NewProxy(config Config) *Proxy {
-	return &Proxy{
-		config:      config,
-		stats:       Stats{StartTime: time.Now()},
-		shutdown:    make(chan struct{}),
+	level, err := parseLogLevel(config.LogLevel)
+	if err != nil {
+		level = levelInfo
+	}
+	if config.BufferSize < minBufferSize {
+		config.BufferSize = defaultBufferSize
+	}
+	if config.RateIPv4Prefix == 0 {
+		config.RateIPv4Prefix = defaultIPv4Prefix
+	}
+	if config.RateIPv6Prefix == 0 {
+		config.RateIPv6Prefix = defaultIPv6Prefix
 	}
+	if config.DialRetryMax <= 0 {
+		config.DialRetryMax = defaultDialRetryMax
+	}
+	if config.RateWindow <= 0 {
+		config.RateWindow = defaultRateWindow
+	}
+	if config.SRVRefresh <= 0 {
+		config.SRVRefresh = defaultSRVRefresh
+	}
+	p := &Proxy{
+		config:     config,
+		stats:      Stats{StartTime: time.Now()},
+		log:        newLogger(config.LogFormat, level),
+		rejecting:  make(chan struct{}, maxRejectWriters),
+		shutdown:   make(chan struct{}),
+		draining:   make(chan struct{}),
+		cmdTimings: newCommandTimings(),
+		events:     newEventHub(),
+		labels:     newLabelStats(),
+		targetTLS:  targetTLSConfig(config),
+		conns:      make(map[*activeConn]struct{}),
+		ipConns:    make(map[string]int),
+		traceLeft:  int64(config.TraceConns),
+	}
+	if config.AuditLog != "" {
+		p.audit = newAuditLog(config.AuditLog, p.log)
+	}
+	if config.AllowFile != "" {
+		p.allowFile = newAllowFile(config.AllowFile, p.log)
+	}
+	if config.RewriteLogin {
+		p.loginLine = []byte(fmt.Sprintf("login %s %s\n", tsEscape(config.LoginUser), tsEscape(config.LoginPass)))
+	}
+	if len(config.AllowCommands) > 0 {
+		p.allowedCommands = make(map[string]bool)
+		for _, verb := range config.AllowCommands {
+			p.allowedCommands[strings.ToLower(verb)] = true
+		}
+	}
+	live := &liveConfig{
+		MaxConns: config.MaxConns,
+		ConnRate: config.ConnRate,
+		Allow:    config.Allow,
+		Deny:     config.Deny,
+	}
+	if config.ConnRate > 0 {
+		live.rateLimiter = NewRateLimiter(config.ConnRate, config.RateWindow)
+	}
+	p.live.Store(live)
+	if config.BanThreshold > 0 {
+		p.bans = newBanList(config.BanThreshold, config.BanWindow, config.BanDuration)
+	}
+	if config.Balance == balanceSticky {
+		p.sticky = newStickyTable()
+	}
+	if config.GlobalConnRate > 0 {
+		p.globalLimiter = newTokenBucket(float64(config.GlobalConnRate))
+	}
+	// Handshake das conexões do pool: login (-pool-user) e use (-auto-use)
+	if config.PoolUser != "" {
+		p.poolSetup = append(p.poolSetup, fmt.Sprintf("login %s %s\n", tsEscape(config.PoolUser), tsEscape(config.PoolPass)))
+	}
+	if config.AutoUse > 0 {
+		p.useLine = fmt.Sprintf("use sid=%d\n", config.AutoUse)
+		p.poolSetup = append(p.poolSetup, p.useLine)
+	}
+	// Os destinos srv:// só existem depois da resolução, no Start()
+	var targets []*target
+	for _, addr := range config.Targets {
+		if name, ok := strings.CutPrefix(addr, srvScheme); ok {
+			p.srvNames = append(p.srvNames, name)
+			continue
+		}
+		targets = append(targets, p.newTarget(addr))
+	}
+	p.targets.Store(&targets)
+	p.srvCache = make(map[string][]srvRecord)
+	p.lookupSRV = lookupSRV
+	return p
+}
+
+// Separa o -listen em rede e endereço: "unix:/caminho" é socket unix, o
+// resto é TCP (tcp4/tcp6 com -listen-v4-only/-listen-v6-only)
+func listenNetwork(listen string, v4Only, v6Only bool) (network, address string) {
+	if path, ok := strings.CutPrefix(listen, "unix:"); ok {
+		return "unix", path
+	}
+	switch {
+	case v4Only:
+		return "tcp4", listen
+	case v6Only:
+		return "tcp6", listen
+	}
+	return "tcp", listen
+}
+
+// Confere o -listen antes de abrir o socket, para um erro de digitação
+// aparecer com uma mensagem clara: porta válida e, com IP (ou nome) fixo,
+// um endereço que exista em alguma interface desta máquina e seja da
+// família pedida
+func checkListenAddr(network, address string) error {
+	if network == "unix" {
+		if address == "" {
+			return errors.New("caminho do socket unix vazio")
+		}
+		return nil
+	}
+
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if _, err := net.LookupPort("tcp", port); err != nil {
+		return fmt.Errorf("porta inválida: %q", port)
+	}
+	if host == "" {
+		return nil // todas as interfaces
+	}
+
+	// IPv6 com zona (fe80::1%eth0): a interface tem que existir
+	host, zone, _ := strings.Cut(host, "%")
+	if zone != "" {
+		if _, err := net.InterfaceByName(zone); err != nil {
+			return fmt.Errorf("interface %q: %w", zone, err)
+		}
+	}
+
+	ips := []net.IP{net.ParseIP(host)}
+	if ips[0] == nil {
+		if ips, err = net.LookupIP(host); err != nil {
+			return err
+		}
+	}
+
+	local, err := net.InterfaceAddrs()
+	if err != nil {
+		return err
+	}
+	for _, ip := range ips {
+		v4 := ip.To4() != nil
+		if (network == "tcp4" && !v4) || (network == "tcp6" && v4) {
+			continue
+		}
+		if ip.IsUnspecified() {
+			return nil
+		}
+		for _, addr := range local {
+			if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.Equal(ip) {
+				return nil
+			}
+		}
+	}
+	switch network {
+	case "tcp4":
+		return fmt.Errorf("%s não tem endereço IPv4 em nenhuma interface desta máquina", host)
+	case "tcp6":
+		return fmt.Errorf("%s não tem endereço IPv6 em nenhuma interface desta máquina", host)
+	}
+	return fmt.Errorf("%s não é endereço de nenhuma interface desta máquina", host)
+}
+
+// Apaga o arquivo de socket deixado por uma execução que não encerrou
+// direito. Um socket com alguém escutando não é tocado.
+func removeStaleSocket(path string) error {
+	info, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s já existe e não é um socket", path)
+	}
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+		return fmt.Errorf("%s: %w", path, syscall.EADDRINUSE)
+	}
+	return os.Remove(path)
 }
 
 func (p *Proxy) Start() error {
-	listener, err := net.Listen("tcp", p.config.ListenAddr)
+	if p.audit != nil {
+		if err := p.audit.open(); err != nil {
+			return fmt.Errorf("erro ao abrir o log de auditoria: %w", err)
+		}
+	}
+	if p.allowFile != nil {
+		if err := p.allowFile.load(); err != nil {
+			return fmt.Errorf("erro ao ler -allow-file: %w", err)
+		}
+	}
+
+	network, address := listenNetwork(p.config.ListenAddr, p.config.ListenV4Only, p.config.ListenV6Only)
+
+	// Vindo de um handoff, o socket já está aberto
+	listener, err := inheritedListener()
 	if err != nil {
-		return fmt.Errorf("erro ao iniciar listener: %w", err)
+		return fmt.Errorf("%w: %w", ErrListenFailed, err)
+	}
+	inherited := listener != nil
+	if !inherited && network == "unix" {
+		if err := removeStaleSocket(address); err != nil {
+			if errors.Is(err, syscall.EADDRINUSE) {
+				return fmt.Errorf("%w: %w: %w", ErrListenFailed, ErrAddrInUse, err)
+			}
+			return fmt.Errorf("%w: %w", ErrListenFailed, err)
+		}
+	}
+	// O socket unix é apagado pelo próprio listener no Close() do Stop()
+	if !inherited {
+		listener, err = net.Listen(network, address)
+	}
+	if err != nil {
+		if errors.Is(err, syscall.EADDRINUSE) {
+			return fmt.Errorf("%w: %w: %w", ErrListenFailed, ErrAddrInUse, err)
+		}
+		return fmt.Errorf("%w: %w", ErrListenFailed, err)
+	}
+	netListener := listener
+
+	// TLS na ponta dos clientes
+	if p.config.TLSCert != "" || p.config.TLSKey != "" {
+		tlsConfig, err := p.serverTLSConfig()
+		if err != nil {
+			listener.Close()
+			return err
+		}
+		// Com PROXY protocol o cabeçalho vem antes do handshake
+		if p.config.ProxyProtocol {
+			p.clientTLS = tlsConfig
+		} else {
+			listener = tls.NewListener(listener, tlsConfig)
+		}
+	}
+
+	// Stop() pode ter sido chamado enquanto o listener era criado
+	p.mu.Lock()
+	if p.stopping() {
+		p.mu.Unlock()
+		listener.Close()
+		return nil
 	}
 	p.listener = listener
+	p.netListener = netListener
+	if p.config.StatsAddr != "" {
+		if err := p.startHTTP(); err != nil {
+			p.mu.Unlock()
+			listener.Close()
+			return fmt.Errorf("erro ao iniciar servidor de estatísticas: %w", err)
+		}
+	}
+	p.mu.Unlock()
 
-	log.Printf("🚀 BATQA Proxy iniciado")
-	log.Printf("   Escutando em: %s", p.config.ListenAddr)
-	log.Printf("   Destino: %s", p.config.TargetAddr)
-	log.Printf("   Max conexões: %d", p.config.MaxConns)
-	log.Printf("   Rate limit: unlimited")
+	if len(p.srvNames) > 0 {
+		p.resolveSRV(false)
+		go p.refreshSRV()
+	}
+	for _, t := range p.targetList() {
+		p.startTarget(t)
+	}
+	if p.config.HealthInterval > 0 {
+		go p.runHealthChecks()
+	}
+	if p.allowFile != nil {
+		go p.allowFile.watch(p.shutdown, p.config.JitterPct)
+	}
+	go p.runCleanup()
+	if p.config.MaxSession > 0 {
+		go p.expireSessions()
+	}
+
+	p.log.Infof("🚀 BATQA Proxy iniciado")
+	p.log.Infof("   Versão: %s", buildInfo())
+	// Endereço de fato aberto (com -listen :porta, o wildcard da família)
+	switch network {
+	case "unix":
+		p.log.Infof("   Escutando em: %s", p.config.ListenAddr)
+	case "tcp4":
+		p.log.Infof("   Escutando em: %s (só IPv4)", netListener.Addr())
+	case "tcp6":
+		p.log.Infof("   Escutando em: %s (só IPv6)", netListener.Addr())
+	default:
+		if addr, ok := netListener.Addr().(*net.TCPAddr); ok && addr.IP.IsUnspecified() {
+			p.log.Infof("   Escutando em: %s (todas as interfaces, IPv4 e IPv6)", addr)
+		} else {
+			p.log.Infof("   Escutando em: %s", netListener.Addr())
+		}
+	}
+	if inherited {
+		p.log.Infof("   Socket herdado do processo anterior (reinício sem queda)")
+	}
+	if network == "unix" && (p.config.ConnRate > 0 || p.config.MaxConnsPerIP > 0 || len(p.config.Allow) > 0 || p.allowFile != nil || len(p.config.Deny) > 0) {
+		p.log.Warnf("⚠️  Socket unix não tem IP de cliente: -conn-rate, -max-conns-per-ip e -allow/-deny não se aplicam")
+	}
+	if p.config.Echo {
+		p.log.Infof("   Destino: modo echo (sem TS; todo comando recebe error id=0)")
+	} else if len(p.config.Targets) > 1 {
+		p.log.Infof("   Destinos: %s (%s)", strings.Join(p.config.Targets, ", "), p.config.Balance)
+	} else {
+		p.log.Infof("   Destino: %s", p.config.Targets[0])
+	}
+	if p.config.DialRetries > 0 {
+		p.log.Infof("   Novas tentativas de conexão com o TS: %d por destino, até %v no total", p.config.DialRetries, p.config.DialRetryMax)
+	}
+	if p.config.TLSCert != "" {
+		p.log.Infof("   TLS: ativado (%s), %s", p.config.TLSCert, tlsPolicy(p.config.TLSMinVersion, p.config.TLSCiphers))
+	}
+	if len(p.config.SNIRoutes) > 0 {
+		routes := sniRoutes(p.config.SNIRoutes)
+		p.log.Infof("   Rotas por SNI: %s (outros nomes são recusados)", routes.String())
+	}
+	if p.config.TargetTLSInsecure {
+		p.log.Warnf("   TLS com o TS: ativado, SEM verificar o certificado (-target-tls-insecure)")
+	} else if p.config.TargetTLS {
+		p.log.Infof("   TLS com o TS: ativado, %s", tlsPolicy(p.config.TargetTLSMin, p.config.TargetTLSCiphers))
+	}
+	if p.config.ProxyProtocol {
+		p.log.Infof("   PROXY protocol: ativado (v1 e v2, obrigatório)")
+	}
+	if p.config.AutoUse > 0 {
+		p.log.Infof("   Servidor virtual selecionado pelo proxy: sid=%d", p.config.AutoUse)
+	}
+	if p.config.OriginCommand != "" {
+		p.log.Infof("   Origem enviada ao TS em toda conexão: %s", p.config.OriginCommand)
+	}
+	if p.config.StripBanner {
+		p.log.Infof("   Banner do TS: não repassado aos clientes")
+	}
+	if p.config.AuditLog != "" {
+		p.log.Infof("   Log de auditoria: %s", p.config.AuditLog)
+	}
+	if p.config.RewriteLogin {
+		p.log.Infof("   Login dos clientes reescrito para: %s", p.config.LoginUser)
+	}
+	if p.config.PoolSize > 0 {
+		p.log.Infof("   Pool de conexões: %d por destino", p.config.PoolSize)
+	}
+	if p.config.CacheTTL > 0 {
+		p.log.Infof("   Cache de respostas: %v", p.config.CacheTTL)
+		if p.config.CacheErrorLine == cacheErrorRegenerate {
+			p.log.Infof("   Linha de erro do cache: gerada pelo proxy (error id=0 msg=ok)")
+		}
+	}
+	if p.config.HealthInterval > 0 {
+		p.log.Infof("   Health check: a cada %v", p.config.HealthInterval)
+	}
+	if p.config.BreakerThreshold > 0 {
+		p.log.Infof("   Circuit breaker: %d falhas seguidas pausam o destino por %v", p.config.BreakerThreshold, p.config.BreakerCooldown)
+	}
+	p.log.Infof("   Max conexões: %d", p.config.MaxConns)
+	if p.config.MaxUpstreamConns > 0 {
+		p.log.Infof("   Max conexões com o TS: %d", p.config.MaxUpstreamConns)
+	}
+	if p.config.MaxConnsPerIP > 0 {
+		p.log.Infof("   Max conexões por IP: %d", p.config.MaxConnsPerIP)
+	}
+	if p.config.HighWaterPct > 0 {
+		p.log.Infof("   Aviso de capacidade: %d%%", p.config.HighWaterPct)
+	}
+	if len(p.config.Allow) > 0 {
+		p.log.Infof("   IPs permitidos: %v", p.config.Allow)
+	}
+	if p.allowFile != nil {
+		p.log.Infof("   IPs permitidos em arquivo: %s (%d faixas, relido ao mudar)", p.config.AllowFile, len(p.allowFile.list()))
+	}
+	if len(p.config.Deny) > 0 {
+		p.log.Infof("   IPs bloqueados: %v", p.config.Deny)
+	}
+	if p.config.ConnRate > 0 {
+		if p.config.RateWindow == time.Second {
+			p.log.Infof("   Rate limit de conexões: %d/s por IP", p.config.ConnRate)
+		} else {
+			p.log.Infof("   Rate limit de conexões: %d a cada %v por IP", p.config.ConnRate, p.config.RateWindow)
+		}
+	} else {
+		p.log.Infof("   Rate limit de conexões: unlimited")
+	}
+	if (p.config.ConnRate > 0 || p.config.MaxConnsPerIP > 0) &&
+		(p.config.RateIPv4Prefix != defaultIPv4Prefix || p.config.RateIPv6Prefix != defaultIPv6Prefix) {
+		p.log.Infof("   Limites por IP agregados em: /%d (IPv4), /%d (IPv6)", p.config.RateIPv4Prefix, p.config.RateIPv6Prefix)
+	}
+	if p.config.BanThreshold > 0 {
+		p.log.Infof("   Banimento automático: %d recusas em %v banem por %v", p.config.BanThreshold, p.config.BanWindow, p.config.BanDuration)
+	}
+	if p.config.GlobalConnRate > 0 {
+		p.log.Infof("   Rate limit global: %d conexões/s", p.config.GlobalConnRate)
+	}
+	if p.config.RateMode == rateModeDelay && (p.config.ConnRate > 0 || p.config.GlobalConnRate > 0) {
+		p.log.Infof("   Acima do rate limit: espera até %v pelo token", p.config.RateMaxWait)
+	}
+	if p.config.MinCmdInterval > 0 {
+		p.log.Infof("   Intervalo mínimo entre comandos: %s", p.config.MinCmdInterval)
+	}
+	if p.config.CmdRate > 0 {
+		p.log.Infof("   Rate limit de comandos: %d/s por conexão", p.config.CmdRate)
+	}
+	if p.config.SlowCommand > 0 {
+		p.log.Infof("   Log de comandos lentos: acima de %v", p.config.SlowCommand)
+	}
+	if p.config.ShedLatency > 0 {
+		p.log.Infof("   Descarte de carga: destino com média de resposta acima de %v recusa parte das conexões novas", p.config.ShedLatency)
+	}
+	if p.config.IdleTimeout > 0 {
+		p.log.Infof("   Timeout de ociosidade: %v", p.config.IdleTimeout)
+	}
+	if p.config.MaxSession > 0 {
+		p.log.Infof("   Duração máxima da sessão: %v", p.config.MaxSession)
+	}
+	if p.config.ConnBandwidth > 0 {
+		p.log.Infof("   Banda por conexão: %d bytes/s em cada direção", p.config.ConnBandwidth)
+	}
+	if p.config.TSKeepAlive > 0 {
+		p.log.Infof("   Keepalive com o TS: version a cada %v parado", p.config.TSKeepAlive)
+	}
+	if p.config.WriteTimeout > 0 {
+		p.log.Infof("   Timeout de escrita: %v", p.config.WriteTimeout)
+	}
+	if p.config.AllowCompression {
+		p.log.Infof("   Compressão: gzip/deflate para quem pedir (%s)", compressCommand)
+	}
+	if p.config.AllowLabels {
+		p.log.Infof("   Rótulos de conexão: aceitos (%s)", labelCommand)
+	}
+	if p.config.MaxCommandSize > 0 {
+		p.log.Infof("   Tamanho máximo de linha do cliente: %d bytes", p.config.MaxCommandSize)
+	}
+	if p.config.MaxResponseSize > 0 {
+		p.log.Infof("   Tamanho máximo de linha do TS: %d bytes", p.config.MaxResponseSize)
+	}
+	if len(p.config.ResponseLimits) > 0 {
+		limits := responseLimits(p.config.ResponseLimits)
+		p.log.Infof("   Tamanho máximo de resposta: %s", limits.String())
+	}
+	if p.config.StrictProtocol {
+		p.log.Infof("   Protocolo estrito: comandos malformados são recusados")
+	}
+	if len(p.config.AllowCommands) > 0 {
+		p.log.Infof("   Comandos permitidos: %s", strings.Join(p.config.AllowCommands, ", "))
+	}
+	if p.config.StatsAddr != "" {
+		p.log.Infof("   Estatísticas HTTP: http://%s/stats, /metrics, /connections, /version, /healthz e /ready", p.config.StatsAddr)
+		if p.config.AdminToken != "" {
+			p.log.Infof("   Administração HTTP: /cache, /cache/flush, /drain, /undrain, /bans, /connections/{id}/close, /targets/drain, /targets/undrain e /config (com -admin-token)")
+		}
+	}
+	if p.config.LogLevel == "debug" {
+		p.log.Debugf("   Configuração efetiva: %+v", p.config.redacted())
+	}
+	if p.config.TraceIO {
+		p.log.Warnf("⚠️  -trace-io ativo: todas as linhas são registradas no log (impacto em performance e dados sensíveis)")
+	} else if p.config.TraceConns > 0 {
+		p.log.Infof("   Rastreio (-trace): as próximas %d conexões", p.config.TraceConns)
+	} else if len(p.config.TraceNets) > 0 {
+		p.log.Infof("   Rastreio (-trace): conexões de %v", p.config.TraceNets)
+	}
+
+	// Vindo de um handoff: o processo anterior só para de aceitar agora
+	if err := notifyReady(); err != nil {
+		p.log.Errorf("❌ Erro ao avisar o processo anterior: %v", err)
+	}
 
 	for {
 		conn, err := listener.Accept()
@@ -80,152 +1103,1487 @@ func (p *Proxy) Start() error {
 			case <-p.shutdown:
 				return nil
 			default:
-				log.Printf("Erro ao aceitar conexão: %v", err)
+				p.log.Errorf("Erro ao aceitar conexão: %v", err)
 				continue
 			}
 		}
 
-		// Verifica limite de conexões
-		if atomic.LoadInt64(&p.stats.ActiveConnections) >= int64(p.config.MaxConns) {
-			log.Printf("⚠️  Limite de conexões atingido, rejeitando: %s", conn.RemoteAddr())
-			conn.Close()
+		// Com PROXY protocol o endereço do cliente só vem no cabeçalho; a
+		// leitura fica fora do loop para um cliente lento não travar os
+		// outros. wg.Add sob o lock, como no admit(), para o Stop() esperar
+		// também os cabeçalhos em leitura.
+		if p.config.ProxyProtocol {
+			p.mu.Lock()
+			if p.stopping() {
+				p.mu.Unlock()
+				conn.Close()
+				return nil
+			}
+			p.wg.Add(1)
+			p.mu.Unlock()
+			go p.admitProxyHeader(conn)
 			continue
 		}
 
-		p.wg.Add(1)
-		go p.handleConnection(conn)
+		if !p.admit(conn) {
+			return nil
+		}
+	}
+}
+
+// Lê o cabeçalho PROXY de uma conexão aceita e segue para o admit(). O
+// Stop() fecha a conexão se o cabeçalho ainda não chegou, em vez de esperar
+// o -timeout dele.
+func (p *Proxy) admitProxyHeader(conn net.Conn) {
+	defer p.wg.Done()
+
+	read := make(chan struct{})
+	go func() {
+		select {
+		case <-p.shutdown:
+			conn.Close()
+		case <-read:
+		}
+	}()
+	pconn, err := readProxyHeader(conn, p.config.Timeout)
+	close(read)
+	if err != nil {
+		if !p.stopping() {
+			p.log.Warnf("⚠️  %v, rejeitando: %s", err, conn.RemoteAddr())
+		}
+		conn.Close()
+		return
+	}
+
+	var c net.Conn = pconn
+	if p.clientTLS != nil {
+		c = tls.Server(pconn, p.clientTLS)
+	}
+	// false só avisa que o proxy está encerrando: o admit() já fechou a
+	// conexão e o accept loop sai sozinho pelo shutdown
+	p.admit(c)
+}
+
+// Aplica os limites a uma conexão aceita e, se passar, inicia o
+// handleConnection. Retorna false se o proxy está encerrando.
+func (p *Proxy) admit(conn net.Conn) bool {
+	if p.rejectNotReady(conn) {
+		return true
+	}
+
+	// Controle de acesso por IP, antes de qualquer limite; não conta
+	// como conexão
+	if !p.allowedAddr(conn.RemoteAddr()) {
+		atomic.AddUint64(&p.stats.RejectedDenylist, 1)
+		p.log.Warnf("⚠️  IP não permitido, rejeitando: %s", conn.RemoteAddr())
+		p.reject(conn, errIDBanned, "address not allowed")
+		return true
+	}
+
+	live := p.live.Load()
+	ip := p.ipKey(conn.RemoteAddr()) // vazio em socket unix
+
+	// IP banido pelo -ban-threshold: recusado antes de gastar token do
+	// rate limit
+	if p.bans != nil {
+		if until, ok := p.bans.banned(ip); ok {
+			atomic.AddUint64(&p.stats.RejectedBanned, 1)
+			p.log.Debugf("🔨 IP banido até %s, rejeitando: %s", until.Format(time.TimeOnly), conn.RemoteAddr())
+			p.reject(conn, errIDBanned, "you are banned")
+			return true
+		}
+	}
+
+	// Verifica limite de conexões
+	if atomic.LoadInt64(&p.stats.ActiveConnections) >= int64(live.MaxConns) {
+		atomic.AddUint64(&p.stats.RejectedMaxConns, 1)
+		p.log.Warnf("⚠️  Limite de conexões atingido, rejeitando: %s", conn.RemoteAddr())
+		p.reject(conn, errIDUndefined, "too many connections")
+		return true
+	}
+
+	// Limite de novas conexões por IP, antes do global para que um IP
+	// sozinho não gaste os tokens de todos. Com -rate-mode delay, quem
+	// passou do limite espera o próximo token (até -rate-max-wait) em vez
+	// de ser recusado.
+	var delay time.Duration
+	if live.rateLimiter != nil && ip != "" {
+		wait, ok := live.rateLimiter.Reserve(ip, p.rateMaxWait())
+		if !ok {
+			atomic.AddUint64(&p.stats.RejectedRateLimit, 1)
+			p.log.Warnf("⚠️  Rate limit excedido, rejeitando: %s", conn.RemoteAddr())
+			p.strike(ip)
+			p.reject(conn, errIDFlooding, "connection rate limit exceeded")
+			return true
+		}
+		delay = wait
+	}
+
+	// Limite global de novas conexões por segundo (todas as origens)
+	if p.globalLimiter != nil {
+		wait, ok := p.globalLimiter.Reserve(p.rateMaxWait())
+		if !ok {
+			// O token por IP já reservado volta: a conexão não entrou
+			if live.rateLimiter != nil && ip != "" {
+				live.rateLimiter.Refund(ip)
+			}
+			atomic.AddUint64(&p.stats.RejectedGlobalRate, 1)
+			p.log.Warnf("⚠️  Limite global de conexões/s atingido, rejeitando: %s", conn.RemoteAddr())
+			p.reject(conn, errIDFlooding, "server busy, try again later")
+			return true
+		}
+		delay = max(delay, wait)
+	}
+
+	// A espera roda em outra goroutine, sem segurar o accept dos outros
+	if delay > 0 {
+		atomic.AddUint64(&p.stats.DelayedRateLimit, 1)
+		p.log.Debugf("⏳ Rate limit: %s espera %v pelo token", conn.RemoteAddr(), delay.Round(time.Millisecond))
+		go p.admitAfter(conn, ip, delay)
+		return true
+	}
+	return p.admitReserved(conn, ip)
+}
+
+// Recusa a conexão se o proxy foi tirado do ar pelo POST /drain
+func (p *Proxy) rejectNotReady(conn net.Conn) bool {
+	if !p.notReady.Load() {
+		return false
 	}
+	atomic.AddUint64(&p.stats.RejectedNotReady, 1)
+	p.log.Debugf("🚧 Proxy em drain, rejeitando: %s", conn.RemoteAddr())
+	p.reject(conn, errIDUndefined, "proxy draining, try another server")
+	return true
 }
 
+// Espera máxima por um token de rate limit: 0 no modo drop (recusa na hora)
+func (p *Proxy) rateMaxWait() time.Duration {
+	if p.config.RateMode == rateModeDelay {
+		return p.config.RateMaxWait
+	}
+	return 0
+}
+
+// Conexão segurada pelo -rate-mode delay: segue quando o token reservado
+// estiver disponível, ou é fechada se o proxy parar antes
+func (p *Proxy) admitAfter(conn net.Conn, ip string, delay time.Duration) {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-p.shutdown:
+		conn.Close()
+		return
+	}
+
+	// O proxy pode ter saído do ar ou as vagas acabado durante a espera
+	if p.rejectNotReady(conn) {
+		return
+	}
+	if atomic.LoadInt64(&p.stats.ActiveConnections) >= int64(p.live.Load().MaxConns) {
+		atomic.AddUint64(&p.stats.RejectedMaxConns, 1)
+		p.log.Warnf("⚠️  Limite de conexões atingido, rejeitando: %s", conn.RemoteAddr())
+		p.reject(conn, errIDUndefined, "too many connections")
+		return
+	}
+	p.admitReserved(conn, ip)
+}
+
+// Resto do admit, depois dos rate limits: reserva as vagas e sobe o
+// handleConnection
+func (p *Proxy) admitReserved(conn net.Conn, ip string) bool {
+	// Reserva o slot de query no TS já no accept, para que conexões
+	// aceitas em rajada não passem juntas do limite
+	if !p.reserveUpstream() {
+		atomic.AddUint64(&p.stats.RejectedUpstreamCap, 1)
+		p.log.Warnf("⚠️  Limite de conexões com o TS atingido (%d), rejeitando: %s",
+			p.config.MaxUpstreamConns, conn.RemoteAddr())
+		p.reject(conn, errIDUndefined, "too many connections")
+		return true
+	}
+
+	// Limite de conexões simultâneas por IP, para um cliente com defeito
+	// não ocupar as vagas de todos; a vaga volta no fim do handleConnection
+	if n, ok := p.reserveIP(ip); !ok {
+		atomic.AddUint64(&p.stats.RejectedIPCap, 1)
+		atomic.AddInt64(&p.stats.UpstreamConnections, -1)
+		p.log.Warnf("⚠️  Limite de conexões por IP atingido (%s com %d), rejeitando: %s", ip, n, conn.RemoteAddr())
+		p.reject(conn, errIDUndefined, "too many connections from your address")
+		return true
+	}
+
+	// wg.Add sob o mesmo lock de Stop() para não correr com wg.Wait()
+	p.mu.Lock()
+	if p.stopping() {
+		p.mu.Unlock()
+		atomic.AddInt64(&p.stats.UpstreamConnections, -1)
+		p.releaseIP(ip)
+		conn.Close()
+		return false
+	}
+	p.wg.Add(1)
+	p.mu.Unlock()
+
+	go p.handleConnection(conn)
+	return true
+}
+
+// Encerra o proxy. Pode ser chamado em qualquer fase (antes de Start(),
+// durante o bind ou com o accept loop rodando) e mais de uma vez.
 func (p *Proxy) Stop() {
-	close(p.shutdown)
-	if p.listener != nil {
-		p.listener.Close()
+	p.stopOnce.Do(func() {
+		p.mu.Lock()
+		close(p.shutdown)
+		if p.listener != nil {
+			p.listener.Close()
+		}
+		p.mu.Unlock()
+
+		p.stopHTTP()
+		for _, t := range p.targetList() {
+			if t.pool != nil {
+				t.pool.close()
+			}
+		}
+		p.drain()
+		if p.audit != nil {
+			p.audit.close()
+		}
+		p.log.Infof("✅ Proxy encerrado")
+	})
+}
+
+// Dá às conexões até DrainTimeout para terminar a resposta em andamento,
+// fechando cada uma assim que fica ociosa. Vencido o prazo, fecha o resto
+// à força, para que uma conexão travada não segure o shutdown. Depois de
+// um handoff, antes disso as sessões seguem normais por HandoffTimeout.
+func (p *Proxy) drain() {
+	done := make(chan struct{})
+	go func() {
+		p.wg.Wait()
+		close(done)
+	}()
+
+	if p.handingOff.Load() && p.config.HandoffTimeout > 0 {
+		p.log.Infof("⏳ Esperando até %v as sessões ativas (%d) terminarem",
+			p.config.HandoffTimeout, atomic.LoadInt64(&p.stats.ActiveConnections))
+		select {
+		case <-done:
+			close(p.draining)
+			return
+		case <-time.After(p.config.HandoffTimeout):
+		}
+	}
+	close(p.draining)
+
+	deadline := time.NewTimer(p.config.DrainTimeout)
+	defer deadline.Stop()
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+
+	for {
+		p.closeConns(false)
+
+		select {
+		case <-done:
+			return
+		case <-deadline.C:
+			if n := p.closeConns(true); n > 0 {
+				p.log.Warnf("⏱️  Drain expirou, %d conexões fechadas à força", n)
+			}
+			select {
+			case <-done:
+			case <-time.After(time.Second):
+				p.log.Warnf("⚠️  Conexões ainda não encerraram, saindo mesmo assim")
+			}
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Fecha as conexões registradas: só as ociosas, ou todas se force
+func (p *Proxy) closeConns(force bool) int {
+	p.connsMu.Lock()
+	defer p.connsMu.Unlock()
+
+	n := 0
+	for c := range p.conns {
+		if force && c.close() || !force && c.closeIfIdle() {
+			n++
+		}
+	}
+	return n
+}
+
+// -max-session: a cada sessionSweepInterval, fecha as sessões abertas há
+// mais que o limite, avisando o cliente ("session expired") para ele
+// reconectar em vez de tratar como queda. A sessão ocupada espera a resposta
+// em andamento por até -close-grace, numa goroutine própria para não segurar
+// o sweeper.
+func (p *Proxy) expireSessions() {
+	ticker := time.NewTicker(sessionSweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-p.shutdown:
+			return
+		}
+
+		var expired []*activeConn
+		p.connsMu.Lock()
+		for c := range p.conns {
+			if time.Since(c.started) >= p.config.MaxSession {
+				expired = append(expired, c)
+			}
+		}
+		p.connsMu.Unlock()
+
+		for _, c := range expired {
+			if c.expiring.CompareAndSwap(false, true) {
+				go p.expireSession(c)
+			}
+		}
+	}
+}
+
+func (p *Proxy) expireSession(c *activeConn) {
+	closed, forced := c.closeGracefully("session expired", p.config.CloseGrace)
+	if !closed {
+		return
+	}
+	atomic.AddUint64(&p.stats.SessionsExpired, 1)
+	age := time.Since(c.started).Round(time.Second)
+	clog := c.logger(p.log.With(logFields{"conn_id": c.id, "client": c.clientAddr, "target": c.target}))
+	if forced {
+		clog.Warnf("⌛ Sessão expirada #%d: %s (aberta há %v, ocupada por mais de %v), fechada à força", c.id, c.who(), age, p.config.CloseGrace)
+	} else {
+		clog.Infof("⌛ Sessão expirada #%d: %s (aberta há %v), fechando", c.id, c.who(), age)
+	}
+}
+
+// Registra a conexão para o drain; falha se o proxy já está parando
+func (p *Proxy) trackConn(c *activeConn) bool {
+	p.connsMu.Lock()
+	defer p.connsMu.Unlock()
+	if p.stopping() {
+		return false
+	}
+	p.conns[c] = struct{}{}
+	return true
+}
+
+func (p *Proxy) untrackConn(c *activeConn) {
+	p.connsMu.Lock()
+	delete(p.conns, c)
+	p.connsMu.Unlock()
+}
+
+func (p *Proxy) isDraining() bool {
+	select {
+	case <-p.draining:
+		return true
+	default:
+		return false
 	}
-	p.wg.Wait()
-	log.Printf("✅ Proxy encerrado")
 }
 
-func (p *Proxy) handleConnection(clientConn net.Conn) {
-	defer p.wg.Done()
-	defer clientConn.Close()
+func (p *Proxy) stopping() bool {
+	select {
+	case <-p.shutdown:
+		return true
+	default:
+		return false
+	}
+}
+
+func (p *Proxy) handleConnection(clientConn net.Conn) {
+	defer p.wg.Done()
+	defer clientConn.Close()
+	defer atomic.AddInt64(&p.stats.UpstreamConnections, -1) // reservado no accept
+	clientKey := p.ipKey(clientConn.RemoteAddr())           // chave do rate limit e do -ban-threshold
+	defer p.releaseIP(clientKey)
+
+	atomic.AddUint64(&p.stats.TotalConnections, 1)
+	p.checkHighWater(atomic.AddInt64(&p.stats.ActiveConnections, 1))
+	defer func() {
+		p.checkHighWater(atomic.AddInt64(&p.stats.ActiveConnections, -1))
+	}()
+
+	connID := atomic.AddUint64(&p.nextConnID, 1)
+	clientAddr := clientConn.RemoteAddr().String()
+	if clientAddr == "" || clientAddr == "@" {
+		clientAddr = "unix" // cliente de socket unix não tem endereço
+	}
+	clog := p.log.With(logFields{"conn_id": connID, "client": clientAddr})
+	clog.Infof("📥 Nova conexão #%d: %s (ativas: %d)", connID, clientAddr, atomic.LoadInt64(&p.stats.ActiveConnections))
+
+	// Handshake TLS antes de ocupar uma conexão com o TS
+	var serverName string
+	if tlsConn, ok := clientConn.(*tls.Conn); ok {
+		tlsConn.SetDeadline(time.Now().Add(p.config.Timeout))
+		if err := tlsConn.Handshake(); err != nil {
+			clog.Errorf("❌ Erro no handshake TLS #%d: %s (%v)", connID, clientAddr, err)
+			return
+		}
+		state := tlsConn.ConnectionState()
+		serverName = state.ServerName
+		clog.Debugf("🔐 TLS #%d: %s, SNI %q", connID, describeTLS(state), serverName)
+	}
+
+	// Auditoria e eventos: registram o IP, sem a porta
+	clientIP := remoteIP(clientConn.RemoteAddr())
+	if clientIP == "" {
+		clientIP = clientAddr
+	}
+
+	// -sni-route: o nome pedido no handshake escolhe os destinos; o
+	// -balance vale só entre eles. Nome fora do mapa (ou sem SNI) é recusado.
+	var route []string
+	if len(p.config.SNIRoutes) > 0 {
+		route = p.config.SNIRoutes[sniName(serverName)]
+		if route == nil {
+			atomic.AddUint64(&p.stats.RejectedSNI, 1)
+			clog.Warnf("🔐 SNI desconhecido #%d: %s pediu %q, rejeitando", connID, clientAddr, serverName)
+			p.publish(eventRejected, connID, clientIP, "", "unknown server name")
+			writeError(clientConn, errIDUndefined, "unknown server name")
+			return
+		}
+	}
+
+	// Conecta no TeamSpeak local (ou pega uma conexão pronta do pool)
+	t, pc, err := p.acquireTarget(route, clientKey)
+	if errors.Is(err, ErrServerBusy) {
+		atomic.AddUint64(&p.stats.RejectedShed, 1)
+		clog.Warnf("⚠️  Destino sobrecarregado (-shed-latency), rejeitando #%d: %s", connID, clientAddr)
+		p.publish(eventRejected, connID, clientIP, "", "server busy")
+		writeError(clientConn, errIDUndefined, "server busy")
+		return
+	}
+	if errors.Is(err, ErrNoHealthyTarget) {
+		atomic.AddUint64(&p.stats.RejectedDialFailed, 1)
+		clog.Errorf("❌ Conexão #%d recusada: %v", connID, err)
+		p.publish(eventRejected, connID, clientIP, "", "no healthy target available")
+		writeError(clientConn, errIDUndefined, "no healthy target available")
+		return
+	}
+	if err != nil {
+		atomic.AddUint64(&p.stats.RejectedDialFailed, 1)
+		clog.Errorf("❌ Erro ao conectar no TS: %v", err)
+		p.publish(eventRejected, connID, clientIP, "", "dial failed")
+		return
+	}
+	tsConn := pc.conn
+	clog = clog.With(logFields{"target": t.addr})
+	atomic.AddInt64(&t.active, 1)
+	atomic.AddUint64(&t.conns, 1)
+	defer atomic.AddInt64(&t.active, -1)
+
+	// Tudo que vai para o cliente depois do banner passa por out, que
+	// serializa as escritas das goroutines do pipe (e do -max-session) e
+	// comprime com -allow-compression
+	out := newClientWriter(clientConn, &p.stats)
+	ac := newActiveConn(connID, clientAddr, t.addr, clientConn, out, tsConn)
+	defer ac.close()
+	if !p.trackConn(ac) {
+		return
+	}
+	defer p.untrackConn(ac)
+
+	p.publish(eventConnectionOpen, connID, clientIP, t.addr, "")
+	defer p.publish(eventConnectionClose, connID, clientIP, t.addr, "")
+	if p.audit != nil {
+		p.audit.record("connect", connID, clientIP, t.addr, "")
+		defer p.audit.record("disconnect", connID, clientIP, t.addr, "")
+	}
+
+	// Define timeouts
+	clientConn.SetDeadline(time.Time{}) // Sem deadline global
+	tsConn.SetDeadline(time.Time{})
+
+	// Linhas curtas e interativas: sem Nagle nas duas pontas
+	p.tuneTCP(clientConn)
+	p.tuneTCP(tsConn)
+
+	// -idle-timeout: deadline de leitura do cliente, empurrada para frente
+	// sempre que passa dado em qualquer direção
+	touch := func() {}
+	if idle := p.config.IdleTimeout; idle > 0 {
+		touch = func() { clientConn.SetReadDeadline(time.Now().Add(idle)) }
+		touch()
+	}
+
+	// Conexão do pool: o banner já foi consumido, reenvia o que o TS mandou
+	// (a não ser com -strip-banner)
+	if len(pc.banner) > 0 && !p.config.StripBanner {
+		p.setWriteDeadline(clientConn)
+		if _, err := clientConn.Write(pc.banner); err != nil {
+			return
+		}
+		atomic.AddUint64(&ac.bytesToClient, uint64(len(pc.banner)))
+		atomic.AddUint64(&p.stats.TotalBytes, uint64(len(pc.banner)))
+		atomic.AddUint64(&t.bytes, uint64(len(pc.banner)))
+	}
+
+	// -trace-io/-trace: decidido uma vez, sem custo por linha nas outras
+	trace := p.traceConn(clientConn.RemoteAddr())
+	if trace && !p.config.TraceIO {
+		clog.Debugf("🔎 Rastreando conexão #%d (-trace): %s", connID, clientAddr)
+	}
+
+	// -origin-command: o TS só vê o IP do proxy, então o proxy conta de onde
+	// o cliente veio antes do primeiro comando dele. A resposta fica no
+	// proxy, como a do keepalive.
+	var originSent bool
+	if tmpl := p.config.OriginCommand; tmpl != "" {
+		cmd := strings.ReplaceAll(tmpl, "{ip}", tsEscape(clientIP)) + "\n"
+		sent, err := ac.sendInternal(cmd, func() error {
+			p.setWriteDeadline(tsConn)
+			_, err := tsConn.Write([]byte(cmd))
+			return err
+		})
+		if err != nil {
+			clog.Errorf("❌ Erro ao enviar -origin-command #%d: %v", connID, err)
+			writeError(out, errIDUndefined, "connection closed by server")
+			return
+		}
+		// Sem envio (conexão já fechada) não há resposta para engolir nem
+		// estado de sessão mudado no TS
+		originSent = sent
+		if sent && trace {
+			p.traceLine(connID, "proxy->T", []byte(cmd))
+		}
+	}
+
+	// Pipe bidirecional
+	clientDone := make(chan struct{})
+	tsDone := make(chan struct{})
+	var sessionChanged bool // cliente (ou o -origin-command) mudou o estado da sessão no TS
+	var tsIdle bool         // leitura do TS interrompida sem nada pendente
+	var quitSent int32      // cliente mandou quit: o TS vai fechar (atomic)
+	if p.useLine != "" {
+		ac.cacheUse = trimLine(p.useLine)
+	}
+	if originSent && t.pool != nil && sessionCommands[commandVerb([]byte(p.config.OriginCommand))] {
+		sessionChanged = true
+	}
+
+	// Cliente → TeamSpeak (conta comandos)
+	go func() {
+		defer close(clientDone)
+		reader := bufio.NewReaderSize(p.shaped(clientConn, ac), p.config.BufferSize)
+		writer := bufio.NewWriter(tsConn)
+		var lastCmd time.Time
+		var lineBuf []byte
+		var cmdLimiter *tokenBucket
+		if p.config.CmdRate > 0 {
+			cmdLimiter = newTokenBucket(float64(p.config.CmdRate))
+		}
+
+		// Responde ao cliente com um erro no lugar do comando, que não vai
+		// pro TS; o erro sai depois das respostas que já estão a caminho
+		reject := func(id int, msg string) bool {
+			select {
+			case <-ac.pending.whenEmpty():
+			case <-ac.closed:
+				return false
+			}
+			p.setWriteDeadline(clientConn)
+			return writeError(out, id, msg) == nil
+		}
+
+	loop:
+		for {
+			// Lê linha do cliente (a linha reaproveita lineBuf, sem alocar)
+			line, err := readLineBuf(reader, lineBuf, p.config.MaxCommandSize)
+			lineBuf = line[:0]
+			if err != nil {
+				if errors.Is(err, ErrLineTooLong) {
+					// Linha gigante sem "\n": violação de protocolo (ou DoS),
+					// a conexão cai antes de o buffer crescer mais
+					atomic.AddUint64(&p.stats.OversizedLines, 1)
+					ac.logger(clog).Warnf("⚠️  Violação de protocolo #%d: %s mandou linha com mais de %d bytes, fechando",
+						connID, ac.who(), p.config.MaxCommandSize)
+					p.strike(clientKey)
+				} else if errors.Is(err, os.ErrDeadlineExceeded) {
+					atomic.AddUint64(&p.stats.IdleTimeouts, 1)
+					ac.logger(clog).Warnf("⏱️  Conexão ociosa #%d: %s (sem tráfego por %v), fechando", connID, ac.who(), p.config.IdleTimeout)
+					// TS lento no meio de uma resposta: dá até -close-grace
+					// para ela chegar antes de cortar
+					if ac.pending.len() > 0 && !ac.waitResponse(p.config.CloseGrace) {
+						ac.logger(clog).Warnf("⏱️  Conexão ociosa #%d: resposta não chegou em %v, fechando à força", connID, p.config.CloseGrace)
+					}
+				} else if err != io.EOF && !errors.Is(err, net.ErrClosed) {
+					ac.logger(clog).Errorf("Erro leitura cliente: %v", err)
+				}
+				break
+			}
+			touch()
+			ac.markTraffic()
+
+			// Um mesmo segmento pode trazer vários comandos terminados em
+			// "\n\r": o '\r' que sobra no início da linha seguinte pertence ao
+			// terminador anterior. Linhas vazias não são comandos e não vão pro TS.
+			line = bytes.TrimLeft(line, "\r")
+			if len(bytes.TrimSpace(line)) == 0 {
+				continue
+			}
+
+			// Rótulo da conexão (-allow-labels): guardado pelo proxy, sem
+			// resposta e sem chegar no TS. Só antes do primeiro comando; com
+			// os rótulos desligados, a linha é recusada.
+			if commandVerb(line) == labelCommand {
+				args := strings.Fields(string(line))[1:]
+				var ok bool
+				switch {
+				case !p.config.AllowLabels:
+					ok = reject(errIDUndefined, "labels not enabled")
+				case len(args) != 1 || !validLabel(args[0]):
+					ok = reject(errIDInvalidParameter, "invalid parameter")
+				case ac.labelStats.Load() != nil || atomic.LoadUint64(&ac.commandCount) > 0:
+					ok = reject(errIDUndefined, "label must be sent before the first command")
+				default:
+					p.labelConn(ac, args[0])
+					ac.logger(clog).Infof("🏷️  Conexão #%d rotulada: %s", connID, ac.who())
+					ok = true
+				}
+				if !ok {
+					break loop
+				}
+				continue
+			}
+
+			// Pedido de compressão (-allow-compression): o proxy responde, o
+			// TS nem fica sabendo. Só antes do primeiro comando, para o
+			// cliente saber de que ponto em diante o fluxo vem comprimido.
+			if p.config.AllowCompression && commandVerb(line) == compressCommand {
+				args := strings.Fields(string(line))[1:]
+				switch {
+				case len(args) != 1 || newCompressor(args[0], io.Discard) == nil:
+					if !reject(errIDInvalidParameter, "invalid parameter") {
+						break loop
+					}
+				case out.compressing() || atomic.LoadUint64(&ac.commandCount) > 0:
+					if !reject(errIDUndefined, "compression must be requested before the first command") {
+						break loop
+					}
+				default:
+					p.setWriteDeadline(clientConn)
+					if err := out.compress(args[0]); err != nil {
+						ac.logger(clog).Errorf("Erro escrita cliente: %v", err)
+						break loop
+					}
+					ac.logger(clog).Infof("🗜️  Compressão %s ligada #%d: %s", args[0], connID, ac.who())
+				}
+				continue
+			}
+
+			// Rate limit de comandos: o comando acima da cota é descartado e o
+			// cliente recebe um erro, depois das respostas que já estão a caminho
+			if cmdLimiter != nil && !cmdLimiter.Allow() {
+				atomic.AddUint64(&p.stats.RateLimitedCommands, 1)
+				if !reject(errIDFlooding, "rate limit") || p.strike(clientKey) {
+					break
+				}
+				continue
+			}
 
-	atomic.AddUint64(&p.stats.TotalConnections, 1)
-	atomic.AddInt64(&p.stats.ActiveConnections, 1)
-	defer atomic.AddInt64(&p.stats.ActiveConnections, -1)
+			// Protocolo estrito: linha que não é um comando ServerQuery
+			// válido não chega no TS
+			if p.config.StrictProtocol {
+				if _, err := parseCommand(line); err != nil {
+					atomic.AddUint64(&p.stats.MalformedCommands, 1)
+					ac.logger(clog).Warnf("⚠️  #%d %s: %v", connID, ac.who(), err)
+					if !reject(errIDInvalidParameter, "invalid parameter") || p.strike(clientKey) {
+						break
+					}
+					continue
+				}
+			}
 
-	clientAddr := clientConn.RemoteAddr().String()
-	log.Printf("📥 Nova conexão: %s (ativas: %d)", clientAddr, atomic.LoadInt64(&p.stats.ActiveConnections))
+			// Whitelist de comandos: o resto é recusado sem chegar no TS
+			if p.allowedCommands != nil {
+				if verb := commandVerb(line); !p.allowedCommands[verb] {
+					atomic.AddUint64(&p.stats.BlockedCommands, 1)
+					ac.logger(clog).Warnf("⚠️  Comando não permitido #%d %s: %s", connID, ac.who(), verb)
+					if !reject(errIDCommandNotFound, "command not allowed") {
+						break
+					}
+					continue
+				}
+			}
 
-	// Conecta no TeamSpeak local
-	tsConn, err := net.DialTimeout("tcp", p.config.TargetAddr, p.config.Timeout)
-	if err != nil {
-		log.Printf("❌ Erro ao conectar no TS: %v", err)
-		return
-	}
-	defer tsConn.Close()
+			// Identidade declarada pelo cliente, para os logs e o /connections
+			// (antes do login reescrito, que troca o usuário)
+			if verb := commandVerb(line); verb == "login" || verb == "clientupdate" {
+				if login, nickname := clientIdentity(line); login != "" || nickname != "" {
+					ac.setIdentity(login, nickname)
+					ac.logger(clog).Infof("🏷️  Conexão #%d identificada: %s", connID, ac.who())
+				}
+			}
 
-	// Define timeouts
-	clientConn.SetDeadline(time.Time{}) // Sem deadline global
-	tsConn.SetDeadline(time.Time{})
+			// Login reescrito: a senha real nunca sai do host do proxy, e a
+			// do cliente não chega no TS
+			if p.loginLine != nil && commandVerb(line) == "login" {
+				ac.logger(clog).Infof("🔑 Login reescrito #%d %s: %s → %s", connID, ac.who(), loginUser(line), p.config.LoginUser)
+				line = p.loginLine
+			}
 
-	// Contador de bytes/comandos para esta conexão
-	var bytesTransferred uint64
-	var commandCount uint64
+			// Cache: responde direto se houver resposta fresca; comandos que
+			// podem alterar o servidor invalidam o cache do destino
+			var key string
+			var scope *scopeChange
+			if t.cache != nil {
+				verb := commandVerb(line)
+				switch {
+				case verb == "login":
+					scope = &scopeChange{login: true, value: loginUser(line)}
+				case verb == "use":
+					scope = &scopeChange{value: trimLine(string(line))}
+				case cacheableCommands[verb]:
+					if s, ok := ac.cacheScope(); ok {
+						key = cacheKey(s, line)
+					}
+				case !readOnlyCommands[verb]:
+					t.cache.flush()
+				}
 
-	// Pipe bidirecional
-	done := make(chan struct{}, 2)
+				// Só com nada em andamento, para a resposta não passar na
+				// frente das respostas de comandos anteriores
+				if key != "" && ac.pending.len() == 0 {
+					if response, ok := t.cache.get(key); ok {
+						atomic.AddUint64(&p.stats.CacheHits, 1)
+						if trace {
+							p.traceLine(connID, "C->cache", line)
+						}
+						p.setWriteDeadline(clientConn)
+						if _, err := out.Write(response); err != nil {
+							ac.logger(clog).Errorf("Erro escrita cliente: %v", err)
+							break
+						}
+						atomic.AddUint64(&ac.bytesToClient, uint64(len(response)))
+						atomic.AddUint64(&p.stats.TotalBytes, uint64(len(response)))
+						atomic.AddUint64(&t.bytes, uint64(len(response)))
+						continue
+					}
+					atomic.AddUint64(&p.stats.CacheMisses, 1)
+				}
+			}
 
-	// Cliente → TeamSpeak (conta comandos)
-	go func() {
-		reader := bufio.NewReader(clientConn)
-		writer := bufio.NewWriter(tsConn)
-		
-		for {
-			// Lê linha do cliente
-			line, err := reader.ReadBytes('\n')
-			if err != nil {
-				if err != io.EOF {
-					log.Printf("Erro leitura cliente: %v", err)
+			// Pacing: segura o comando até completar o intervalo mínimo
+			// desde o anterior (enfileira, nunca descarta)
+			if p.config.MinCmdInterval > 0 && !lastCmd.IsZero() {
+				if wait := p.config.MinCmdInterval - time.Since(lastCmd); wait > 0 {
+					atomic.AddUint64(&p.stats.PacedCommands, 1)
+					timer := time.NewTimer(wait)
+					select {
+					case <-timer.C:
+					case <-p.draining:
+						timer.Stop()
+						<-ac.closed
+						break loop
+					case <-ac.closed:
+						timer.Stop()
+						break loop
+					}
 				}
+			}
+
+			if trace {
+				p.traceLine(connID, "C->T", line)
+			}
+
+			if t.pool != nil && sessionCommands[commandVerb(line)] {
+				sessionChanged = true
+			}
+			if commandVerb(line) == "quit" {
+				atomic.StoreInt32(&quitSent, 1)
+			}
+
+			// Durante o drain não repassa comandos novos; o Stop() fecha a
+			// conexão assim que a resposta em andamento chegar
+			if !ac.beginCommand(p.isDraining(), commandVerb(line), key, scope) {
+				<-ac.closed
 				break
 			}
 
 			// Envia pro TS
+			p.setWriteDeadline(tsConn)
 			_, err = writer.Write(line)
+			if err == nil {
+				err = writer.Flush()
+			}
 			if err != nil {
-				log.Printf("Erro escrita TS: %v", err)
+				if !errors.Is(err, net.ErrClosed) {
+					ac.logger(clog).Errorf("Erro escrita TS: %v", err)
+				}
 				break
 			}
-			writer.Flush()
+			lastCmd = time.Now()
+
+			if p.audit != nil {
+				p.audit.record("command", connID, clientIP, "", commandVerb(line))
+			}
 
-			bytesTransferred += uint64(len(line))
-			commandCount++
+			atomic.AddUint64(&ac.bytesToTS, uint64(len(line)))
+			atomic.AddUint64(&ac.commandCount, 1)
 			atomic.AddUint64(&p.stats.TotalCommands, 1)
 			atomic.AddUint64(&p.stats.TotalBytes, uint64(len(line)))
+			atomic.AddUint64(&t.commands, 1)
+			atomic.AddUint64(&t.bytes, uint64(len(line)))
+			if lc := ac.labelStats.Load(); lc != nil {
+				atomic.AddUint64(&lc.commands, 1)
+				atomic.AddUint64(&lc.bytesToTS, uint64(len(line)))
+			}
 		}
-		done <- struct{}{}
 	}()
 
 	// TeamSpeak → Cliente
 	go func() {
-		reader := bufio.NewReader(tsConn)
-		writer := bufio.NewWriter(clientConn)
+		defer close(tsDone)
+		defer out.finish()
+		reader := bufio.NewReaderSize(p.shaped(tsConn, ac), p.config.BufferSize)
+		received := len(pc.banner) > 0
+		var response []byte // resposta em andamento de um comando cacheável
+		var respBytes int   // tamanho da resposta em andamento, sem notificações
+		var truncated bool  // resposta em andamento passou do -response-limit
+		var lineBuf []byte
+		var unmatchedWarned bool // avisa uma resposta fora de ordem por conexão
 
 		for {
-			// Lê resposta do TS
-			line, err := reader.ReadBytes('\n')
+			// Lê resposta do TS (a linha reaproveita lineBuf, sem alocar)
+			line, err := readLineBuf(reader, lineBuf, p.config.MaxResponseSize)
+			lineBuf = line[:0]
 			if err != nil {
-				if err != io.EOF {
-					log.Printf("Erro leitura TS: %v", err)
+				if errors.Is(err, ErrLineTooLong) {
+					atomic.AddUint64(&p.stats.OversizedLines, 1)
+					ac.logger(clog).Warnf("⚠️  Violação de protocolo #%d: TS mandou linha com mais de %d bytes, fechando",
+						connID, p.config.MaxResponseSize)
+					writeError(out, errIDUndefined, "response too large")
+				} else if errors.Is(err, os.ErrDeadlineExceeded) && len(line) == 0 && reader.Buffered() == 0 {
+					// Interrompida pelo proxy para devolver a conexão ao pool
+					tsIdle = true
+				} else if !received && len(line) == 0 && !errors.Is(err, net.ErrClosed) {
+					// TS aceitou o TCP mas fechou antes do banner (limite de
+					// conexões ou IP banido do lado do servidor)
+					atomic.AddUint64(&p.stats.UpstreamClosedEarly, 1)
+					ac.logger(clog).Errorf("❌ TS fechou a conexão sem enviar banner: %s (%v)", ac.who(), err)
+					writeError(out, errIDUndefined, "server closed connection before banner")
+				} else if atomic.LoadInt32(&quitSent) == 1 && err == io.EOF {
+					// Fechamento normal depois do quit do cliente
+				} else if err == io.EOF || errors.Is(err, syscall.ECONNRESET) {
+					// TS fechou no meio da sessão (restart, kick do query,
+					// timeout do servidor): o cliente fica sabendo o motivo
+					if err == io.EOF {
+						ac.logger(clog).Infof("🔌 TS fechou a conexão #%d: %s", connID, ac.who())
+					} else {
+						ac.logger(clog).Errorf("❌ Conexão com o TS caiu #%d: %s (%v)", connID, ac.who(), err)
+					}
+					writeError(out, errIDUndefined, "connection closed by server")
+				} else if !errors.Is(err, net.ErrClosed) {
+					ac.logger(clog).Errorf("Erro leitura TS: %v", err)
 				}
 				break
 			}
+			received = true
 
-			// Envia pro cliente
-			_, err = writer.Write(line)
-			if err != nil {
-				log.Printf("Erro escrita cliente: %v", err)
+			// Resposta do keepalive (-ts-keepalive) e do -origin-command: fica
+			// no proxy e não conta como atividade do cliente. Notificações no
+			// meio dela passam.
+			if cmd, ok := ac.pending.peek(); ok && cmd.internal && !isNotifyLine(line) {
+				if isErrorLine(line) {
+					ac.pending.pop()
+					if !bytes.HasPrefix(line, []byte("error id=0 ")) {
+						ac.logger(clog).Debugf("🔕 TS recusou o %s do proxy #%d: %s", cmd.verb, connID, trimLine(string(line)))
+					}
+				}
+				if trace {
+					p.traceLine(connID, "T->proxy", line)
+				}
+				continue
+			}
+			touch()
+			ac.markTraffic()
+
+			// Evento de servernotifyregister: chega a qualquer momento, até no
+			// meio da resposta de um comando. Vai para o cliente e conta nos
+			// bytes, mas não é resposta de nenhum comando: fica fora do cache e
+			// do tempo de resposta.
+			notify := isNotifyLine(line)
+
+			// -response-limit: passou do limite do verbo, o resto da resposta
+			// é descartado e o "error id=" do TS vira um erro do proxy
+			if !notify && ac.pending.len() > 0 {
+				respBytes += len(line)
+				if !truncated && !isErrorLine(line) {
+					if cmd, ok := ac.pending.peek(); ok {
+						if limit := p.config.ResponseLimits[cmd.verb]; limit > 0 && respBytes > limit {
+							truncated = true
+							atomic.AddUint64(&p.stats.TruncatedResponses, 1)
+							ac.logger(clog).With(logFields{"verb": cmd.verb}).
+								Warnf("✂️  Resposta cortada #%d %s: %s passou de %d bytes (-response-limit)", connID, ac.who(), cmd.verb, limit)
+						}
+					}
+				}
+				if truncated && !isErrorLine(line) {
+					continue
+				}
+			}
+
+			if t.cache != nil && ac.pending.len() > 0 && !notify {
+				response = append(response, line...)
+			}
+
+			if !notify && isErrorLine(line) {
+				if cmd, ok := ac.pending.pop(); ok {
+					elapsed := time.Since(cmd.sent)
+					p.cmdTimings.Observe(cmd.verb, elapsed, respBytes)
+					t.observeCommandLatency(elapsed)
+					t.cmdHist.Observe(elapsed)
+					t.sizeHist.Observe(respBytes)
+					if slow := p.config.SlowCommand; slow > 0 && elapsed >= slow {
+						atomic.AddUint64(&p.stats.SlowCommands, 1)
+						ac.logger(clog).With(logFields{"verb": cmd.verb, "latency_ms": elapsed.Milliseconds()}).
+							Warnf("🐌 Comando lento #%d %s: %s levou %v", connID, ac.who(), cmd.verb, elapsed.Round(time.Millisecond))
+					}
+					// Só respostas de sucesso vão para o cache ou mudam o escopo
+					success := bytes.HasPrefix(bytes.TrimLeft(line, "\r"), []byte("error id=0 "))
+					if cmd.cacheKey != "" && success && !truncated {
+						t.cache.set(cmd.cacheKey, response)
+					}
+					if cmd.scope != nil {
+						ac.endScope(cmd.scope, success)
+					}
+					if truncated {
+						line = fmt.Appendf(nil, "error id=%d msg=%s\n\r", errIDUndefined, tsEscaper.Replace("response too large"))
+					}
+				} else {
+					// "error id=" sem comando pendente: o TS respondeu algo que
+					// não passou pelo proxy, e as respostas seguintes podem estar
+					// sendo atribuídas ao comando errado
+					atomic.AddUint64(&p.stats.UnmatchedResponses, 1)
+					if !unmatchedWarned {
+						ac.logger(clog).Warnf("⚠️  Resposta fora de ordem #%d: %s recebeu %q sem comando pendente",
+							connID, ac.who(), trimLine(string(line)))
+						unmatchedWarned = true
+					}
+				}
+				response = nil
+				respBytes, truncated = 0, false
+			}
+
+			if trace {
+				p.traceLine(connID, "T->C", line)
+			}
+
+			// Envia pro cliente. Com -write-timeout, um cliente que parou de
+			// ler não segura esta goroutine (e a conexão com o TS) para sempre
+			p.setWriteDeadline(clientConn)
+			if _, err := out.Write(line); err != nil {
+				if errors.Is(err, os.ErrDeadlineExceeded) {
+					atomic.AddUint64(&p.stats.WriteTimeouts, 1)
+					ac.logger(clog).Warnf("⏱️  Cliente travado #%d: %s (escrita parada por %v), fechando", connID, ac.who(), p.config.WriteTimeout)
+				} else if !errors.Is(err, net.ErrClosed) {
+					ac.logger(clog).Errorf("Erro escrita cliente: %v", err)
+				}
 				break
 			}
-			writer.Flush()
 
-			bytesTransferred += uint64(len(line))
+			atomic.AddUint64(&ac.bytesToClient, uint64(len(line)))
 			atomic.AddUint64(&p.stats.TotalBytes, uint64(len(line)))
+			atomic.AddUint64(&t.bytes, uint64(len(line)))
+			if lc := ac.labelStats.Load(); lc != nil {
+				atomic.AddUint64(&lc.bytesToClient, uint64(len(line)))
+			}
 		}
-		done <- struct{}{}
 	}()
 
+	// -ts-keepalive: com a conexão parada e nada pendente, manda um
+	// "version" ao TS de tempos em tempos, para ele não derrubar a sessão
+	// por ociosidade. A resposta não chega ao cliente.
+	keepaliveDone := make(chan struct{})
+	if interval := p.config.TSKeepAlive; interval > 0 {
+		go func() {
+			defer close(keepaliveDone)
+			timer := time.NewTimer(interval)
+			defer timer.Stop()
+			for {
+				select {
+				case <-timer.C:
+				case <-clientDone:
+					return
+				case <-tsDone:
+					return
+				case <-ac.closed:
+					return
+				}
+
+				if idle := ac.idleFor(); idle < interval {
+					timer.Reset(interval - idle)
+					continue
+				}
+				if !p.isDraining() {
+					sent, err := ac.sendInternal(keepaliveCommand, func() error {
+						p.setWriteDeadline(tsConn)
+						_, err := tsConn.Write([]byte(keepaliveCommand))
+						return err
+					})
+					if err != nil {
+						if !errors.Is(err, net.ErrClosed) {
+							ac.logger(clog).Errorf("Erro escrita TS (keepalive): %v", err)
+						}
+						return
+					}
+					if sent {
+						atomic.AddUint64(&p.stats.TSKeepalives, 1)
+						if trace {
+							p.traceLine(connID, "proxy->T", []byte(keepaliveCommand))
+						}
+					}
+				}
+				timer.Reset(interval)
+			}
+		}()
+	} else {
+		close(keepaliveDone)
+	}
+
 	// Espera uma das direções terminar
-	<-done
+	var reused bool
+	select {
+	case <-clientDone:
+		// Cliente saiu: se a sessão no TS está limpa, devolve a conexão ao
+		// pool (um keepalive ainda sem resposta conta como pendente)
+		<-keepaliveDone
+		if t.pool != nil && !sessionChanged && ac.pending.len() == 0 {
+			tsConn.SetReadDeadline(time.Now())
+			<-tsDone
+			if tsIdle && ac.detachTS() {
+				tsConn.SetReadDeadline(time.Time{})
+				t.pool.put(pc)
+				reused = true
+			}
+		}
+	case <-tsDone:
+	}
+
+	// Fecha as duas pontas (a conexão devolvida ao pool já foi desvinculada)
+	// para destravar a goroutine que ainda estiver em um Read, e espera as
+	// duas: nenhuma sobrevive segurando uma conexão meio aberta
+	ac.close()
+	<-clientDone
+	<-tsDone
+	<-keepaliveDone
+
+	if t.pool != nil && !reused {
+		t.pool.discard(pc)
+	}
+
+	cmdCount := atomic.LoadUint64(&ac.commandCount)
+	toTS, toClient := atomic.LoadUint64(&ac.bytesToTS), atomic.LoadUint64(&ac.bytesToClient)
+	ac.logger(clog).With(logFields{
+		"cmd_count":       cmdCount,
+		"bytes":           toTS + toClient,
+		"bytes_to_ts":     toTS,
+		"bytes_to_client": toClient,
+	}).Infof("📤 Conexão encerrada #%d: %s (comandos: %d, bytes cliente→TS: %d, TS→cliente: %d)",
+		connID, ac.who(), cmdCount, toTS, toClient)
+	if lc := ac.labelStats.Load(); lc != nil {
+		atomic.AddInt64(&lc.active, -1)
+	}
+}
+
+// Senhas em comandos login (posicional ou client_login_password=)
+var (
+	loginPositionalRe = regexp.MustCompile(`^(\s*login\s+\S+\s+)\S+`)
+	loginPasswordRe   = regexp.MustCompile(`(client_login_password=)\S+`)
+)
+
+// Remove senhas de uma linha antes de ir para o log
+func redactLine(line string) string {
+	line = loginPositionalRe.ReplaceAllString(line, "${1}***")
+	return loginPasswordRe.ReplaceAllString(line, "${1}***")
+}
+
+// Registra uma linha trafegada (-trace-io/-trace), com senhas removidas,
+// truncada em TraceIOMax bytes e com os caracteres de controle escapados
+// (o terminador aparece como \n\r)
+func (p *Proxy) traceLine(connID uint64, dir string, line []byte) {
+	text := redactLine(string(line))
+	if max := p.config.TraceIOMax; max > 0 && len(text) > max {
+		text = fmt.Sprintf("%s... (+%d bytes)", escapeTrace(text[:max]), len(text)-max)
+	} else {
+		text = escapeTrace(text)
+	}
+	p.log.Debugf("🔎 #%d %s %s", connID, dir, text)
+}
+
+// Escreve uma linha de erro no formato do ServerQuery
+func writeError(w io.Writer, id int, msg string) error {
+	_, err := fmt.Fprintf(w, "error id=%d msg=%s\n\r", id, tsEscaper.Replace(msg))
+	return err
+}
+
+// Recusa uma conexão no accept com uma linha de erro, para o cliente saber
+// o motivo em vez de ver só a conexão caindo. O prazo vale também para a
+// leitura porque, com -tls, o Write faz o handshake; o erro é ignorado (o
+// cliente pode já ter ido embora).
+func rejectConn(conn net.Conn, id int, msg string) {
+	conn.SetDeadline(time.Now().Add(rejectWriteTimeout))
+	writeError(conn, id, msg)
+	conn.Close()
+}
+
+// Recusa dos limites do admit, com o evento "rejected" em /events. A
+// escrita roda fora do accept loop: uma rajada de clientes recusados (ou
+// de handshakes TLS lentos) não atrasa o accept de ninguém.
+func (p *Proxy) reject(conn net.Conn, id int, msg string) {
+	p.publish(eventRejected, 0, remoteIP(conn.RemoteAddr()), "", msg)
+	select {
+	case p.rejecting <- struct{}{}:
+		go func() {
+			defer func() { <-p.rejecting }()
+			rejectConn(conn, id, msg)
+		}()
+	default:
+		conn.Close()
+	}
+}
+
+// TCP_NODELAY e keepalive (-keepalive) numa conexão TCP, mesmo por baixo
+// do TLS ou do PROXY protocol. Socket unix e o TS do modo echo não são TCP
+// e ficam como estão.
+func (p *Proxy) tuneTCP(conn net.Conn) {
+	for {
+		switch c := conn.(type) {
+		case *tls.Conn:
+			conn = c.NetConn()
+		case *proxyConn:
+			conn = c.Conn
+		case *net.TCPConn:
+			c.SetNoDelay(true)
+			if p.config.KeepAlive > 0 {
+				c.SetKeepAlive(true)
+				c.SetKeepAlivePeriod(p.config.KeepAlive)
+			} else {
+				c.SetKeepAlive(false)
+			}
+			return
+		default:
+			return
+		}
+	}
+}
+
+// Prazo para a próxima escrita em conn (-write-timeout; 0 = sem prazo)
+func (p *Proxy) setWriteDeadline(conn net.Conn) {
+	if p.config.WriteTimeout > 0 {
+		conn.SetWriteDeadline(time.Now().Add(p.config.WriteTimeout))
+	}
+}
+
+// Reserva uma conexão com o TS respeitando -max-upstream-conns, que deve
+// ficar abaixo do limite de queries simultâneas do próprio servidor
+func (p *Proxy) reserveUpstream() bool {
+	n := atomic.AddInt64(&p.stats.UpstreamConnections, 1)
+	if max := int64(p.config.MaxUpstreamConns); max > 0 && n > max {
+		atomic.AddInt64(&p.stats.UpstreamConnections, -1)
+		return false
+	}
+	return true
+}
+
+// Chave do cliente no rate limit e no -max-conns-per-ip
+func (p *Proxy) ipKey(addr net.Addr) string {
+	return ipKey(addr, p.config.RateIPv4Prefix, p.config.RateIPv6Prefix)
+}
+
+// Reserva uma vaga do IP respeitando -max-conns-per-ip; devolve quantas
+// conexões o IP já tem
+func (p *Proxy) reserveIP(ip string) (int, bool) {
+	if p.config.MaxConnsPerIP <= 0 || ip == "" {
+		return 0, true
+	}
+	p.ipConnsMu.Lock()
+	defer p.ipConnsMu.Unlock()
+	n := p.ipConns[ip]
+	if n >= p.config.MaxConnsPerIP {
+		return n, false
+	}
+	p.ipConns[ip] = n + 1
+	return n + 1, true
+}
+
+func (p *Proxy) releaseIP(ip string) {
+	if p.config.MaxConnsPerIP <= 0 || ip == "" {
+		return
+	}
+	p.ipConnsMu.Lock()
+	defer p.ipConnsMu.Unlock()
+	if p.ipConns[ip] <= 1 {
+		delete(p.ipConns, ip)
+	} else {
+		p.ipConns[ip]--
+	}
+}
+
+// Comandos que mudam o estado da sessão no TS; depois deles a conexão não
+// volta para o pool, para não vazar login/servidor virtual para outro cliente
+var sessionCommands = map[string]bool{
+	"login": true, "logout": true, "use": true, "quit": true,
+	"clientupdate": true, "servernotifyregister": true, "servernotifyunregister": true,
+}
+
+// Conecta no TeamSpeak; falhas são envolvidas em ErrTargetUnreachable
+func (p *Proxy) dialTarget(addr string) (net.Conn, error) {
+	if p.config.Echo {
+		return newEchoConn(), nil
+	}
+	// Com -target-tls o -timeout cobre a discagem e o handshake juntos
+	var deadline time.Time
+	if p.config.Timeout > 0 {
+		deadline = time.Now().Add(p.config.Timeout)
+	}
+	conn, err := net.DialTimeout("tcp", addr, p.config.Timeout)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrTargetUnreachable, err)
+	}
+	if p.targetTLS != nil {
+		tlsConn, err := p.clientHandshake(conn, addr, deadline)
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("%w: %w", ErrTargetUnreachable, err)
+		}
+		return tlsConn, nil
+	}
+	return conn, nil
+}
 
-	log.Printf("📤 Conexão encerrada: %s (comandos: %d, bytes: %d)", 
-		clientAddr, commandCount, bytesTransferred)
+// Atualiza o sinal de "perto da capacidade" e avisa quando as conexões
+// ativas cruzam o limiar. O aviso tem debounce para não inundar o log
+// quando o número de conexões oscila em torno do limiar.
+func (p *Proxy) checkHighWater(active int64) {
+	if p.config.HighWaterPct <= 0 {
+		return
+	}
+
+	maxConns := p.live.Load().MaxConns
+	threshold := int64(maxConns) * int64(p.config.HighWaterPct) / 100
+	if threshold < 1 {
+		threshold = 1
+	}
+
+	if active < threshold {
+		atomic.StoreInt32(&p.stats.NearCapacity, 0)
+		return
+	}
+
+	if !atomic.CompareAndSwapInt32(&p.stats.NearCapacity, 0, 1) {
+		return
+	}
+
+	now := time.Now().UnixNano()
+	last := atomic.LoadInt64(&p.lastHighWaterWarn)
+	if now-last < int64(highWaterWarnInterval) || !atomic.CompareAndSwapInt64(&p.lastHighWaterWarn, last, now) {
+		return
+	}
+	p.log.Warnf("⚠️  Perto do limite de conexões: %d/%d (aviso em %d%%)",
+		active, maxConns, p.config.HighWaterPct)
+}
+
+// Aplica jitter de ±pct% em um intervalo, para que várias instâncias
+// iniciadas ao mesmo tempo não executem tarefas periódicas em sincronia
+func jitter(d time.Duration, pct int) time.Duration {
+	spread := int64(d) * int64(pct) / 100
+	if spread <= 0 {
+		return d
+	}
+	return d + time.Duration(rand.Int63n(2*spread+1)-spread)
 }
 
 func (p *Proxy) PrintStats() {
 	uptime := time.Since(p.stats.StartTime)
-	log.Printf("📊 Estatísticas:")
-	log.Printf("   Uptime: %s", uptime.Round(time.Second))
-	log.Printf("   Total conexões: %d", atomic.LoadUint64(&p.stats.TotalConnections))
-	log.Printf("   Conexões ativas: %d", atomic.LoadInt64(&p.stats.ActiveConnections))
-	log.Printf("   Total comandos: %d", atomic.LoadUint64(&p.stats.TotalCommands))
-	log.Printf("   Total bytes: %d", atomic.LoadUint64(&p.stats.TotalBytes))
+	p.log.Infof("📊 Estatísticas:")
+	p.log.Infof("   Uptime: %s", uptime.Round(time.Second))
+	p.log.Infof("   Total conexões: %d", atomic.LoadUint64(&p.stats.TotalConnections))
+	p.log.Infof("   Conexões ativas: %d", atomic.LoadInt64(&p.stats.ActiveConnections))
+	p.log.Infof("   Conexões com o TS: %d", atomic.LoadInt64(&p.stats.UpstreamConnections))
+	if atomic.LoadInt32(&p.stats.NearCapacity) == 1 {
+		p.log.Infof("   ⚠️  Perto da capacidade máxima")
+	}
+	p.log.Infof("   Total comandos: %d", atomic.LoadUint64(&p.stats.TotalCommands))
+	p.log.Infof("   Total bytes: %d", atomic.LoadUint64(&p.stats.TotalBytes))
+	if len(p.targetList()) > 1 {
+		for _, t := range p.targetList() {
+			line := fmt.Sprintf("   Destino %s: %d ativas, %d comandos, %d bytes", t.addr,
+				atomic.LoadInt64(&t.active), atomic.LoadUint64(&t.commands), atomic.LoadUint64(&t.bytes))
+			if rtt := t.latency(); rtt > 0 {
+				line += fmt.Sprintf(", latência %v", rtt.Round(10*time.Microsecond))
+			}
+			if t.breaker != nil {
+				line += ", circuito " + t.circuit()
+			}
+			p.log.Infof("%s", line)
+		}
+	}
+	p.log.Infof("   Comandos espaçados (pacing): %d", atomic.LoadUint64(&p.stats.PacedCommands))
+	p.log.Infof("   TS fechou sem banner: %d", atomic.LoadUint64(&p.stats.UpstreamClosedEarly))
+	p.log.Infof("   Fechadas por ociosidade: %d", atomic.LoadUint64(&p.stats.IdleTimeouts))
+	if p.config.MaxSession > 0 {
+		p.log.Infof("   Fechadas por -max-session: %d", atomic.LoadUint64(&p.stats.SessionsExpired))
+	}
+	if p.config.ConnBandwidth > 0 {
+		p.log.Infof("   Conexões limitadas por -conn-bandwidth: %d", atomic.LoadUint64(&p.stats.ThrottledConnections))
+	}
+	p.log.Infof("   Fechadas por cliente travado: %d", atomic.LoadUint64(&p.stats.WriteTimeouts))
+	p.log.Infof("   Fechadas por linha grande demais: %d", atomic.LoadUint64(&p.stats.OversizedLines))
+	if len(p.config.ResponseLimits) > 0 {
+		p.log.Infof("   Respostas cortadas pelo -response-limit: %d", atomic.LoadUint64(&p.stats.TruncatedResponses))
+	}
+	if p.config.TSKeepAlive > 0 {
+		p.log.Infof("   Keepalives enviados ao TS: %d", atomic.LoadUint64(&p.stats.TSKeepalives))
+	}
+	if p.config.AllowCompression {
+		p.log.Infof("   Conexões comprimidas: %d (%d bytes → %d na rede)", atomic.LoadUint64(&p.stats.CompressedConnections),
+			atomic.LoadUint64(&p.stats.UncompressedBytes), atomic.LoadUint64(&p.stats.CompressedBytes))
+	}
+	p.log.Infof("   Comandos não permitidos: %d", atomic.LoadUint64(&p.stats.BlockedCommands))
+	p.log.Infof("   Comandos malformados recusados: %d", atomic.LoadUint64(&p.stats.MalformedCommands))
+	p.log.Infof("   Comandos descartados (rate limit): %d", atomic.LoadUint64(&p.stats.RateLimitedCommands))
+	if p.config.SlowCommand > 0 {
+		p.log.Infof("   Comandos lentos: %d", atomic.LoadUint64(&p.stats.SlowCommands))
+	}
+	p.log.Infof("   Rejeitadas (rate limit por IP): %d", atomic.LoadUint64(&p.stats.RejectedRateLimit))
+	p.log.Infof("   Rejeitadas (limite global/s): %d", atomic.LoadUint64(&p.stats.RejectedGlobalRate))
+	if p.config.BanThreshold > 0 {
+		p.log.Infof("   Rejeitadas (IP banido): %d, em %d banimentos", atomic.LoadUint64(&p.stats.RejectedBanned), atomic.LoadUint64(&p.stats.Bans))
+	}
+	if p.config.RateMode == rateModeDelay {
+		p.log.Infof("   Seguradas pelo rate limit: %d", atomic.LoadUint64(&p.stats.DelayedRateLimit))
+	}
+	p.log.Infof("   Rejeitadas (limite de conexões com o TS): %d", atomic.LoadUint64(&p.stats.RejectedUpstreamCap))
+	p.log.Infof("   Rejeitadas (max conexões): %d", atomic.LoadUint64(&p.stats.RejectedMaxConns))
+	p.log.Infof("   Rejeitadas (conexões por IP): %d", atomic.LoadUint64(&p.stats.RejectedIPCap))
+	p.log.Infof("   Rejeitadas (IP não permitido): %d", atomic.LoadUint64(&p.stats.RejectedDenylist))
+	p.log.Infof("   Rejeitadas (falha ao conectar no TS): %d", atomic.LoadUint64(&p.stats.RejectedDialFailed))
+	if p.config.ShedLatency > 0 {
+		p.log.Infof("   Rejeitadas (destino lento, -shed-latency): %d", atomic.LoadUint64(&p.stats.RejectedShed))
+	}
+	if len(p.config.SNIRoutes) > 0 {
+		p.log.Infof("   Rejeitadas (SNI fora do -sni-route): %d", atomic.LoadUint64(&p.stats.RejectedSNI))
+	}
+	if p.config.DialRetries > 0 {
+		p.log.Infof("   Novas tentativas de conexão com o TS: %d", atomic.LoadUint64(&p.stats.DialRetries))
+	}
+	p.log.Infof("   Rejeitadas (em drain pelo /drain): %d", atomic.LoadUint64(&p.stats.RejectedNotReady))
+	if p.config.CacheTTL > 0 {
+		p.log.Infof("   Cache: %d hits, %d misses", atomic.LoadUint64(&p.stats.CacheHits), atomic.LoadUint64(&p.stats.CacheMisses))
+	}
 }
 
 func main() {
 	// Flags de linha de comando
-	listenAddr := flag.String("listen", ":10202", "Endereço para escutar (ex: :10202)")
-	targetAddr := flag.String("target", "localhost:10011", "Endereço do TeamSpeak ServerQuery")
+	configFile := flag.String("config", "", "Arquivo JSON com os parâmetros (as flags da linha de comando têm prioridade)")
+	listenAddr := flag.String("listen", ":10202", "Endereço para escutar (ex: :10202, 10.0.0.5:10202 ou unix:/run/batqa.sock)")
+	listenV4Only := flag.Bool("listen-v4-only", false, "Escuta só em IPv4 (com -listen :porta, 0.0.0.0 em vez de todas as interfaces IPv4 e IPv6)")
+	listenV6Only := flag.Bool("listen-v6-only", false, "Escuta só em IPv6, sem aceitar clientes IPv4 pelo socket dual-stack")
+	targetAddr := flag.String("target", "localhost:10011", "Endereço do TeamSpeak ServerQuery (vários separados por vírgula; srv://nome resolve por DNS SRV)")
+	srvRefresh := flag.Duration("srv-refresh", defaultSRVRefresh, "Intervalo entre resoluções dos -target srv://")
+	balance := flag.String("balance", balanceRoundRobin, "Distribuição entre vários -target (round-robin, random, least-conn, latency, sticky)")
+	stickyStay := flag.Bool("sticky-stay", false, "Com -balance sticky, o cliente que mudou de destino porque o dele caiu fica no novo quando o original volta (padrão: volta para o original)")
 	maxConns := flag.Int("max-conns", 100, "Máximo de conexões simultâneas")
 	timeout := flag.Duration("timeout", 30*time.Second, "Timeout de conexão")
+	dialRetries := flag.Int("dial-retries", 0, "Novas tentativas de conectar em cada destino antes de desistir dele, com espera exponencial entre elas (0 = desativado)")
+	dialRetryMax := flag.Duration("dial-retry-max", defaultDialRetryMax, "Tempo máximo gasto em novas tentativas (-dial-retries) por conexão de cliente, somando todos os destinos")
 	logLevel := flag.String("log", "info", "Nível de log (debug, info, warn, error)")
+	logFormat := flag.String("log-format", logFormatText, "Formato do log: text ou json (um objeto por linha)")
+	tlsCert := flag.String("tls-cert", "", "Certificado TLS (PEM) para os clientes; requer -tls-key")
+	tlsKey := flag.String("tls-key", "", "Chave privada TLS (PEM) para os clientes; requer -tls-cert")
+	var sniRouteMap sniRoutes
+	flag.Var(&sniRouteMap, "sni-route", "Destinos por nome do SNI, ex: querya.example.com=10.0.0.1:10011,queryb.example.com=10.0.0.2:10011; nomes fora da lista são recusados (requer -tls-cert)")
+	targetTLS := flag.Bool("target-tls", false, "Conecta no TS com TLS (ServerQuery em SSL), verificando o certificado pelo host do -target")
+	targetTLSInsecure := flag.Bool("target-tls-insecure", false, "Com -target-tls, aceita qualquer certificado do TS (autoassinado); requer -target-tls")
+	tlsMinVersion := flag.String("tls-min-version", "1.2", "Versão mínima de TLS aceita dos clientes: 1.2 ou 1.3")
+	tlsCiphers := flag.String("tls-ciphers", "", "Suítes TLS 1.2 aceitas dos clientes, separadas por vírgula (ex: TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384; vazio = padrão do Go)")
+	targetTLSMinVersion := flag.String("target-tls-min-version", "1.2", "Com -target-tls, versão mínima de TLS com o TS: 1.2 ou 1.3")
+	targetTLSCiphers := flag.String("target-tls-ciphers", "", "Com -target-tls, suítes TLS 1.2 oferecidas ao TS, separadas por vírgula (vazio = padrão do Go)")
+	poolSize := flag.Int("pool-size", 0, "Conexões pré-abertas com cada TS de destino (0 = desativado)")
+	poolUser := flag.String("pool-user", "", "Login feito nas conexões do pool (vazio = sem login)")
+	poolPass := flag.String("pool-pass", "", "Senha do login do pool")
+	rewriteLogin := flag.Bool("rewrite-login", false, "Substitui o login enviado pelos clientes por -login-user/-login-pass")
+	loginUser := flag.String("login-user", "", "Usuário ServerQuery usado no lugar do login do cliente (com -rewrite-login)")
+	loginPass := flag.String("login-pass", "", "Senha usada no lugar da do cliente (com -rewrite-login)")
+	cacheTTL := flag.Duration("cache-ttl", 0, "Tempo de vida das respostas de serverinfo/channellist/clientlist em cache (0 = desativado)")
+	cacheErrorLine := flag.String("cache-error-line", cacheErrorVerbatim, "Linha \"error id=\" das respostas servidas do cache: verbatim (a que o TS mandou) ou regenerate (sempre \"error id=0 msg=ok\")")
+	healthInterval := flag.Duration("health-interval", 0, "Intervalo do health check dos destinos (0 = desativado)")
+	healthProbe := flag.Bool("health-probe", false, "No health check, também envia um version e exige resposta")
+	breakerThreshold := flag.Int("breaker-threshold", 0, "Falhas seguidas (discagem ou health check) que abrem o circuito do destino (0 = desativado)")
+	breakerCooldown := flag.Duration("breaker-cooldown", 30*time.Second, "Tempo que o destino fica de fora com o circuito aberto, antes da tentativa de teste")
+	allowList := flag.String("allow", "", "Faixas CIDR que podem conectar, separadas por vírgula (vazio = todas)")
+	allowFilePath := flag.String("allow-file", "", "Arquivo com faixas CIDR que podem conectar, uma por linha; relido sozinho quando muda (soma com -allow)")
+	denyList := flag.String("deny", "", "Faixas CIDR bloqueadas, separadas por vírgula")
+	bufferSize := byteSize(defaultBufferSize)
+	maxCommandSize := byteSize(defaultMaxCommandSize)
+	flag.Var(&maxCommandSize, "max-command-size", "Tamanho máximo de uma linha do cliente; acima disso a conexão cai (0 = sem limite)")
+	var maxResponseSize byteSize
+	var respLimits responseLimits
+	var connBandwidth byteSize
+	flag.Var(&connBandwidth, "conn-bandwidth", "Banda máxima por conexão, em bytes/s em cada direção (ex: 256k, 1MB); acima disso a leitura é espaçada (0 = sem limite)")
+	flag.Var(&maxResponseSize, "max-response-size", "Tamanho máximo de uma linha vinda do TS; acima disso a conexão cai (0 = sem limite)")
+	flag.Var(&respLimits, "response-limit", "Tamanho máximo da resposta inteira por comando, ex: clientdblist=10m,channellist=1m; acima disso o resto é descartado e o cliente recebe um erro (vazio = sem limite)")
+	flag.Var(&bufferSize, "buffer-size", "Buffer de leitura de cada direção da conexão (ex: 64k); linhas maiores também passam, em mais de uma leitura")
+	stripBanner := flag.Bool("strip-banner", false, "Não repassa ao cliente o banner do TS (TS3 e Welcome...)")
+	autoUse := flag.Int("auto-use", 0, "Envia use sid=N em toda conexão nova com o TS, antes do tráfego do cliente (0 = desativado)")
+	originCommand := flag.String("origin-command", "", "Comando enviado ao TS em toda conexão nova, com {ip} trocado pelo IP do cliente; a resposta não chega ao cliente (ex: \"clientupdate client_description=origin:{ip}\")")
+	echo := flag.Bool("echo", false, "Não conecta no TS: responde error id=0 a todo comando (para testes)")
+	writeTimeout := flag.Duration("write-timeout", 10*time.Second, "Prazo para cada escrita no cliente ou no TS; quem não lê nesse tempo é desconectado (0 = sem prazo)")
+	auditLog := flag.String("audit-log", "", "Arquivo de auditoria: uma linha por conexão e por comando repassado (só o nome do comando)")
+	keepAlive := flag.Duration("keepalive", 30*time.Second, "Período do TCP keepalive nas conexões com o cliente e com o TS (0 = desativado)")
+	tsKeepAlive := flag.Duration("ts-keepalive", 0, "Com a conexão parada por esse tempo, manda um version ao TS para ele não derrubá-la por ociosidade; vale também para o pool (0 = desativado)")
+	allowLabels := flag.Bool("allow-labels", false, "Aceita a linha \"batqa-label <nome>\" do cliente, antes do primeiro comando, e usa o nome nos logs, em /connections e nos contadores por rótulo do /stats")
+	allowCompression := flag.Bool("allow-compression", false, "Aceita o pedido \"batqa-compress gzip|deflate\" do cliente, antes do primeiro comando, e comprime o que vai do TS para ele")
+	idleTimeout := flag.Duration("idle-timeout", 0, "Fecha a conexão sem tráfego em nenhuma direção por esse tempo (0 = desativado)")
+	maxSession := flag.Duration("max-session", 0, "Fecha a conexão aberta há mais que isso, com error id=1 msg=session\\sexpired antes (0 = sem limite)")
+	proxyProtocol := flag.Bool("proxy-protocol", false, "Lê o cabeçalho PROXY (v1/v2) do HAProxy/nginx para obter o IP real do cliente")
+	drainTimeout := flag.Duration("drain-timeout", 10*time.Second, "Tempo para conexões terminarem o comando em andamento no shutdown")
+	closeGrace := flag.Duration("close-grace", 10*time.Second, "Espera máxima pela resposta em andamento antes de fechar por ociosidade, -max-session ou /connections/{id}/close (0 = fecha na hora)")
+	handoffTimeout := flag.Duration("handoff-timeout", 5*time.Minute, "Depois do SIGUSR1, tempo que as sessões do processo antigo seguem antes do drain")
+	statsInterval := flag.Duration("stats-interval", 5*time.Minute, "Intervalo das estatísticas no log (0 = só no encerramento e no SIGUSR2)")
+	statsAddr := flag.String("stats-addr", "", "Endereço do servidor HTTP de estatísticas (ex: :9090, vazio = desativado)")
+	adminToken := flag.String("admin-token", "", "Segredo das rotas de administração no -stats-addr (/cache, /drain...), enviado como Authorization: Bearer (vazio = rotas desativadas)")
+	maxConnsPerIP := flag.Int("max-conns-per-ip", 0, "Máximo de conexões simultâneas de um mesmo IP (0 = sem limite)")
+	maxUpstreamConns := flag.Int("max-upstream-conns", 0, "Máximo de conexões simultâneas com o TS (0 = sem limite)")
+	connRate := flag.Int("conn-rate", 0, "Máximo de novas conexões de um mesmo IP por -rate-window (0 = ilimitado); para comandos, veja -cmd-rate")
+	rateLimit := flag.Int("rate-limit", 0, "Obsoleto: nome antigo do -conn-rate")
+	rateWindow := flag.Duration("rate-window", defaultRateWindow, "Janela do -conn-rate: o IP faz até -conn-rate conexões em rajada, recarregadas ao longo dessa janela")
+	rateIPv4Prefix := flag.Int("rate-ipv4-prefix", defaultIPv4Prefix, "No -conn-rate e no -max-conns-per-ip, IPv4 da mesma rede /N contam como um só")
+	rateIPv6Prefix := flag.Int("rate-ipv6-prefix", defaultIPv6Prefix, "No -conn-rate e no -max-conns-per-ip, IPv6 da mesma rede /N contam como um só")
+	banThreshold := flag.Int("ban-threshold", 0, "Bane o IP que acumular N recusas (rate limit, linha grande, comando malformado) dentro de -ban-window (0 = desativado)")
+	banWindow := flag.Duration("ban-window", time.Minute, "Janela em que as recusas do -ban-threshold são contadas")
+	banDuration := flag.Duration("ban-duration", 5*time.Minute, "Tempo de banimento do -ban-threshold; conexões do IP banido são recusadas no accept")
+	rateMode := flag.String("rate-mode", rateModeDrop, "Conexão acima do -conn-rate/-global-conn-rate: drop (recusa) ou delay (espera o próximo token)")
+	rateMaxWait := flag.Duration("rate-max-wait", 2*time.Second, "Com -rate-mode delay, espera máxima pelo token; acima disso a conexão é recusada")
+	globalConnRate := flag.Int("global-conn-rate", 0, "Máximo de novas conexões por segundo, somando todos os IPs (0 = ilimitado)")
+	highWater := flag.Int("high-water", 80, "Avisa quando as conexões ativas passam deste % de -max-conns (0 = desativado)")
+	jitterPct := flag.Int("jitter", 10, "Variação aleatória (%) nos intervalos de tarefas periódicas")
+	traceIO := flag.Bool("trace-io", false, "Registra cada linha trafegada (requer -log debug; só para depuração)")
+	traceIOMax := flag.Int("trace-io-max", 256, "Tamanho máximo de cada linha registrada pelo -trace-io")
+	traceSpec := flag.String("trace", "", "Como o -trace-io, só para algumas conexões: um número (as próximas N) ou IPs/faixas CIDR separados por vírgula (requer -log debug)")
+	allowCommands := flag.String("allow-commands", "", "Comandos permitidos, separados por vírgula (vazio = todos)")
+	strictProtocol := flag.Bool("strict-protocol", false, "Recusa linhas que não são comandos ServerQuery válidos, sem repassar ao TS")
+	cmdRate := flag.Int("cmd-rate", 0, "Máximo de comandos por segundo em cada conexão (0 = ilimitado)")
+	slowCommand := flag.Duration("slow-command", 0, "Loga em warn todo comando cuja resposta do TS demorar mais que isso, ex: 500ms (0 = desativado)")
+	shedLatency := flag.Duration("shed-latency", 0, "Com a média de resposta dos comandos de um destino acima disso, recusa parte das conexões novas para ele com server busy, mais quanto mais lento (0 = desativado)")
+	minCmdInterval := flag.Duration("min-cmd-interval", 0, "Intervalo mínimo entre comandos na mesma conexão (0 = desativado)")
+	replayFile := flag.String("replay", "", "Modo cliente: envia os comandos do arquivo para -target e mede a latência")
+	replayDelay := flag.Duration("replay-delay", 0, "Pausa entre comandos no modo -replay")
 	showVersion := flag.Bool("version", false, "Mostra versão e sai")
 
 	flag.Parse()
 
 	if *showVersion {
-		fmt.Println("BATQA Proxy v1.0.0")
+		fmt.Println("BATQA Proxy " + buildInfo().String())
 		fmt.Println("Proxy TCP para TeamSpeak/TeaSpeak ServerQuery")
 		os.Exit(0)
 	}
@@ -234,12 +2592,265 @@ func main() {
 	log.SetFlags(log.Ldate | log.Ltime | log.Lmicroseconds)
 	log.SetPrefix("[BATQA-Proxy] ")
 
+	if *configFile != "" {
+		if err := loadConfigFile(flag.CommandLine, *configFile); err != nil {
+			log.Fatalf("❌ Erro no arquivo de configuração: %v", err)
+		}
+	}
+
+	// Logger só depois do arquivo de configuração, que pode definir -log/-log-format
+	level, err := parseLogLevel(*logLevel)
+	if err != nil {
+		log.Fatalf("❌ -log: %v", err)
+	}
+	if *logFormat != logFormatText && *logFormat != logFormatJSON {
+		log.Fatalf("❌ -log-format inválido: %q (use %s ou %s)", *logFormat, logFormatText, logFormatJSON)
+	}
+	logger := newLogger(*logFormat, level)
+
+	targets, err := parseTargets(*targetAddr)
+	if err != nil {
+		logger.Fatalf("❌ -target: %v", err)
+	}
+	if !validBalance(*balance) {
+		logger.Fatalf("❌ -balance inválido: %q (use %s, %s, %s, %s ou %s)", *balance, balanceRoundRobin, balanceRandom, balanceLeastConn, balanceLatency, balanceSticky)
+	}
+	if *stickyStay && *balance != balanceSticky {
+		logger.Fatalf("❌ -sticky-stay requer -balance %s", balanceSticky)
+	}
+	if *balance == balanceLatency && *healthInterval <= 0 {
+		logger.Fatalf("❌ -balance %s requer -health-interval (a latência vem do health check)", balanceLatency)
+	}
+
+	allow, err := parseCIDRList(*allowList)
+	if err != nil {
+		logger.Fatalf("❌ -allow: %v", err)
+	}
+	deny, err := parseCIDRList(*denyList)
+	if err != nil {
+		logger.Fatalf("❌ -deny: %v", err)
+	}
+	traceConns, traceNets, err := parseTraceSpec(*traceSpec)
+	if err != nil {
+		logger.Fatalf("❌ -trace: %v", err)
+	}
+	clientTLSVersion, err := parseTLSVersion(*tlsMinVersion)
+	if err != nil {
+		logger.Fatalf("❌ -tls-min-version: %v", err)
+	}
+	clientCiphers, err := parseCipherSuites(*tlsCiphers)
+	if err != nil {
+		logger.Fatalf("❌ -tls-ciphers: %v", err)
+	}
+	targetTLSVersion, err := parseTLSVersion(*targetTLSMinVersion)
+	if err != nil {
+		logger.Fatalf("❌ -target-tls-min-version: %v", err)
+	}
+	targetCiphers, err := parseCipherSuites(*targetTLSCiphers)
+	if err != nil {
+		logger.Fatalf("❌ -target-tls-ciphers: %v", err)
+	}
+
+	// Modo replay não sobe o proxy
+	if *replayFile != "" {
+		if len(targets) > 1 || strings.HasPrefix(targets[0], srvScheme) {
+			logger.Fatalf("❌ -replay aceita um único -target, sem srv://")
+		}
+		os.Exit(runReplay(ReplayConfig{
+			File:       *replayFile,
+			TargetAddr: targets[0],
+			Timeout:    *timeout,
+			Delay:      *replayDelay,
+		}))
+	}
+
+	if *dialRetries < 0 {
+		logger.Fatalf("❌ -dial-retries inválido: %d", *dialRetries)
+	}
+	if *dialRetries > 0 && *dialRetryMax <= 0 {
+		logger.Fatalf("❌ -dial-retry-max precisa ser positivo com -dial-retries")
+	}
+	if *breakerThreshold > 0 && *breakerCooldown <= 0 {
+		logger.Fatalf("❌ -breaker-threshold requer -breaker-cooldown maior que zero")
+	}
+
+	if *rateLimit != 0 {
+		logger.Warnf("⚠️  -rate-limit é obsoleto: use -conn-rate (conexões por IP; o limite de comandos é o -cmd-rate)")
+	}
+	*connRate, err = resolveConnRate(*connRate, *rateLimit)
+	if err != nil {
+		logger.Fatalf("❌ %v", err)
+	}
+	if *rateWindow <= 0 {
+		logger.Fatalf("❌ -rate-window precisa ser positivo: %v", *rateWindow)
+	}
+	if *cacheErrorLine != cacheErrorVerbatim && *cacheErrorLine != cacheErrorRegenerate {
+		logger.Fatalf("❌ -cache-error-line inválido: %q (use %s ou %s)", *cacheErrorLine, cacheErrorVerbatim, cacheErrorRegenerate)
+	}
+	if *rateMode != rateModeDrop && *rateMode != rateModeDelay {
+		logger.Fatalf("❌ -rate-mode inválido: %q (use %s ou %s)", *rateMode, rateModeDrop, rateModeDelay)
+	}
+	if *rateMode == rateModeDelay && *rateMaxWait <= 0 {
+		logger.Fatalf("❌ -rate-mode %s requer -rate-max-wait maior que zero", rateModeDelay)
+	}
+
+	if *statsInterval < 0 {
+		logger.Fatalf("❌ -stats-interval negativo: %v", *statsInterval)
+	}
+	if *rateIPv4Prefix < 1 || *rateIPv4Prefix > 32 {
+		logger.Fatalf("❌ -rate-ipv4-prefix inválido: %d (use de 1 a 32)", *rateIPv4Prefix)
+	}
+	if *rateIPv6Prefix < 1 || *rateIPv6Prefix > 128 {
+		logger.Fatalf("❌ -rate-ipv6-prefix inválido: %d (use de 1 a 128)", *rateIPv6Prefix)
+	}
+	if *banThreshold < 0 {
+		logger.Fatalf("❌ -ban-threshold inválido: %d", *banThreshold)
+	}
+	if *banThreshold > 0 && (*banWindow <= 0 || *banDuration <= 0) {
+		logger.Fatalf("❌ -ban-window e -ban-duration precisam ser positivos com -ban-threshold")
+	}
+
+	if *listenV4Only && *listenV6Only {
+		logger.Fatalf("❌ -listen-v4-only e -listen-v6-only não podem ser usados juntos")
+	}
+	network, address := listenNetwork(*listenAddr, *listenV4Only, *listenV6Only)
+	if network == "unix" && (*listenV4Only || *listenV6Only) {
+		logger.Fatalf("❌ -listen-v4-only/-listen-v6-only não se aplicam a socket unix")
+	}
+	if err := checkListenAddr(network, address); err != nil {
+		logger.Fatalf("❌ -listen %s: %v", *listenAddr, err)
+	}
+
 	config := Config{
-		ListenAddr: *listenAddr,
-		TargetAddr: *targetAddr,
-		MaxConns:   *maxConns,
-		Timeout:    *timeout,
-		LogLevel:   *logLevel,
+		ListenAddr:        *listenAddr,
+		ListenV4Only:      *listenV4Only,
+		ListenV6Only:      *listenV6Only,
+		Targets:           targets,
+		Balance:           *balance,
+		StickyStay:        *stickyStay,
+		MaxConns:          *maxConns,
+		Timeout:           *timeout,
+		DialRetries:       *dialRetries,
+		DialRetryMax:      *dialRetryMax,
+		SRVRefresh:        *srvRefresh,
+		LogLevel:          *logLevel,
+		LogFormat:         *logFormat,
+		MinCmdInterval:    *minCmdInterval,
+		HighWaterPct:      *highWater,
+		JitterPct:         *jitterPct,
+		TraceIO:           *traceIO,
+		TraceIOMax:        *traceIOMax,
+		TraceConns:        traceConns,
+		TraceNets:         traceNets,
+		GlobalConnRate:    *globalConnRate,
+		MaxUpstreamConns:  *maxUpstreamConns,
+		MaxConnsPerIP:     *maxConnsPerIP,
+		RateIPv4Prefix:    *rateIPv4Prefix,
+		RateIPv6Prefix:    *rateIPv6Prefix,
+		BanThreshold:      *banThreshold,
+		BanWindow:         *banWindow,
+		BanDuration:       *banDuration,
+		StatsAddr:         *statsAddr,
+		AdminToken:        *adminToken,
+		DrainTimeout:      *drainTimeout,
+		CloseGrace:        *closeGrace,
+		HandoffTimeout:    *handoffTimeout,
+		IdleTimeout:       *idleTimeout,
+		MaxSession:        *maxSession,
+		ConnBandwidth:     int(connBandwidth),
+		KeepAlive:         *keepAlive,
+		TSKeepAlive:       *tsKeepAlive,
+		WriteTimeout:      *writeTimeout,
+		Echo:              *echo,
+		AutoUse:           *autoUse,
+		OriginCommand:     strings.TrimSpace(*originCommand),
+		StripBanner:       *stripBanner,
+		AllowCompression:  *allowCompression,
+		AllowLabels:       *allowLabels,
+		AuditLog:          *auditLog,
+		BufferSize:        int(bufferSize),
+		MaxCommandSize:    int(maxCommandSize),
+		MaxResponseSize:   int(maxResponseSize),
+		ResponseLimits:    respLimits,
+		TLSCert:           *tlsCert,
+		TLSKey:            *tlsKey,
+		SNIRoutes:         sniRouteMap,
+		TargetTLS:         *targetTLS,
+		TargetTLSInsecure: *targetTLSInsecure,
+		TLSMinVersion:     clientTLSVersion,
+		TLSCiphers:        clientCiphers,
+		TargetTLSMin:      targetTLSVersion,
+		TargetTLSCiphers:  targetCiphers,
+		ProxyProtocol:     *proxyProtocol,
+		PoolSize:          *poolSize,
+		PoolUser:          *poolUser,
+		PoolPass:          *poolPass,
+		RewriteLogin:      *rewriteLogin,
+		LoginUser:         *loginUser,
+		LoginPass:         *loginPass,
+		CacheTTL:          *cacheTTL,
+		CacheErrorLine:    *cacheErrorLine,
+		HealthInterval:    *healthInterval,
+		HealthProbe:       *healthProbe,
+		BreakerThreshold:  *breakerThreshold,
+		BreakerCooldown:   *breakerCooldown,
+		Allow:             allow,
+		AllowFile:         *allowFilePath,
+		Deny:              deny,
+		ConnRate:          *connRate,
+		RateWindow:        *rateWindow,
+		RateMode:          *rateMode,
+		RateMaxWait:       *rateMaxWait,
+		CmdRate:           *cmdRate,
+		SlowCommand:       *slowCommand,
+		ShedLatency:       *shedLatency,
+		StrictProtocol:    *strictProtocol,
+		AllowCommands:     splitList(*allowCommands),
+	}
+
+	if config.BufferSize < minBufferSize {
+		logger.Fatalf("❌ -buffer-size muito pequeno: %d (mínimo %d)", config.BufferSize, minBufferSize)
+	}
+
+	if config.TargetTLSInsecure && !config.TargetTLS {
+		logger.Fatalf("❌ -target-tls-insecure requer -target-tls")
+	}
+	if len(config.SNIRoutes) > 0 && config.TLSCert == "" {
+		logger.Fatalf("❌ -sni-route requer -tls-cert")
+	}
+	for name, addrs := range config.SNIRoutes {
+		for _, addr := range addrs {
+			if !slices.Contains(config.Targets, addr) {
+				logger.Fatalf("❌ -sni-route: destino %s de %s não está no -target", addr, name)
+			}
+		}
+	}
+	if (clientTLSVersion != tls.VersionTLS12 || len(clientCiphers) > 0) && config.TLSCert == "" {
+		logger.Fatalf("❌ -tls-min-version e -tls-ciphers requerem -tls-cert")
+	}
+	if (targetTLSVersion != tls.VersionTLS12 || len(targetCiphers) > 0) && !config.TargetTLS {
+		logger.Fatalf("❌ -target-tls-min-version e -target-tls-ciphers requerem -target-tls")
+	}
+	if config.TLSMinVersion == tls.VersionTLS13 && len(config.TLSCiphers) > 0 {
+		logger.Warnf("⚠️  -tls-ciphers ignorado: com -tls-min-version 1.3 as suítes são as do TLS 1.3")
+	}
+	if config.TargetTLSMin == tls.VersionTLS13 && len(config.TargetTLSCiphers) > 0 {
+		logger.Warnf("⚠️  -target-tls-ciphers ignorado: com -target-tls-min-version 1.3 as suítes são as do TLS 1.3")
+	}
+	if config.RewriteLogin && config.LoginUser == "" {
+		logger.Fatalf("❌ -rewrite-login requer -login-user")
+	}
+	if strings.ContainsAny(config.OriginCommand, "\r\n") {
+		logger.Fatalf("❌ -origin-command precisa ser um comando só, em uma linha")
+	}
+
+	if config.TraceIO && config.LogLevel != "debug" {
+		logger.Warnf("⚠️  -trace-io ignorado: requer -log debug")
+		config.TraceIO = false
+	}
+	if (config.TraceConns > 0 || len(config.TraceNets) > 0) && config.LogLevel != "debug" {
+		logger.Warnf("⚠️  -trace ignorado: requer -log debug")
+		config.TraceConns, config.TraceNets = 0, nil
 	}
 
 	proxy := NewProxy(config)
@@ -248,24 +2859,82 @@ func main() {
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
 
+	// SIGHUP relê o -config e aplica o que pode mudar sem reiniciar
+	hupChan := make(chan os.Signal, 1)
+	signal.Notify(hupChan, syscall.SIGHUP)
 	go func() {
-		<-sigChan
-		log.Println("\n⏹️  Recebido sinal de shutdown...")
-		proxy.PrintStats()
+		for range hupChan {
+			if proxy.audit != nil {
+				proxy.audit.reopen()
+			}
+			proxy.ReloadTLSCert()
+			if *configFile == "" {
+				if *auditLog == "" && config.TLSCert == "" {
+					logger.Warnf("⚠️  SIGHUP ignorado: proxy iniciado sem -config")
+				}
+				continue
+			}
+			logger.Infof("🔄 SIGHUP recebido, relendo %s", *configFile)
+			proxy.reloadConfigFile(*configFile)
+		}
+	}()
+
+	// SIGUSR1 passa o socket para uma cópia nova do binário e drena este
+	usr1Chan := make(chan os.Signal, 1)
+	signal.Notify(usr1Chan, syscall.SIGUSR1)
+	handedOff := make(chan struct{})
+	go func() {
+		for range usr1Chan {
+			pid, err := proxy.handoff()
+			if err != nil {
+				logger.Errorf("❌ %v, continuando neste processo", err)
+				continue
+			}
+			logger.Infof("🔁 Socket passado ao novo processo %d, drenando as conexões deste", pid)
+			close(handedOff)
+			return
+		}
+	}()
+
+	stopped := make(chan struct{})
+	go func() {
+		select {
+		case <-sigChan:
+			logger.Infof("\n⏹️  Recebido sinal de shutdown...")
+		case <-handedOff:
+		}
 		proxy.Stop()
-		os.Exit(0)
+		proxy.PrintStats()
+		close(stopped)
 	}()
 
-	// Imprime estatísticas periodicamente
+	// Imprime estatísticas periodicamente (com jitter) e, no SIGUSR2, na
+	// hora; a mesma goroutine faz as duas para as linhas não se misturarem
+	usr2Chan := make(chan os.Signal, 1)
+	signal.Notify(usr2Chan, syscall.SIGUSR2)
 	go func() {
-		ticker := time.NewTicker(5 * time.Minute)
-		for range ticker.C {
+		var tick <-chan time.Time
+		next := func() {
+			if *statsInterval > 0 {
+				tick = time.After(jitter(*statsInterval, config.JitterPct))
+			}
+		}
+		next()
+		for {
+			select {
+			case <-tick:
+				next()
+			case <-usr2Chan:
+			}
 			proxy.PrintStats()
 		}
 	}()
 
 	// Inicia proxy
 	if err := proxy.Start(); err != nil {
-		log.Fatalf("Erro fatal: %v", err)
+		logger.Fatalf("Erro fatal: %v", err)
 	}
+
+	// Start() retorna assim que o listener fecha; espera o drain terminar
+	<-stopped
 }
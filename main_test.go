@@ -0,0 +1,2399 @@
+// Testes de ponta a ponta: o proxy de verdade (NewProxy/Start) na frente
+// de um servidor ServerQuery falso, que manda o banner e responde
+// "error id=0 msg=ok" a cada comando.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+const fakeBanner = "TS3\n\rWelcome to the TeamSpeak 3 ServerQuery interface, type \"help\" for a list of commands.\n\r"
+
+// Servidor ServerQuery falso em uma porta livre de 127.0.0.1. Conta os
+// comandos recebidos em *commands. Fecha sozinho no fim do teste.
+func startFakeTS(t testing.TB) (addr string, commands *int64) {
+	t.Helper()
+	commands = new(int64)
+	addr = startFakeTSWith(t, func(conn net.Conn) { serveFakeTS(conn, commands) })
+	return addr, commands
+}
+
+// Como startFakeTS, mas cada conexão é atendida por serve
+func startFakeTSWith(t testing.TB, serve func(net.Conn)) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen do TS falso: %v", err)
+	}
+
+	var wg sync.WaitGroup
+	t.Cleanup(func() {
+		ln.Close()
+		wg.Wait()
+	})
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				defer conn.Close()
+				serve(conn)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func serveFakeTS(conn net.Conn, commands *int64) {
+	if _, err := io.WriteString(conn, fakeBanner); err != nil {
+		return
+	}
+	reader := bufio.NewReader(conn)
+	for {
+		line, err := readLine(reader)
+		if err != nil {
+			return
+		}
+		cmd := trimLine(string(line))
+		if cmd == "" {
+			continue
+		}
+		atomic.AddInt64(commands, 1)
+		if _, err := io.WriteString(conn, "error id=0 msg=ok\n\r"); err != nil || cmd == "quit" {
+			return
+		}
+	}
+}
+
+// Sobe o proxy com config (endereços e timeouts de teste preenchidos) e
+// devolve o endereço em que ele escuta. Stop() no fim do teste.
+func startProxy(t testing.TB, config Config) (*Proxy, string) {
+	t.Helper()
+	if config.ListenAddr == "" {
+		config.ListenAddr = "127.0.0.1:0"
+	}
+	if config.MaxConns == 0 {
+		config.MaxConns = 100
+	}
+	if config.Timeout == 0 {
+		config.Timeout = 5 * time.Second
+	}
+	if config.LogLevel == "" {
+		config.LogLevel = "error"
+	}
+
+	p := NewProxy(config)
+	started := make(chan error, 1)
+	go func() { started <- p.Start() }()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		p.mu.Lock()
+		ln := p.listener
+		p.mu.Unlock()
+		if ln != nil {
+			t.Cleanup(func() {
+				p.Stop()
+				if err := <-started; err != nil {
+					t.Errorf("Start(): %v", err)
+				}
+			})
+			return p, ln.Addr().String()
+		}
+		select {
+		case err := <-started:
+			t.Fatalf("Start() terminou antes de escutar: %v", err)
+		default:
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("proxy não começou a escutar")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// Cliente ServerQuery de teste
+type testClient struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func dialProxy(t testing.TB, addr string) *testClient {
+	t.Helper()
+	conn, err := net.DialTimeout("tcp", addr, 5*time.Second)
+	if err != nil {
+		t.Fatalf("dial no proxy: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	return &testClient{conn: conn, reader: bufio.NewReader(conn)}
+}
+
+// Lê o banner; falha o teste se vier outra coisa
+func (c *testClient) banner(t *testing.T) {
+	t.Helper()
+	banner, err := readBanner(c.reader)
+	if err != nil {
+		t.Fatalf("banner: %v", err)
+	}
+	if string(banner) != fakeBanner {
+		t.Fatalf("banner = %q, esperado %q", banner, fakeBanner)
+	}
+}
+
+// Manda um comando e devolve a resposta, até a linha "error id="
+func (c *testClient) command(cmd string) ([]string, error) {
+	if _, err := io.WriteString(c.conn, cmd+"\n"); err != nil {
+		return nil, err
+	}
+	return c.response()
+}
+
+// Lê uma resposta, até a linha "error id="
+func (c *testClient) response() ([]string, error) {
+	return readResponse(c.reader)
+}
+
+// Primeira linha que o proxy manda (o erro de uma conexão recusada)
+func (c *testClient) firstLine(t *testing.T) string {
+	t.Helper()
+	line, err := readLine(c.reader)
+	if err != nil {
+		t.Fatalf("leitura: %v", err)
+	}
+	return trimLine(string(line))
+}
+
+func TestRoundTrip(t *testing.T) {
+	tsAddr, commands := startFakeTS(t)
+	p, addr := startProxy(t, Config{Targets: []string{tsAddr}})
+
+	c := dialProxy(t, addr)
+	c.banner(t)
+	response, err := c.command("version")
+	if err != nil {
+		t.Fatalf("version: %v", err)
+	}
+	if len(response) != 1 || response[0] != "error id=0 msg=ok" {
+		t.Fatalf("resposta = %q", response)
+	}
+
+	if got := atomic.LoadInt64(commands); got != 1 {
+		t.Errorf("TS recebeu %d comandos, esperado 1", got)
+	}
+	eventually(t, "TotalCommands = 1", func() bool {
+		return p.Snapshot().TotalCommands == 1
+	})
+}
+
+func TestConcurrentConnections(t *testing.T) {
+	const clients, perClient = 20, 10
+	tsAddr, commands := startFakeTS(t)
+	p, addr := startProxy(t, Config{Targets: []string{tsAddr}})
+
+	var wg sync.WaitGroup
+	errs := make(chan error, clients)
+	for i := 0; i < clients; i++ {
+		c := dialProxy(t, addr)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := readBanner(c.reader); err != nil {
+				errs <- err
+				return
+			}
+			for j := 0; j < perClient; j++ {
+				response, err := c.command("clientlist")
+				if err != nil {
+					errs <- err
+					return
+				}
+				if last := response[len(response)-1]; last != "error id=0 msg=ok" {
+					errs <- errors.New("resposta inesperada: " + last)
+					return
+				}
+			}
+			c.conn.Close()
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	if got := atomic.LoadInt64(commands); got != clients*perClient {
+		t.Errorf("TS recebeu %d comandos, esperado %d", got, clients*perClient)
+	}
+	eventually(t, "todas as conexões encerradas", func() bool {
+		s := p.Snapshot()
+		return s.ActiveConnections == 0 && s.TotalConnections == clients && s.TotalCommands == clients*perClient
+	})
+}
+
+func TestRateLimitRejection(t *testing.T) {
+	tsAddr, _ := startFakeTS(t)
+	p, addr := startProxy(t, Config{Targets: []string{tsAddr}, ConnRate: 2})
+
+	// Rajada de 2 passa; a 3ª no mesmo segundo é recusada
+	for i := 0; i < 2; i++ {
+		dialProxy(t, addr).banner(t)
+	}
+	c := dialProxy(t, addr)
+	if line := c.firstLine(t); line != `error id=524 msg=connection\srate\slimit\sexceeded` {
+		t.Fatalf("3ª conexão recebeu %q", line)
+	}
+	if _, err := c.reader.ReadByte(); err != io.EOF {
+		t.Errorf("conexão recusada não foi fechada: %v", err)
+	}
+	if got := p.Snapshot().RejectedRateLimit; got != 1 {
+		t.Errorf("RejectedRateLimit = %d, esperado 1", got)
+	}
+}
+
+// -rate-limit continua valendo como nome antigo do -conn-rate
+func TestResolveConnRate(t *testing.T) {
+	for _, tc := range []struct {
+		connRate, rateLimit, want int
+		wantErr                   bool
+	}{
+		{connRate: 0, rateLimit: 0, want: 0},
+		{connRate: 5, rateLimit: 0, want: 5},
+		{connRate: 0, rateLimit: 3, want: 3},
+		{connRate: 4, rateLimit: 4, want: 4},
+		{connRate: 5, rateLimit: 3, wantErr: true},
+	} {
+		got, err := resolveConnRate(tc.connRate, tc.rateLimit)
+		if (err != nil) != tc.wantErr || got != tc.want {
+			t.Errorf("resolveConnRate(%d, %d) = %d, %v", tc.connRate, tc.rateLimit, got, err)
+		}
+	}
+}
+
+func TestMaxConnsRejection(t *testing.T) {
+	tsAddr, _ := startFakeTS(t)
+	p, addr := startProxy(t, Config{Targets: []string{tsAddr}, MaxConns: 1})
+
+	first := dialProxy(t, addr)
+	first.banner(t) // já está no handleConnection, contando como ativa
+
+	c := dialProxy(t, addr)
+	if line := c.firstLine(t); line != `error id=1 msg=too\smany\sconnections` {
+		t.Fatalf("2ª conexão recebeu %q", line)
+	}
+	if got := p.Snapshot().RejectedMaxConns; got != 1 {
+		t.Errorf("RejectedMaxConns = %d, esperado 1", got)
+	}
+
+	// A vaga volta quando a primeira sai
+	first.conn.Close()
+	eventually(t, "vaga liberada", func() bool {
+		return p.Snapshot().ActiveConnections == 0
+	})
+	dialProxy(t, addr).banner(t)
+}
+
+func TestStopClosesConnections(t *testing.T) {
+	tsAddr, _ := startFakeTS(t)
+	p, addr := startProxy(t, Config{Targets: []string{tsAddr}})
+
+	c := dialProxy(t, addr)
+	c.banner(t)
+	if _, err := c.command("version"); err != nil {
+		t.Fatalf("version: %v", err)
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		p.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Stop() não terminou")
+	}
+
+	// Conexão ociosa fechada pelo drain, sem nada a mais
+	if _, err := c.reader.ReadByte(); err != io.EOF && !isConnReset(err) {
+		t.Errorf("leitura depois do Stop(): %v, esperado EOF", err)
+	}
+	if s := p.Snapshot(); s.ActiveConnections != 0 {
+		t.Errorf("ActiveConnections = %d depois do Stop()", s.ActiveConnections)
+	}
+
+	// E ninguém mais entra
+	if conn, err := net.DialTimeout("tcp", addr, time.Second); err == nil {
+		conn.Close()
+		t.Error("proxy ainda aceita conexões depois do Stop()")
+	}
+}
+
+func TestStopBeforeAndDuringStart(t *testing.T) {
+	// Porta livre, para conferir que ela é devolvida
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	config := Config{ListenAddr: addr, Targets: []string{"127.0.0.1:1"}, MaxConns: 10, LogLevel: "error"}
+
+	startReturns := func(p *Proxy, started chan error) {
+		t.Helper()
+		select {
+		case err := <-started:
+			if err != nil {
+				t.Fatalf("Start(): %v", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Start() não voltou depois do Stop()")
+		}
+		ln, err := net.Listen("tcp", addr)
+		if err != nil {
+			t.Fatalf("porta presa depois do Stop(): %v", err)
+		}
+		ln.Close()
+	}
+
+	// Stop() logo depois do NewProxy: o Start() seguinte volta sem escutar
+	p := NewProxy(config)
+	p.Stop()
+	started := make(chan error, 1)
+	go func() { started <- p.Start() }()
+	startReturns(p, started)
+
+	// Stop() concorrente com o Start(), em qualquer ponto dele
+	for i := 0; i < 50; i++ {
+		p := NewProxy(config)
+		started := make(chan error, 1)
+		go func() { started <- p.Start() }()
+		if i%2 == 0 {
+			time.Sleep(time.Duration(i) * 20 * time.Microsecond)
+		}
+		p.Stop()
+		p.Stop() // mais de uma vez também pode
+		startReturns(p, started)
+	}
+}
+
+func TestUpstreamClosedBeforeBanner(t *testing.T) {
+	// TS que aceita o TCP e fecha sem mandar nada (limite ou ban do lado dele)
+	tsAddr := startFakeTSWith(t, func(conn net.Conn) {})
+	p, addr := startProxy(t, Config{Targets: []string{tsAddr}})
+
+	c := dialProxy(t, addr)
+	if line := c.firstLine(t); line != `error id=1 msg=server\sclosed\sconnection\sbefore\sbanner` {
+		t.Errorf("cliente recebeu %q", line)
+	}
+	if got := atomic.LoadUint64(&p.stats.UpstreamClosedEarly); got != 1 {
+		t.Errorf("UpstreamClosedEarly = %d, esperado 1", got)
+	}
+}
+
+// Espera cond ficar verdadeira (contadores atualizados por outra goroutine)
+func eventually(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("tempo esgotado esperando: %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// Saída do pacote log, capturada durante o teste
+type logCapture struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (l *logCapture) Write(b []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.buf.Write(b)
+}
+
+func (l *logCapture) String() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.buf.String()
+}
+
+func captureLog(t *testing.T) *logCapture {
+	out := &logCapture{}
+	log.SetOutput(out)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	return out
+}
+
+// Mensagens do -trace-io no log, na ordem
+func tracedLines(out string) []string {
+	var traced []string
+	for _, line := range strings.Split(out, "\n") {
+		if _, msg, ok := strings.Cut(line, "🔎 "); ok {
+			traced = append(traced, msg)
+		}
+	}
+	return traced
+}
+
+func TestTraceIO(t *testing.T) {
+	tsAddr, _ := startFakeTS(t)
+	logs := captureLog(t)
+	_, addr := startProxy(t, Config{Targets: []string{tsAddr}, TraceIO: true, LogLevel: "debug"})
+
+	c := dialProxy(t, addr)
+	c.banner(t)
+	for _, cmd := range []string{"login serveradmin s3cr3t", "login client_login_name=bot client_login_password=0utr4", "version"} {
+		if _, err := c.command(cmd); err != nil {
+			t.Fatalf("%s: %v", cmd, err)
+		}
+	}
+	c.conn.Close()
+
+	var traced []string
+	eventually(t, "rastreio da resposta do version", func() bool {
+		out := logs.String()
+		if strings.Contains(out, "s3cr3t") || strings.Contains(out, "0utr4") {
+			t.Fatalf("senha no log:\n%s", out)
+		}
+		traced = tracedLines(out)
+		return len(traced) == 8
+	})
+	want := []string{
+		`#1 T->C TS3\n\r`,
+		`#1 T->C Welcome to the TeamSpeak 3 ServerQuery interface, type "help" for a list of commands.\n\r`,
+		`#1 C->T login serveradmin ***\n`,
+		`#1 T->C error id=0 msg=ok\n\r`,
+		`#1 C->T login client_login_name=bot ***\n`,
+		`#1 T->C error id=0 msg=ok\n\r`,
+		`#1 C->T version\n`,
+		`#1 T->C error id=0 msg=ok\n\r`,
+	}
+	for i := range want {
+		if traced[i] != want[i] {
+			t.Errorf("linha %d do rastreio = %q, esperado %q", i+1, traced[i], want[i])
+		}
+	}
+}
+
+func TestTraceIOTruncate(t *testing.T) {
+	tsAddr, _ := startFakeTS(t)
+	logs := captureLog(t)
+	_, addr := startProxy(t, Config{Targets: []string{tsAddr}, TraceIO: true, TraceIOMax: 4, LogLevel: "debug"})
+
+	c := dialProxy(t, addr)
+	c.banner(t)
+	if _, err := c.command("serverinfo"); err != nil {
+		t.Fatalf("serverinfo: %v", err)
+	}
+
+	eventually(t, "rastreio do serverinfo", func() bool {
+		for _, line := range tracedLines(logs.String()) {
+			if line == "#1 C->T serv... (+7 bytes)" {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+func TestGlobalConnRate(t *testing.T) {
+	tsAddr, _ := startFakeTS(t)
+	// Cada IP pode 2 por segundo, mas o proxy todo só 3
+	p, addr := startProxy(t, Config{Targets: []string{tsAddr}, ConnRate: 2, GlobalConnRate: 3})
+
+	// Cinco origens diferentes (127.0.0.1 a 127.0.0.5), uma conexão cada
+	var lines []string
+	for i := 1; i <= 5; i++ {
+		dialer := net.Dialer{LocalAddr: &net.TCPAddr{IP: net.IPv4(127, 0, 0, byte(i))}, Timeout: 5 * time.Second}
+		conn, err := dialer.Dial("tcp", addr)
+		if err != nil {
+			t.Fatalf("dial de 127.0.0.%d: %v", i, err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		line, err := readLine(bufio.NewReader(conn))
+		if err != nil {
+			t.Fatalf("leitura de 127.0.0.%d: %v", i, err)
+		}
+		lines = append(lines, trimLine(string(line)))
+	}
+
+	for i, line := range lines {
+		want := "TS3"
+		if i >= 3 {
+			want = `error id=524 msg=server\sbusy,\stry\sagain\slater`
+		}
+		if line != want {
+			t.Errorf("conexão %d recebeu %q, esperado %q", i+1, line, want)
+		}
+	}
+	s := p.Snapshot()
+	if s.RejectedGlobalRate != 2 || s.RejectedRateLimit != 0 {
+		t.Errorf("RejectedGlobalRate = %d, RejectedRateLimit = %d, esperado 2 e 0", s.RejectedGlobalRate, s.RejectedRateLimit)
+	}
+}
+
+func TestGlobalRejectRefundsIPToken(t *testing.T) {
+	tsAddr, _ := startFakeTS(t)
+	// O IP pode 2 por segundo, o proxy todo só 1: a segunda e a terceira
+	// caem no limite global, e o token por IP delas tem que voltar
+	p, addr := startProxy(t, Config{Targets: []string{tsAddr}, ConnRate: 2, GlobalConnRate: 1})
+
+	c := dialProxy(t, addr)
+	c.banner(t)
+	for i := 2; i <= 3; i++ {
+		c := dialProxy(t, addr)
+		if line := c.firstLine(t); line != `error id=524 msg=server\sbusy,\stry\sagain\slater` {
+			t.Errorf("conexão %d recebeu %q", i, line)
+		}
+	}
+	s := p.Snapshot()
+	if s.RejectedGlobalRate != 2 || s.RejectedRateLimit != 0 {
+		t.Errorf("RejectedGlobalRate = %d, RejectedRateLimit = %d, esperado 2 e 0", s.RejectedGlobalRate, s.RejectedRateLimit)
+	}
+}
+
+func TestConcatenatedCommands(t *testing.T) {
+	// TS que guarda os comandos que recebe, para ver o que o proxy manda
+	var mu sync.Mutex
+	var received []string
+	tsAddr := startFakeTSWith(t, func(conn net.Conn) {
+		io.WriteString(conn, fakeBanner)
+		reader := bufio.NewReader(conn)
+		for {
+			line, err := readLine(reader)
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			received = append(received, trimLine(string(line)))
+			mu.Unlock()
+			io.WriteString(conn, "error id=0 msg=ok\n\r")
+		}
+	})
+	p, addr := startProxy(t, Config{Targets: []string{tsAddr}})
+
+	c := dialProxy(t, addr)
+	c.banner(t)
+	// Três comandos num Write só, com o "\n\r" do ServerQuery entre eles
+	// (e um terminador sobrando no fim)
+	if _, err := io.WriteString(c.conn, "whoami\n\rversion\n\rclientlist\n\r\n"); err != nil {
+		t.Fatalf("escrita: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		lines, err := c.response()
+		if err != nil || len(lines) != 1 || lines[0] != "error id=0 msg=ok" {
+			t.Fatalf("resposta %d = %q, %v", i+1, lines, err)
+		}
+	}
+
+	mu.Lock()
+	got := strings.Join(received, ",")
+	mu.Unlock()
+	if want := "whoami,version,clientlist"; got != want {
+		t.Errorf("TS recebeu %q, esperado %q", got, want)
+	}
+	s := p.Snapshot()
+	if s.TotalCommands != 3 {
+		t.Errorf("TotalCommands = %d, esperado 3", s.TotalCommands)
+	}
+	// Cada comando casou com a própria resposta (tempo por comando)
+	for _, verb := range []string{"whoami", "version", "clientlist"} {
+		if n := s.Commands[verb].Count; n != 1 {
+			t.Errorf("Commands[%s].Count = %d, esperado 1", verb, n)
+		}
+	}
+}
+
+func TestMaxUpstreamConns(t *testing.T) {
+	tsAddr, _ := startFakeTS(t)
+	// MaxConns folgado: quem recusa é o limite de conexões com o TS
+	p, addr := startProxy(t, Config{Targets: []string{tsAddr}, MaxConns: 100, MaxUpstreamConns: 2})
+
+	for i := 0; i < 2; i++ {
+		c := dialProxy(t, addr)
+		c.banner(t)
+	}
+	if got := p.Snapshot().UpstreamConnections; got != 2 {
+		t.Errorf("UpstreamConnections = %d, esperado 2", got)
+	}
+
+	c := dialProxy(t, addr)
+	if line := c.firstLine(t); line != `error id=1 msg=too\smany\sconnections` {
+		t.Errorf("terceira conexão recebeu %q", line)
+	}
+	if got := p.Snapshot().RejectedUpstreamCap; got != 1 {
+		t.Errorf("RejectedUpstreamCap = %d, esperado 1", got)
+	}
+}
+
+// TS falso com senha: "login <usuário> certa" entra, qualquer outra senha é
+// recusada, e o clientlist mostra quem está logado na sessão
+func serveLoginTS(conn net.Conn) {
+	io.WriteString(conn, fakeBanner)
+	reader := bufio.NewReader(conn)
+	user := "guest"
+	for {
+		line, err := readLine(reader)
+		if err != nil {
+			return
+		}
+		fields := strings.Fields(trimLine(string(line)))
+		if len(fields) == 0 {
+			continue
+		}
+		switch {
+		case fields[0] == "login" && len(fields) == 3 && fields[2] == "certa":
+			user = fields[1]
+		case fields[0] == "login":
+			io.WriteString(conn, "error id=520 msg=invalid\\sloginname\\sor\\spassword\n\r")
+			continue
+		case fields[0] == "clientlist":
+			io.WriteString(conn, "clid=1 client_nickname="+user+"\n\r")
+		}
+		io.WriteString(conn, "error id=0 msg=ok\n\r")
+	}
+}
+
+func TestCacheFailedLogin(t *testing.T) {
+	tsAddr := startFakeTSWith(t, serveLoginTS)
+	p, addr := startProxy(t, Config{Targets: []string{tsAddr}, CacheTTL: time.Minute})
+
+	clientlist := func(c *testClient) string {
+		t.Helper()
+		lines, err := c.command("clientlist")
+		if err != nil || len(lines) != 2 {
+			t.Fatalf("clientlist = %q, %v", lines, err)
+		}
+		return lines[0]
+	}
+
+	// Sessão serveradmin de verdade: a resposta vai para o cache
+	admin := dialProxy(t, addr)
+	admin.banner(t)
+	if lines, err := admin.command("login serveradmin certa"); err != nil || lines[0] != "error id=0 msg=ok" {
+		t.Fatalf("login = %q, %v", lines, err)
+	}
+	if got := clientlist(admin); got != "clid=1 client_nickname=serveradmin" {
+		t.Fatalf("clientlist do admin = %q", got)
+	}
+
+	// Login recusado pelo TS: o clientlist seguinte não pode sair do cache
+	// do serveradmin
+	c := dialProxy(t, addr)
+	c.banner(t)
+	if lines, err := c.command("login serveradmin errada"); err != nil || !strings.HasPrefix(lines[0], "error id=520 ") {
+		t.Fatalf("login = %q, %v", lines, err)
+	}
+	if got := clientlist(c); got != "clid=1 client_nickname=guest" {
+		t.Errorf("clientlist depois do login recusado = %q", got)
+	}
+
+	// Login e clientlist juntos, antes da resposta do login: vai para o TS
+	// e não entra no cache
+	c = dialProxy(t, addr)
+	c.banner(t)
+	if _, err := io.WriteString(c.conn, "login serveradmin errada\nclientlist\n"); err != nil {
+		t.Fatalf("escrita: %v", err)
+	}
+	if lines, err := c.response(); err != nil || !strings.HasPrefix(lines[0], "error id=520 ") {
+		t.Fatalf("login = %q, %v", lines, err)
+	}
+	if lines, err := c.response(); err != nil || lines[0] != "clid=1 client_nickname=guest" {
+		t.Errorf("clientlist junto do login recusado = %q, %v", lines, err)
+	}
+
+	// O cache continua servindo quem entrou de verdade
+	if got := clientlist(admin); got != "clid=1 client_nickname=serveradmin" {
+		t.Errorf("segundo clientlist do admin = %q", got)
+	}
+	if got := atomic.LoadUint64(&p.stats.CacheHits); got != 1 {
+		t.Errorf("CacheHits = %d, esperado 1", got)
+	}
+}
+
+func TestCacheErrorLine(t *testing.T) {
+	// TS que manda um campo a mais na linha de erro
+	tsAddr := startFakeTSWith(t, func(conn net.Conn) {
+		io.WriteString(conn, fakeBanner)
+		reader := bufio.NewReader(conn)
+		for {
+			if _, err := readLine(reader); err != nil {
+				return
+			}
+			io.WriteString(conn, "clid=1 client_nickname=bot\n\r")
+			io.WriteString(conn, "error id=0 msg=ok extra_msg=do\\sTS\n\r")
+		}
+	})
+
+	for mode, want := range map[string]string{
+		cacheErrorVerbatim:   `error id=0 msg=ok extra_msg=do\sTS`,
+		cacheErrorRegenerate: "error id=0 msg=ok",
+	} {
+		p, addr := startProxy(t, Config{Targets: []string{tsAddr}, CacheTTL: time.Minute, CacheErrorLine: mode})
+		c := dialProxy(t, addr)
+		c.banner(t)
+		for i := 0; i < 2; i++ {
+			lines, err := c.command("clientlist")
+			if err != nil || len(lines) != 2 || lines[0] != "clid=1 client_nickname=bot" {
+				t.Fatalf("%s: clientlist #%d = %q, %v", mode, i+1, lines, err)
+			}
+			// A primeira vem do TS como está; só a do cache muda
+			if i == 1 && lines[1] != want {
+				t.Errorf("%s: linha de erro do cache = %q, esperado %q", mode, lines[1], want)
+			}
+		}
+		if got := p.Snapshot().CacheHits; got != 1 {
+			t.Errorf("%s: CacheHits = %d, esperado 1", mode, got)
+		}
+	}
+}
+
+func TestNoGoroutineLeak(t *testing.T) {
+	tsAddr, _ := startFakeTS(t)
+	_, addr := startProxy(t, Config{Targets: []string{tsAddr}})
+
+	// Uma conexão antes da medida, para goroutines de inicialização única
+	c := dialProxy(t, addr)
+	c.banner(t)
+	c.conn.Close()
+	time.Sleep(50 * time.Millisecond)
+	baseline := runtime.NumGoroutine()
+
+	// 10 mil conexões, metade saindo com quit (o TS fecha primeiro) e
+	// metade fechando do lado do cliente; com -short, só 200
+	n := 10000
+	if testing.Short() {
+		n = 200
+	}
+	for i := 0; i < n; i++ {
+		c := dialProxy(t, addr)
+		c.banner(t)
+		if _, err := c.command("version"); err != nil {
+			t.Fatalf("version: %v", err)
+		}
+		if i%2 == 0 {
+			c.command("quit")
+		}
+		c.conn.Close()
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > baseline {
+		if time.Now().After(deadline) {
+			buf := make([]byte, 1<<20)
+			t.Fatalf("%d goroutines, esperado até %d:\n%s", runtime.NumGoroutine(), baseline, buf[:runtime.Stack(buf, true)])
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestTSEscape(t *testing.T) {
+	for _, tc := range []struct{ raw, escaped string }{
+		{"", ""},
+		{"sem escape", `sem\sescape`},
+		{"a|b", `a\pb`},
+		{"http://x/y", `http:\/\/x\/y`},
+		{`C:\dir`, `C:\\dir`},
+		{"linha1\nlinha2", `linha1\nlinha2`},
+		{"fim\r\n", `fim\r\n`},
+		{"col\tcol", `col\tcol`},
+		{"Bot de M| \\", `Bot\sde\sM\p\s\\`},
+	} {
+		if got := tsEscape(tc.raw); got != tc.escaped {
+			t.Errorf("tsEscape(%q) = %q, esperado %q", tc.raw, got, tc.escaped)
+		}
+		got, err := tsUnescape(tc.escaped)
+		if err != nil || got != tc.raw {
+			t.Errorf("tsUnescape(%q) = %q, %v, esperado %q", tc.escaped, got, err, tc.raw)
+		}
+	}
+
+	// Barra invertida sozinha no fim, ou seguida do que não é escape
+	for _, bad := range []string{`fim\`, `\`, `a\qb`} {
+		if got, err := tsUnescape(bad); !errors.Is(err, ErrMalformedCommand) {
+			t.Errorf("tsUnescape(%q) = %q, %v, esperado ErrMalformedCommand", bad, got, err)
+		}
+	}
+}
+
+func TestWriteJSONErrorLogged(t *testing.T) {
+	var logs bytes.Buffer
+	p := NewProxy(Config{Targets: []string{"127.0.0.1:1"}, LogLevel: "error", LogFormat: logFormatJSON})
+	p.log.out = &logs
+
+	// Canal não serializa: o erro vai para o logger do proxy
+	p.writeJSON(httptest.NewRecorder(), make(chan int))
+
+	var entry struct{ Level, Msg string }
+	if err := json.Unmarshal(logs.Bytes(), &entry); err != nil {
+		t.Fatalf("log não é JSON: %v\n%s", err, logs.String())
+	}
+	if entry.Level != "error" || !strings.HasPrefix(entry.Msg, "Erro ao serializar JSON: ") {
+		t.Errorf("log = %+v", entry)
+	}
+}
+
+func isConnReset(err error) bool {
+	return errors.Is(err, syscall.ECONNRESET)
+}
+
+func TestStopWithPendingProxyHeader(t *testing.T) {
+	tsAddr, _ := startFakeTS(t)
+	// -timeout longo: o Stop() não pode esperar por ele
+	p, addr := startProxy(t, Config{Targets: []string{tsAddr}, ProxyProtocol: true, Timeout: time.Minute})
+
+	// Cliente que conecta e nunca manda o cabeçalho PROXY
+	c := dialProxy(t, addr)
+	time.Sleep(50 * time.Millisecond)
+
+	stopped := make(chan struct{})
+	go func() {
+		p.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Stop() esperando o cabeçalho PROXY")
+	}
+
+	// Quando o Stop() volta, a conexão já foi fechada
+	c.conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := c.reader.ReadByte(); err != io.EOF && !isConnReset(err) {
+		t.Errorf("leitura depois do Stop() = %v, esperado EOF", err)
+	}
+}
+
+func BenchmarkForward(b *testing.B) {
+	tsAddr, _ := startFakeTS(b)
+	_, addr := startProxy(b, Config{Targets: []string{tsAddr}})
+	c := dialProxy(b, addr)
+	c.conn.SetDeadline(time.Time{})
+	if _, err := readBanner(c.reader); err != nil {
+		b.Fatalf("banner: %v", err)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := c.command("version"); err != nil {
+			b.Fatalf("version: %v", err)
+		}
+	}
+}
+
+func TestLargeResponseLine(t *testing.T) {
+	// Linha de 1MB com conteúdo que muda a cada byte: um pedaço fora do
+	// lugar ou repetido não passa na comparação
+	big := make([]byte, 1<<20)
+	for i := range big {
+		big[i] = 'a' + byte(i%26)
+	}
+	for i := 4096; i < len(big); i += 4099 {
+		big[i] = '|'
+	}
+	tsAddr := startFakeTSWith(t, func(conn net.Conn) {
+		io.WriteString(conn, fakeBanner)
+		reader := bufio.NewReader(conn)
+		for {
+			if _, err := readLine(reader); err != nil {
+				return
+			}
+			conn.Write(append(big, "\n\r"...))
+			io.WriteString(conn, "error id=0 msg=ok\n\r")
+		}
+	})
+
+	// Acima do -buffer-size, abaixo do -max-response-size: passa inteira
+	_, addr := startProxy(t, Config{Targets: []string{tsAddr}, BufferSize: 4096, MaxResponseSize: 2 << 20})
+	c := dialProxy(t, addr)
+	c.banner(t)
+	lines, err := c.command("clientlist")
+	if err != nil {
+		t.Fatalf("clientlist: %v", err)
+	}
+	if len(lines) != 2 || lines[0] != string(big) || lines[1] != "error id=0 msg=ok" {
+		t.Fatalf("resposta de 1MB chegou diferente (%d linhas)", len(lines))
+	}
+
+	// Acima do -max-response-size: o cliente recebe o motivo e a conexão cai
+	p, addr := startProxy(t, Config{Targets: []string{tsAddr}, BufferSize: 4096, MaxResponseSize: 512 << 10})
+	c = dialProxy(t, addr)
+	c.banner(t)
+	lines, _ = c.command("clientlist")
+	if len(lines) != 1 || lines[0] != `error id=1 msg=response\stoo\slarge` {
+		t.Fatalf("resposta acima do limite recebeu %q", lines)
+	}
+	if got := p.Snapshot().OversizedLines; got != 1 {
+		t.Errorf("OversizedLines = %d, esperado 1", got)
+	}
+}
+
+func TestResponseLimit(t *testing.T) {
+	row := strings.Repeat("x", 1000)
+	tsAddr := startFakeTSWith(t, func(conn net.Conn) {
+		io.WriteString(conn, fakeBanner)
+		reader := bufio.NewReader(conn)
+		for {
+			line, err := readLine(reader)
+			if err != nil {
+				return
+			}
+			if commandVerb(line) == "clientdblist" {
+				for i := 0; i < 3; i++ {
+					io.WriteString(conn, row+"\n\r")
+				}
+			} else {
+				io.WriteString(conn, "version=3.13.7\n\r")
+			}
+			io.WriteString(conn, "error id=0 msg=ok\n\r")
+		}
+	})
+
+	p, addr := startProxy(t, Config{Targets: []string{tsAddr}, ResponseLimits: map[string]int{"clientdblist": 1500}})
+	c := dialProxy(t, addr)
+	c.banner(t)
+
+	// A primeira linha cabe; a partir da segunda o resto é descartado
+	lines, err := c.command("clientdblist")
+	if err != nil {
+		t.Fatalf("clientdblist: %v", err)
+	}
+	if len(lines) != 2 || lines[0] != row || lines[1] != `error id=1 msg=response\stoo\slarge` {
+		t.Fatalf("resposta cortada = %d linhas, última %q", len(lines), lines[len(lines)-1])
+	}
+
+	// Verbo sem limite, na mesma conexão: as respostas seguem alinhadas
+	lines, err = c.command("version")
+	if err != nil || len(lines) != 2 || lines[1] != "error id=0 msg=ok" {
+		t.Fatalf("version depois do corte: %q, %v", lines, err)
+	}
+
+	snap := p.Snapshot()
+	if snap.TruncatedResponses != 1 {
+		t.Errorf("TruncatedResponses = %d, esperado 1", snap.TruncatedResponses)
+	}
+	// O tamanho medido é o que o TS mandou, não o que chegou ao cliente
+	if got := snap.Commands["clientdblist"].MaxBytes; got < 3000 {
+		t.Errorf("MaxBytes do clientdblist = %d, esperado o tamanho inteiro", got)
+	}
+
+	rec := httptest.NewRecorder()
+	p.handleMetrics(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if body := rec.Body.String(); !strings.Contains(body, `batqa_response_size_bytes_bucket{target="`+tsAddr+`",le="4096"} 2`) {
+		t.Errorf("histograma de tamanho ausente em /metrics:\n%s", body)
+	}
+}
+
+func TestRejectDoesNotStallAccept(t *testing.T) {
+	// Certificado autoassinado do httptest em arquivos, para o -tls-cert
+	certSrv := httptest.NewUnstartedServer(nil)
+	certSrv.StartTLS()
+	key, err := x509.MarshalPKCS8PrivateKey(certSrv.TLS.Certificates[0].PrivateKey)
+	if err != nil {
+		t.Fatalf("chave: %v", err)
+	}
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certSrv.Certificate().Raw}), 0o600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key}), 0o600)
+	certSrv.Close()
+
+	tsAddr, _ := startFakeTS(t)
+	_, addr := startProxy(t, Config{Targets: []string{tsAddr}, MaxConns: 1, TLSCert: certFile, TLSKey: keyFile})
+	clientTLS := &tls.Config{InsecureSkipVerify: true}
+
+	holder, err := tls.Dial("tcp", addr, clientTLS)
+	if err != nil {
+		t.Fatalf("dial TLS: %v", err)
+	}
+	defer holder.Close()
+	if _, err := readBanner(bufio.NewReader(holder)); err != nil {
+		t.Fatalf("banner: %v", err)
+	}
+
+	// Recusados que nunca fazem o handshake: cada um segurava o accept
+	// loop pelo rejectWriteTimeout inteiro
+	for i := 0; i < 20; i++ {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatalf("dial: %v", err)
+		}
+		defer conn.Close()
+	}
+
+	start := time.Now()
+	conn, err := tls.Dial("tcp", addr, clientTLS)
+	if err != nil {
+		t.Fatalf("dial TLS: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	line, err := readLine(bufio.NewReader(conn))
+	if err != nil || !strings.HasSuffix(trimLine(string(line)), `msg=too\smany\sconnections`) {
+		t.Fatalf("recusa = %q, %v", line, err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("recusa levou %v atrás dos handshakes parados", elapsed)
+	}
+}
+
+// Certificado autoassinado novo (chave ECDSA) em certFile/keyFile; devolve
+// o DER, para comparar com o que o cliente recebe
+func writeTestCert(t *testing.T, certFile, keyFile string) []byte {
+	t.Helper()
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("chave: %v", err)
+	}
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "batqa-proxy"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{"localhost"},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &priv.PublicKey, priv)
+	if err != nil {
+		t.Fatalf("certificado: %v", err)
+	}
+	key, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		t.Fatalf("chave: %v", err)
+	}
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key}), 0o600)
+	return der
+}
+
+// SIGHUP troca o certificado: handshakes novos recebem o novo, conexões
+// abertas seguem com o antigo; reconexões retomam a sessão por ticket
+func TestTLSCertReload(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	oldDER := writeTestCert(t, certFile, keyFile)
+
+	tsAddr, _ := startFakeTS(t)
+	p, addr := startProxy(t, Config{Targets: []string{tsAddr}, TLSCert: certFile, TLSKey: keyFile})
+	cache := tls.NewLRUClientSessionCache(4)
+	dialTLS := func() (*tls.Conn, *testClient) {
+		t.Helper()
+		conn, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true, ClientSessionCache: cache})
+		if err != nil {
+			t.Fatalf("dial TLS: %v", err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		c := &testClient{conn: conn, reader: bufio.NewReader(conn)}
+		c.banner(t) // o ticket do TLS 1.3 chega junto com os primeiros dados
+		return conn, c
+	}
+
+	oldConn, old := dialTLS()
+	if got := oldConn.ConnectionState().PeerCertificates[0].Raw; !bytes.Equal(got, oldDER) {
+		t.Fatal("primeira conexão não recebeu o certificado do -tls-cert")
+	}
+	if resumed, _ := dialTLS(); !resumed.ConnectionState().DidResume {
+		t.Error("reconexão não retomou a sessão pelo ticket")
+	}
+
+	// Chave que não bate com o certificado: mantém o atual
+	os.WriteFile(keyFile, []byte("lixo"), 0o600)
+	if err := p.ReloadTLSCert(); err == nil {
+		t.Error("ReloadTLSCert aceitou uma chave inválida")
+	}
+
+	newDER := writeTestCert(t, certFile, keyFile)
+	if err := p.ReloadTLSCert(); err != nil {
+		t.Fatalf("ReloadTLSCert: %v", err)
+	}
+
+	cache = nil // sem retomar a sessão, para o handshake mostrar o certificado
+	newConn, _ := dialTLS()
+	if got := newConn.ConnectionState().PeerCertificates[0].Raw; !bytes.Equal(got, newDER) {
+		t.Error("conexão nova depois do SIGHUP recebeu o certificado antigo")
+	}
+
+	// A conexão aberta antes da troca continua funcionando
+	if lines, err := old.command("version"); err != nil || len(lines) != 1 {
+		t.Fatalf("conexão antiga depois da troca: %q, %v", lines, err)
+	}
+	if got := oldConn.ConnectionState().PeerCertificates[0].Raw; !bytes.Equal(got, oldDER) {
+		t.Error("conexão antiga mudou de certificado")
+	}
+}
+
+// Um listener TLS, dois backends: cada nome do SNI vai para o seu destino,
+// e o destino sem rota não recebe ninguém
+func TestSNIRoute(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writeTestCert(t, certFile, keyFile)
+
+	tsA, commandsA := startFakeTS(t)
+	tsB, commandsB := startFakeTS(t)
+	tsC, commandsC := startFakeTS(t)
+	var routes sniRoutes
+	if err := routes.Set("querya.example.com=" + tsA + ", QueryB.example.com.=" + tsB); err != nil {
+		t.Fatalf("sniRoutes.Set: %v", err)
+	}
+	p, addr := startProxy(t, Config{Targets: []string{tsA, tsB, tsC}, TLSCert: certFile, TLSKey: keyFile, SNIRoutes: routes})
+
+	dial := func(serverName string) *testClient {
+		t.Helper()
+		conn, err := tls.Dial("tcp", addr, &tls.Config{ServerName: serverName, InsecureSkipVerify: true})
+		if err != nil {
+			t.Fatalf("dial TLS (%s): %v", serverName, err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		return &testClient{conn: conn, reader: bufio.NewReader(conn)}
+	}
+
+	for i := 0; i < 3; i++ {
+		for _, name := range []string{"querya.example.com", "QUERYB.example.com"} {
+			c := dial(name)
+			c.banner(t)
+			if _, err := c.command("version"); err != nil {
+				t.Fatalf("version via %s: %v", name, err)
+			}
+		}
+	}
+	if a, b, c := atomic.LoadInt64(commandsA), atomic.LoadInt64(commandsB), atomic.LoadInt64(commandsC); a != 3 || b != 3 || c != 0 {
+		t.Errorf("comandos por destino = %d, %d, %d; esperado 3, 3, 0", a, b, c)
+	}
+
+	// Nome fora do mapa, e handshake sem SNI (IP no ServerName)
+	for _, name := range []string{"outro.example.com", "127.0.0.1"} {
+		c := dial(name)
+		if line := c.firstLine(t); line != `error id=1 msg=unknown\sserver\sname` {
+			t.Errorf("SNI %q recebeu %q", name, line)
+		}
+	}
+	if got := p.Snapshot().RejectedSNI; got != 2 {
+		t.Errorf("RejectedSNI = %d, esperado 2", got)
+	}
+
+	if err := routes.Set("querya.example.com"); err == nil {
+		t.Error("rota sem destino aceita")
+	}
+	if err := routes.Set("querya.example.com=semporta"); err == nil {
+		t.Error("rota com destino sem porta aceita")
+	}
+}
+
+func TestTLSPolicy(t *testing.T) {
+	for list, wantErr := range map[string]string{
+		"TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384": "",
+		"TLS_RSA_WITH_RC4_128_SHA":                "insegura",
+		"TLS_AES_128_GCM_SHA256":                  "TLS 1.3",
+		"TLS_NAO_EXISTE":                          "desconhecida",
+	} {
+		_, err := parseCipherSuites(list)
+		if (wantErr == "") != (err == nil) || (err != nil && !strings.Contains(err.Error(), wantErr)) {
+			t.Errorf("parseCipherSuites(%q) = %v, esperado %q", list, err, wantErr)
+		}
+	}
+
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writeTestCert(t, certFile, keyFile)
+	tsAddr, _ := startFakeTS(t)
+	dial := func(addr string, config *tls.Config) (tls.ConnectionState, error) {
+		config.InsecureSkipVerify = true
+		conn, err := tls.Dial("tcp", addr, config)
+		if err != nil {
+			return tls.ConnectionState{}, err
+		}
+		defer conn.Close()
+		return conn.ConnectionState(), nil
+	}
+
+	// Só TLS 1.3: cliente que vai até o 1.2 é recusado no handshake
+	_, addr := startProxy(t, Config{Targets: []string{tsAddr}, TLSCert: certFile, TLSKey: keyFile, TLSMinVersion: tls.VersionTLS13})
+	if _, err := dial(addr, &tls.Config{MaxVersion: tls.VersionTLS12}); err == nil {
+		t.Error("-tls-min-version 1.3 aceitou um cliente TLS 1.2")
+	}
+	if state, err := dial(addr, &tls.Config{}); err != nil || state.Version != tls.VersionTLS13 {
+		t.Errorf("cliente TLS 1.3: %v, %v", describeTLS(state), err)
+	}
+
+	// Uma suíte só: cliente que não oferece ela é recusado
+	ciphers, _ := parseCipherSuites("TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384")
+	_, addr = startProxy(t, Config{Targets: []string{tsAddr}, TLSCert: certFile, TLSKey: keyFile, TLSCiphers: ciphers})
+	tls12 := func(suite uint16) *tls.Config {
+		return &tls.Config{MaxVersion: tls.VersionTLS12, CipherSuites: []uint16{suite}}
+	}
+	if _, err := dial(addr, tls12(tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256)); err == nil {
+		t.Error("-tls-ciphers aceitou uma suíte fora da lista")
+	}
+	if state, err := dial(addr, tls12(ciphers[0])); err != nil || state.CipherSuite != ciphers[0] {
+		t.Errorf("suíte da lista: %v, %v", describeTLS(state), err)
+	}
+}
+
+// Lado do processo novo no SIGUSR1: escuta no fd herdado e avisa pelo pipe
+func TestInheritedListener(t *testing.T) {
+	tsAddr, _ := startFakeTS(t)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	f, err := ln.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatalf("File(): %v", err)
+	}
+	listenFD, err := syscall.Dup(int(f.Fd()))
+	if err != nil {
+		t.Fatalf("dup: %v", err)
+	}
+	f.Close()
+	ln.Close() // o socket continua aberto no fd herdado
+
+	readyR, readyW, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("pipe: %v", err)
+	}
+	defer readyR.Close()
+	readyFD, err := syscall.Dup(int(readyW.Fd()))
+	if err != nil {
+		t.Fatalf("dup: %v", err)
+	}
+	readyW.Close()
+
+	t.Setenv(listenFDEnv, strconv.Itoa(listenFD))
+	t.Setenv(readyFDEnv, strconv.Itoa(readyFD))
+	_, addr := startProxy(t, Config{Targets: []string{tsAddr}})
+	if addr != ln.Addr().String() {
+		t.Fatalf("proxy escutando em %s, esperado o socket herdado %s", addr, ln.Addr())
+	}
+
+	readyR.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := readyR.Read(make([]byte, 1)); err != nil {
+		t.Fatalf("aviso de pronto: %v", err)
+	}
+	if os.Getenv(listenFDEnv) != "" || os.Getenv(readyFDEnv) != "" {
+		t.Error("variáveis do handoff continuam no ambiente")
+	}
+
+	c := dialProxy(t, addr)
+	c.banner(t)
+	if _, err := c.command("version"); err != nil {
+		t.Fatalf("version: %v", err)
+	}
+}
+
+func TestConfigRedacted(t *testing.T) {
+	config := Config{PoolUser: "pool", PoolPass: "segredo-pool", LoginUser: "bot", LoginPass: "segredo-login", AdminToken: "segredo-admin"}
+	dump := fmt.Sprintf("%+v", config.redacted())
+	for _, secret := range []string{"segredo-pool", "segredo-login", "segredo-admin"} {
+		if strings.Contains(dump, secret) {
+			t.Errorf("configuração do log expõe %q: %s", secret, dump)
+		}
+	}
+	if !strings.Contains(dump, "PoolUser:pool") || config.AdminToken != "segredo-admin" {
+		t.Errorf("redacted() mudou o que não devia: %s", dump)
+	}
+}
+
+func TestConfigEndpoint(t *testing.T) {
+	_, allow, _ := net.ParseCIDR("10.0.0.0/8")
+	p := NewProxy(Config{
+		Targets:     []string{"127.0.0.1:10011"},
+		MaxConns:    100,
+		IdleTimeout: time.Minute,
+		Allow:       []*net.IPNet{allow},
+		AdminToken:  "segredo-admin",
+		LoginUser:   "bot",
+		LoginPass:   "segredo-login",
+		LogLevel:    "error",
+	})
+	p.Reload(7, 0, []*net.IPNet{allow}, nil)
+	mux := http.NewServeMux()
+	p.registerAdmin(mux)
+
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/config", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("GET /config sem token = %d, esperado 401", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/config", nil)
+	r.Header.Set("Authorization", "Bearer segredo-admin")
+	mux.ServeHTTP(w, r)
+	if w.Code != http.StatusOK || strings.Contains(w.Body.String(), "segredo") {
+		t.Fatalf("GET /config = %d %s", w.Code, w.Body)
+	}
+	var got map[string]any
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatalf("JSON: %v", err)
+	}
+	if got["AdminToken"] != "***" || got["LoginPass"] != "***" || got["LoginUser"] != "bot" {
+		t.Errorf("segredos: AdminToken=%v LoginPass=%v LoginUser=%v", got["AdminToken"], got["LoginPass"], got["LoginUser"])
+	}
+	if got["IdleTimeout"] != "1m0s" || fmt.Sprint(got["Allow"]) != "[10.0.0.0/8]" {
+		t.Errorf("IdleTimeout=%v Allow=%v, esperado 1m0s e [10.0.0.0/8]", got["IdleTimeout"], got["Allow"])
+	}
+	if got["MaxConns"] != float64(7) {
+		t.Errorf("MaxConns = %v, esperado o valor do reload (7)", got["MaxConns"])
+	}
+	if got["TLSMinVersion"] != "TLS 1.2" {
+		t.Errorf("TLSMinVersion = %v, esperado \"TLS 1.2\"", got["TLSMinVersion"])
+	}
+}
+
+func TestMetricsPerTarget(t *testing.T) {
+	tsA, _ := startFakeTS(t)
+	tsB, _ := startFakeTS(t)
+	p, addr := startProxy(t, Config{Targets: []string{tsA, tsB}})
+
+	c := dialProxy(t, addr)
+	c.banner(t)
+	if _, err := c.command("version"); err != nil {
+		t.Fatalf("version: %v", err)
+	}
+
+	w := httptest.NewRecorder()
+	p.handleMetrics(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	body := w.Body.String()
+	// Soma das séries de name entre os destinos; cada destino precisa ter a sua
+	sum := func(name string) int {
+		t.Helper()
+		var total int
+		for _, ts := range []string{tsA, tsB} {
+			var n int
+			line := fmt.Sprintf("%s{target=%q} ", name, ts)
+			i := strings.Index(body, line)
+			if i < 0 {
+				t.Fatalf("sem %s para %s em:\n%s", name, ts, body)
+			}
+			fmt.Sscan(body[i+len(line):], &n)
+			total += n
+		}
+		return total
+	}
+	for name, want := range map[string]int{
+		"batqa_connections_total":             1,
+		"batqa_active_connections":            1,
+		"batqa_commands_total":                1,
+		"batqa_target_up":                     2,
+		"batqa_command_latency_seconds_count": 1,
+		"batqa_response_size_bytes_count":     1,
+	} {
+		if got := sum(name); got != want {
+			t.Errorf("%s somou %d entre os destinos, esperado %d", name, got, want)
+		}
+	}
+	if strings.Contains(body, tsA+","+tsB) {
+		t.Error("label target ainda junta os destinos")
+	}
+}
+
+func TestDrainRejectsNewConnections(t *testing.T) {
+	tsAddr, _ := startFakeTS(t)
+	p, addr := startProxy(t, Config{Targets: []string{tsAddr}})
+
+	ready := func() int {
+		w := httptest.NewRecorder()
+		p.handleReady(w, httptest.NewRequest(http.MethodGet, "/ready", nil))
+		return w.Code
+	}
+	if code := ready(); code != http.StatusOK {
+		t.Fatalf("/ready = %d antes do drain", code)
+	}
+
+	active := dialProxy(t, addr)
+	active.banner(t)
+
+	if !p.Drain() {
+		t.Fatal("Drain() = false no primeiro drain")
+	}
+	if code := ready(); code != http.StatusServiceUnavailable {
+		t.Errorf("/ready = %d em drain, esperado 503", code)
+	}
+	c := dialProxy(t, addr)
+	if line := c.firstLine(t); line != `error id=1 msg=proxy\sdraining,\stry\sanother\sserver` {
+		t.Fatalf("conexão nova em drain recebeu %q", line)
+	}
+
+	// A sessão que já estava aberta segue normal
+	if response, err := active.command("version"); err != nil || response[len(response)-1] != "error id=0 msg=ok" {
+		t.Fatalf("sessão ativa em drain: %q, %v", response, err)
+	}
+
+	p.Undrain()
+	if code := ready(); code != http.StatusOK {
+		t.Errorf("/ready = %d depois do undrain", code)
+	}
+	dialProxy(t, addr).banner(t)
+}
+
+func TestTargetDrain(t *testing.T) {
+	tsA, _ := startFakeTS(t)
+	tsB, _ := startFakeTS(t)
+	p, addr := startProxy(t, Config{Targets: []string{tsA, tsB}})
+
+	targetState := func(addr string) TargetSnapshot {
+		for _, ts := range p.Snapshot().Targets {
+			if ts.Addr == addr {
+				return ts
+			}
+		}
+		t.Fatalf("destino %s fora do /stats", addr)
+		return TargetSnapshot{}
+	}
+	drain := func(path, target string) int {
+		w := httptest.NewRecorder()
+		handler := p.handleTargetDrain(path == "/targets/drain")
+		handler(w, httptest.NewRequest(http.MethodPost, path+"?addr="+target, nil))
+		return w.Code
+	}
+
+	// Uma sessão em cada destino (round-robin)
+	sessions := []*testClient{dialProxy(t, addr), dialProxy(t, addr)}
+	for _, c := range sessions {
+		c.banner(t)
+	}
+	if a, b := targetState(tsA).ActiveConnections, targetState(tsB).ActiveConnections; a != 1 || b != 1 {
+		t.Fatalf("ativas antes do drain: A=%d B=%d", a, b)
+	}
+
+	if code := drain("/targets/drain", tsA); code != http.StatusOK {
+		t.Fatalf("POST /targets/drain = %d", code)
+	}
+	if code := drain("/targets/drain", "127.0.0.1:1"); code != http.StatusNotFound {
+		t.Errorf("drain de destino inexistente = %d, esperado 404", code)
+	}
+	if state := targetState(tsA).State; state != targetDraining {
+		t.Errorf("State do destino em drain = %q", state)
+	}
+
+	// Conexões novas só no B; a sessão que já estava no A segue
+	for i := 0; i < 4; i++ {
+		dialProxy(t, addr).banner(t)
+	}
+	if a, b := targetState(tsA).ActiveConnections, targetState(tsB).ActiveConnections; a != 1 || b != 5 {
+		t.Errorf("ativas com A em drain: A=%d B=%d, esperado 1 e 5", a, b)
+	}
+	for _, c := range sessions {
+		if lines, err := c.command("version"); err != nil || lines[len(lines)-1] != "error id=0 msg=ok" {
+			t.Fatalf("sessão aberta antes do drain: %q, %v", lines, err)
+		}
+	}
+
+	drain("/targets/undrain", tsA)
+	if state := targetState(tsA).State; state != targetActive {
+		t.Errorf("State depois do undrain = %q", state)
+	}
+	for i := 0; i < 2; i++ {
+		dialProxy(t, addr).banner(t)
+	}
+	if a := targetState(tsA).ActiveConnections; a != 2 {
+		t.Errorf("A de volta à rotação com %d ativas, esperado 2", a)
+	}
+}
+
+func TestReadyAndHealthz(t *testing.T) {
+	tsAddr, _ := startFakeTS(t)
+	p, _ := startProxy(t, Config{Targets: []string{tsAddr}})
+
+	probe := func(path string) int {
+		w := httptest.NewRecorder()
+		handler := p.handleReady
+		if path == "/healthz" {
+			handler = p.handleHealthz
+		}
+		handler(w, httptest.NewRequest(http.MethodGet, path, nil))
+		return w.Code
+	}
+	if ready, live := probe("/ready"), probe("/healthz"); ready != http.StatusOK || live != http.StatusOK {
+		t.Fatalf("/ready = %d, /healthz = %d com o destino no ar", ready, live)
+	}
+
+	// Sem destino no ar o proxy sai do balanceamento, mas continua vivo
+	target := p.targetList()[0]
+	p.setTargetHealth(target, errors.New("health check falhou"))
+	if ready, live := probe("/ready"), probe("/healthz"); ready != http.StatusServiceUnavailable || live != http.StatusOK {
+		t.Errorf("/ready = %d, /healthz = %d sem destino no ar, esperado 503 e 200", ready, live)
+	}
+	p.setTargetHealth(target, nil)
+
+	p.Drain()
+	if ready, live := probe("/ready"), probe("/healthz"); ready != http.StatusServiceUnavailable || live != http.StatusOK {
+		t.Errorf("/ready = %d, /healthz = %d em drain, esperado 503 e 200", ready, live)
+	}
+}
+
+func TestCompression(t *testing.T) {
+	tsAddr, commands := startFakeTS(t)
+	p, addr := startProxy(t, Config{Targets: []string{tsAddr}, AllowCompression: true})
+
+	c := dialProxy(t, addr)
+	c.banner(t)
+	response, err := c.command("batqa-compress brotli")
+	if err != nil || response[0] != `error id=1538 msg=invalid\sparameter` {
+		t.Fatalf("algoritmo desconhecido: %q, %v", response, err)
+	}
+	response, err = c.command("batqa-compress gzip")
+	if err != nil || response[0] != "error id=0 msg=ok" {
+		t.Fatalf("pedido de compressão: %q, %v", response, err)
+	}
+
+	// Daqui em diante a resposta vem em gzip
+	if _, err := io.WriteString(c.conn, "version\n"); err != nil {
+		t.Fatal(err)
+	}
+	z, err := gzip.NewReader(c.reader)
+	if err != nil {
+		t.Fatalf("gzip: %v", err)
+	}
+	if response, err := readResponse(bufio.NewReader(z)); err != nil || response[0] != "error id=0 msg=ok" {
+		t.Fatalf("version comprimido: %q, %v", response, err)
+	}
+
+	if got := atomic.LoadInt64(commands); got != 1 {
+		t.Errorf("TS recebeu %d comandos, esperado 1 (o pedido fica no proxy)", got)
+	}
+	s := p.Snapshot()
+	if s.CompressedConnections != 1 || s.UncompressedBytes != uint64(len("error id=0 msg=ok\n\r")) || s.CompressedBytes == 0 {
+		t.Errorf("stats de compressão: %d conexões, %d → %d bytes", s.CompressedConnections, s.UncompressedBytes, s.CompressedBytes)
+	}
+}
+
+func TestEventStream(t *testing.T) {
+	tsAddr, _ := startFakeTS(t)
+	p, addr := startProxy(t, Config{Targets: []string{tsAddr}, MaxConns: 1})
+
+	srv := httptest.NewServer(http.HandlerFunc(p.handleEvents))
+	defer srv.Close()
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatalf("GET /events: %v", err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("Content-Type = %q", ct)
+	}
+	events := bufio.NewReader(resp.Body)
+	next := func() Event {
+		t.Helper()
+		for {
+			line, err := events.ReadString('\n')
+			if err != nil {
+				t.Fatalf("leitura do stream: %v", err)
+			}
+			if data, ok := strings.CutPrefix(line, "data: "); ok {
+				var e Event
+				if err := json.Unmarshal([]byte(data), &e); err != nil {
+					t.Fatalf("evento %q: %v", data, err)
+				}
+				return e
+			}
+		}
+	}
+
+	first := dialProxy(t, addr)
+	first.banner(t)
+	if e := next(); e.Event != eventConnectionOpen || e.Client != "127.0.0.1" || e.Target != tsAddr || e.ConnID != 1 {
+		t.Fatalf("primeiro evento: %+v", e)
+	}
+
+	dialProxy(t, addr).firstLine(t) // acima do -max-conns
+	if e := next(); e.Event != eventRejected || e.Reason != "too many connections" {
+		t.Fatalf("evento da recusa: %+v", e)
+	}
+
+	first.conn.Close()
+	if e := next(); e.Event != eventConnectionClose || e.ConnID != 1 {
+		t.Fatalf("evento do fechamento: %+v", e)
+	}
+}
+
+func TestSlowCommand(t *testing.T) {
+	tsAddr, _ := startFakeTS(t)
+	fast, fastAddr := startProxy(t, Config{Targets: []string{tsAddr}, SlowCommand: time.Hour})
+	slow, slowAddr := startProxy(t, Config{Targets: []string{tsAddr}, SlowCommand: time.Nanosecond})
+
+	for _, addr := range []string{fastAddr, slowAddr} {
+		c := dialProxy(t, addr)
+		c.banner(t)
+		if _, err := c.command("clientdblist"); err != nil {
+			t.Fatalf("clientdblist: %v", err)
+		}
+	}
+	if got := fast.Snapshot().SlowCommands; got != 0 {
+		t.Errorf("SlowCommands = %d abaixo do limite", got)
+	}
+	eventually(t, "SlowCommands = 1", func() bool {
+		return slow.Snapshot().SlowCommands == 1
+	})
+}
+
+func TestIPKey(t *testing.T) {
+	tests := []struct {
+		addr   net.Addr
+		v4, v6 int
+		want   string
+	}{
+		{&net.TCPAddr{IP: net.ParseIP("203.0.113.7")}, 32, 64, "203.0.113.7"},
+		{&net.TCPAddr{IP: net.ParseIP("203.0.113.7")}, 24, 64, "203.0.113.0/24"},
+		{&net.TCPAddr{IP: net.ParseIP("::ffff:203.0.113.7")}, 32, 64, "203.0.113.7"},
+		{&net.TCPAddr{IP: net.ParseIP("2001:db8:1:2:aaaa::1")}, 32, 64, "2001:db8:1:2::/64"},
+		{&net.TCPAddr{IP: net.ParseIP("2001:db8:1:2:bbbb::9")}, 32, 64, "2001:db8:1:2::/64"},
+		{&net.TCPAddr{IP: net.ParseIP("2001:db8:1:2:aaaa::1")}, 32, 128, "2001:db8:1:2:aaaa::1"},
+		{&net.TCPAddr{IP: net.ParseIP("2001:db8:1:2:aaaa::1")}, 32, 48, "2001:db8:1::/48"},
+		{&net.UnixAddr{Name: "/run/batqa.sock", Net: "unix"}, 32, 64, ""},
+	}
+	for _, tt := range tests {
+		if got := ipKey(tt.addr, tt.v4, tt.v6); got != tt.want {
+			t.Errorf("ipKey(%v, /%d, /%d) = %q, esperado %q", tt.addr, tt.v4, tt.v6, got, tt.want)
+		}
+	}
+}
+
+func TestMaxSession(t *testing.T) {
+	tsAddr, _ := startFakeTS(t)
+	p, addr := startProxy(t, Config{Targets: []string{tsAddr}, MaxSession: 100 * time.Millisecond})
+
+	c := dialProxy(t, addr)
+	c.banner(t)
+	if _, err := c.command("version"); err != nil {
+		t.Fatalf("version: %v", err)
+	}
+
+	// O sweeper passa a cada segundo: o aviso chega antes do fechamento
+	if line := c.firstLine(t); line != `error id=1 msg=session\sexpired` {
+		t.Fatalf("sessão vencida recebeu %q", line)
+	}
+	if _, err := c.reader.ReadByte(); err != io.EOF && !isConnReset(err) {
+		t.Errorf("sessão vencida não foi fechada: %v", err)
+	}
+	eventually(t, "SessionsExpired = 1", func() bool {
+		s := p.Snapshot()
+		return s.SessionsExpired == 1 && s.ActiveConnections == 0
+	})
+}
+
+func TestNotifyInterleavedWithResponse(t *testing.T) {
+	const (
+		enterView = "notifycliententerview cid=1 clid=5 client_nickname=Ana\n\r"
+		leftView  = "notifyclientleftview cfid=1 ctid=0 clid=5\n\r"
+		clients   = "clid=1 client_nickname=serveradmin\n\r"
+		ok        = "error id=0 msg=ok\n\r"
+		delay     = 50 * time.Millisecond
+	)
+	tsAddr := startFakeTSWith(t, func(conn net.Conn) {
+		io.WriteString(conn, fakeBanner)
+		reader := bufio.NewReader(conn)
+		for {
+			line, err := readLine(reader)
+			if err != nil {
+				return
+			}
+			switch commandVerb(line) {
+			case "servernotifyregister":
+				// Evento logo depois da resposta, sem comando pendente
+				io.WriteString(conn, ok+enterView)
+			case "clientlist":
+				// Evento no meio da resposta, antes da parte lenta
+				io.WriteString(conn, leftView)
+				time.Sleep(delay)
+				io.WriteString(conn, clients+ok)
+			}
+		}
+	})
+	p, addr := startProxy(t, Config{Targets: []string{tsAddr}})
+
+	c := dialProxy(t, addr)
+	c.banner(t)
+	readUntilError := func() (lines []string) {
+		for {
+			line := c.firstLine(t)
+			lines = append(lines, line)
+			if strings.HasPrefix(line, "error id=") {
+				return lines
+			}
+		}
+	}
+
+	io.WriteString(c.conn, "servernotifyregister event=server\n")
+	if got := readUntilError(); len(got) != 1 {
+		t.Fatalf("servernotifyregister: %q", got)
+	}
+	if line := c.firstLine(t); line != trimLine(enterView) {
+		t.Fatalf("evento sem comando pendente: %q", line)
+	}
+
+	io.WriteString(c.conn, "clientlist\n")
+	got := readUntilError()
+	want := []string{trimLine(leftView), trimLine(clients), trimLine(ok)}
+	if strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Fatalf("clientlist: %q, esperado %q", got, want)
+	}
+
+	// O evento não encerra a resposta: o tempo do clientlist inclui a espera
+	eventually(t, "tempo do clientlist", func() bool {
+		return p.Snapshot().Commands["clientlist"].Count == 1
+	})
+	s := p.Snapshot()
+	if ms := s.Commands["clientlist"].MinMs; ms < float64(delay.Milliseconds()) {
+		t.Errorf("tempo do clientlist = %vms, esperado ao menos %v", ms, delay)
+	}
+	if s.UnmatchedResponses != 0 {
+		t.Errorf("UnmatchedResponses = %d", s.UnmatchedResponses)
+	}
+
+	// Eventos contam nos bytes
+	toTS := len("servernotifyregister event=server\n") + len("clientlist\n")
+	toClient := len(fakeBanner) + len(ok+enterView) + len(leftView+clients+ok)
+	if s.TotalBytes != uint64(toTS+toClient) {
+		t.Errorf("TotalBytes = %d, esperado %d", s.TotalBytes, toTS+toClient)
+	}
+}
+
+func TestTargetTLS(t *testing.T) {
+	// Certificado autoassinado do httptest, válido para 127.0.0.1
+	certSrv := httptest.NewUnstartedServer(nil)
+	certSrv.StartTLS()
+	serverTLS := &tls.Config{Certificates: certSrv.TLS.Certificates}
+	certSrv.Close()
+
+	commands := new(int64)
+	tsAddr := startFakeTSWith(t, func(conn net.Conn) {
+		serveFakeTS(tls.Server(conn, serverTLS), commands)
+	})
+
+	// Sem -target-tls-insecure, o certificado não confiável é recusado
+	strict, strictAddr := startProxy(t, Config{Targets: []string{tsAddr}, TargetTLS: true})
+	c := dialProxy(t, strictAddr)
+	if _, err := c.reader.ReadByte(); err != io.EOF && !isConnReset(err) {
+		t.Fatalf("certificado não confiável aceito: %v", err)
+	}
+	if got := strict.Snapshot().RejectedDialFailed; got != 1 {
+		t.Errorf("RejectedDialFailed = %d, esperado 1", got)
+	}
+
+	_, addr := startProxy(t, Config{Targets: []string{tsAddr}, TargetTLS: true, TargetTLSInsecure: true, PoolSize: 1})
+	c = dialProxy(t, addr)
+	c.banner(t)
+	if response, err := c.command("version"); err != nil || response[0] != "error id=0 msg=ok" {
+		t.Fatalf("version pelo TLS: %q, %v", response, err)
+	}
+	if got := atomic.LoadInt64(commands); got != 1 {
+		t.Errorf("TS recebeu %d comandos, esperado 1", got)
+	}
+}
+
+func TestThrottledReader(t *testing.T) {
+	const rate = 64 * 1024
+	data := strings.Repeat("x", rate/4) // 250ms no limite, menos a rajada
+	var pauses int
+	r := newThrottledReader(strings.NewReader(data), rate, make(chan struct{}), func() { pauses++ })
+
+	start := time.Now()
+	n, err := io.Copy(io.Discard, r)
+	elapsed := time.Since(start)
+	if err != nil || n != int64(len(data)) {
+		t.Fatalf("copiou %d bytes (%v), esperado %d", n, err, len(data))
+	}
+	if elapsed < 150*time.Millisecond {
+		t.Errorf("leitura levou %v, esperado perto de 200ms", elapsed)
+	}
+	if pauses == 0 {
+		t.Error("leitura acima do limite sem nenhuma pausa")
+	}
+}
+
+func TestAutoBan(t *testing.T) {
+	tsAddr, _ := startFakeTS(t)
+	p, addr := startProxy(t, Config{Targets: []string{tsAddr}, ConnRate: 1,
+		BanThreshold: 2, BanWindow: time.Minute, BanDuration: time.Minute})
+
+	// A 1ª passa; a 2ª e a 3ª estouram o rate limit e a 3ª recusa bane o IP
+	dialProxy(t, addr).banner(t)
+	for i := 0; i < 2; i++ {
+		if line := dialProxy(t, addr).firstLine(t); line != `error id=524 msg=connection\srate\slimit\sexceeded` {
+			t.Fatalf("conexão acima do rate limit recebeu %q", line)
+		}
+	}
+	if line := dialProxy(t, addr).firstLine(t); line != `error id=3329 msg=you\sare\sbanned` {
+		t.Fatalf("IP banido recebeu %q", line)
+	}
+	s := p.Snapshot()
+	if s.Bans != 1 || s.RejectedBanned != 1 || s.RejectedRateLimit != 2 {
+		t.Errorf("Bans = %d, RejectedBanned = %d, RejectedRateLimit = %d; esperado 1, 1, 2",
+			s.Bans, s.RejectedBanned, s.RejectedRateLimit)
+	}
+	if bans := p.Bans(); len(bans) != 1 || bans[0].IP != "127.0.0.1" {
+		t.Fatalf("Bans() = %+v, esperado só 127.0.0.1", bans)
+	}
+
+	if !p.Unban("127.0.0.1") {
+		t.Fatal("Unban não encontrou o banimento")
+	}
+	if bans := p.Bans(); len(bans) != 0 {
+		t.Errorf("Bans() depois do Unban = %+v", bans)
+	}
+}
+
+func TestRunCleanup(t *testing.T) {
+	p := NewProxy(Config{
+		ConnRate:     5,
+		RateWindow:   20 * time.Millisecond,
+		BanThreshold: 1,
+		BanWindow:    time.Minute,
+		BanDuration:  10 * time.Millisecond,
+		LogLevel:     "error",
+	})
+	rl := p.live.Load().rateLimiter
+	rl.Allow("203.0.113.7")
+	p.bans.strike("203.0.113.8")
+
+	go p.runCleanup()
+	defer close(p.shutdown)
+
+	// Um laço só limpa os dois: o IP parado e o banimento vencido
+	eventually(t, "limpeza do rate limit e dos banimentos", func() bool {
+		rl.mu.Lock()
+		ips := len(rl.buckets)
+		rl.mu.Unlock()
+		p.bans.mu.Lock()
+		bans := len(p.bans.bans)
+		p.bans.mu.Unlock()
+		return ips == 0 && bans == 0
+	})
+}
+
+func TestDialRetries(t *testing.T) {
+	// O TS derruba as 2 primeiras conexões antes do banner
+	var attempts int64
+	tsAddr := startFakeTSWith(t, func(conn net.Conn) {
+		if atomic.AddInt64(&attempts, 1) <= 2 {
+			return
+		}
+		serveFakeTS(conn, new(int64))
+	})
+	p, addr := startProxy(t, Config{Targets: []string{tsAddr}, StripBanner: true, DialRetries: 3})
+
+	c := dialProxy(t, addr)
+	if _, err := c.command("version"); err != nil {
+		t.Fatalf("version depois das novas tentativas: %v", err)
+	}
+	if s := p.Snapshot(); s.DialRetries != 2 || s.RejectedDialFailed != 0 {
+		t.Errorf("DialRetries = %d, RejectedDialFailed = %d; esperado 2 e 0", s.DialRetries, s.RejectedDialFailed)
+	}
+}
+
+func TestTraceSelection(t *testing.T) {
+	conns, nets, err := parseTraceSpec("2")
+	if err != nil || conns != 2 || nets != nil {
+		t.Fatalf("parseTraceSpec(2) = %d, %v, %v", conns, nets, err)
+	}
+	p := NewProxy(Config{TraceConns: conns})
+	addr := &net.TCPAddr{IP: net.ParseIP("203.0.113.7"), Port: 5000}
+	for i, want := range []bool{true, true, false} {
+		if got := p.traceConn(addr); got != want {
+			t.Errorf("-trace 2: conexão %d rastreada = %v, esperado %v", i+1, got, want)
+		}
+	}
+
+	_, nets, err = parseTraceSpec("203.0.113.0/24")
+	if err != nil {
+		t.Fatalf("parseTraceSpec(faixa): %v", err)
+	}
+	p = NewProxy(Config{TraceNets: nets})
+	if !p.traceConn(addr) || p.traceConn(&net.TCPAddr{IP: net.ParseIP("198.51.100.1")}) {
+		t.Error("-trace 203.0.113.0/24 não escolheu só a faixa")
+	}
+
+	if got, want := escapeTrace("login a\\sb\x00\n\r"), `login a\sb\x00\n\r`; got != want {
+		t.Errorf("escapeTrace = %q, esperado %q", got, want)
+	}
+}
+
+func TestConnectionLabels(t *testing.T) {
+	tsAddr, commands := startFakeTS(t)
+	p, addr := startProxy(t, Config{Targets: []string{tsAddr}, AllowLabels: true})
+
+	c := dialProxy(t, addr)
+	c.banner(t)
+	if _, err := io.WriteString(c.conn, "batqa-label bot-1\n"); err != nil {
+		t.Fatalf("escrita do rótulo: %v", err)
+	}
+	if _, err := c.command("version"); err != nil {
+		t.Fatalf("version: %v", err)
+	}
+	if lines, _ := c.command("batqa-label bot-2"); len(lines) == 0 || lines[len(lines)-1] != `error id=1 msg=label\smust\sbe\ssent\sbefore\sthe\sfirst\scommand` {
+		t.Errorf("rótulo depois do primeiro comando recebeu %q", lines)
+	}
+
+	if conns := p.Connections(); len(conns) != 1 || conns[0].Label != "bot-1" {
+		t.Fatalf("Connections() = %+v, esperado o rótulo bot-1", conns)
+	}
+	if l := p.Snapshot().Labels["bot-1"]; l.Connections != 1 || l.ActiveConnections != 1 || l.Commands != 1 {
+		t.Errorf("Labels[bot-1] = %+v, esperado 1 conexão ativa com 1 comando", l)
+	}
+	if got := atomic.LoadInt64(commands); got != 1 {
+		t.Errorf("TS recebeu %d comandos, esperado 1 (o rótulo não é repassado)", got)
+	}
+}
+
+func TestConnectionLabelsDisabled(t *testing.T) {
+	tsAddr, commands := startFakeTS(t)
+	_, addr := startProxy(t, Config{Targets: []string{tsAddr}})
+
+	c := dialProxy(t, addr)
+	c.banner(t)
+	if lines, _ := c.command("batqa-label bot-1"); len(lines) == 0 || lines[len(lines)-1] != `error id=1 msg=labels\snot\senabled` {
+		t.Errorf("rótulo sem -allow-labels recebeu %q", lines)
+	}
+	if got := atomic.LoadInt64(commands); got != 0 {
+		t.Errorf("TS recebeu %d comandos, esperado 0", got)
+	}
+}
+
+func TestOriginCommand(t *testing.T) {
+	// TS que recusa o clientupdate (sem permissão antes do login) e aceita o resto
+	received := make(chan string, 4)
+	tsAddr := startFakeTSWith(t, func(conn net.Conn) {
+		io.WriteString(conn, fakeBanner)
+		reader := bufio.NewReader(conn)
+		for {
+			line, err := readLine(reader)
+			if err != nil {
+				return
+			}
+			cmd := trimLine(string(line))
+			received <- cmd
+			reply := "error id=0 msg=ok\n\r"
+			if commandVerb(line) == "clientupdate" {
+				reply = "error id=2568 msg=insufficient\\sclient\\spermissions failed_permid=4\n\r"
+			}
+			io.WriteString(conn, reply)
+		}
+	})
+	_, addr := startProxy(t, Config{Targets: []string{tsAddr}, OriginCommand: "clientupdate client_description=origin:{ip}"})
+
+	c := dialProxy(t, addr)
+	c.banner(t)
+	lines, err := c.command("version")
+	if err != nil {
+		t.Fatalf("version: %v", err)
+	}
+	if len(lines) != 1 || lines[0] != "error id=0 msg=ok" {
+		t.Errorf("version recebeu %q, esperado só a própria resposta", lines)
+	}
+	if got := <-received; got != "clientupdate client_description=origin:127.0.0.1" {
+		t.Errorf("primeiro comando no TS = %q, esperado o -origin-command", got)
+	}
+	if got := <-received; got != "version" {
+		t.Errorf("segundo comando no TS = %q, esperado version", got)
+	}
+}
+
+func TestRateLimiterWindow(t *testing.T) {
+	// 2 conexões a cada 200ms: o token volta em 100ms; a cada 10s, em 5s
+	fast := NewRateLimiter(2, 200*time.Millisecond)
+	slow := NewRateLimiter(2, 10*time.Second)
+
+	for _, rl := range []*RateLimiter{fast, slow} {
+		if !rl.Allow("203.0.113.7") || !rl.Allow("203.0.113.7") || rl.Allow("203.0.113.7") {
+			t.Fatalf("janela %v: rajada de 2 não foi respeitada", rl.window)
+		}
+	}
+	time.Sleep(150 * time.Millisecond)
+	if !fast.Allow("203.0.113.7") {
+		t.Error("janela 200ms: token não voltou depois de 150ms")
+	}
+	if slow.Allow("203.0.113.7") {
+		t.Error("janela 10s: token voltou depois de 150ms")
+	}
+}
+
+func TestShedRate(t *testing.T) {
+	p := NewProxy(Config{Targets: []string{"127.0.0.1:1"}, ShedLatency: 100 * time.Millisecond})
+	tests := []struct {
+		latency time.Duration
+		want    float64
+	}{
+		{80 * time.Millisecond, 0},
+		{150 * time.Millisecond, 0.5},
+		{300 * time.Millisecond, maxShedRate},
+	}
+	for _, tt := range tests {
+		tgt := &target{addr: "127.0.0.1:1"}
+		tgt.observeCommandLatency(tt.latency)
+		if got := p.shedRate(tgt); math.Abs(got-tt.want) > 1e-9 {
+			t.Errorf("média %v: shedRate = %v, esperado %v", tt.latency, got, tt.want)
+		}
+	}
+
+	// Média sem medida recente não descarta nada
+	tgt := &target{addr: "127.0.0.1:1"}
+	tgt.observeCommandLatency(time.Second)
+	atomic.StoreInt64(&tgt.cmdRTTAt, time.Now().Add(-2*shedStaleAfter).UnixNano())
+	if got := p.shedRate(tgt); got != 0 {
+		t.Errorf("média velha: shedRate = %v, esperado 0", got)
+	}
+}
+
+func TestStickyBalance(t *testing.T) {
+	addrs := []string{"10.0.0.1:10011", "10.0.0.2:10011", "10.0.0.3:10011", "10.0.0.4:10011"}
+	ips := make([]string, 200)
+	for i := range ips {
+		ips[i] = fmt.Sprintf("192.0.2.%d", i)
+	}
+	first := func(p *Proxy, ip string) string {
+		t.Helper()
+		order := p.targetOrder(nil, ip)
+		if len(order) == 0 {
+			t.Fatalf("nenhum destino para %s", ip)
+		}
+		// O que o acquireTarget faria ao conectar
+		p.sticky.remember(ip, order[0].addr)
+		return order[0].addr
+	}
+
+	p := NewProxy(Config{Targets: addrs, Balance: balanceSticky})
+	home := make(map[string]string)
+	perTarget := make(map[string]int)
+	for _, ip := range ips {
+		home[ip] = first(p, ip)
+		perTarget[home[ip]]++
+		if again := first(p, ip); again != home[ip] {
+			t.Fatalf("%s foi para %s e depois %s", ip, home[ip], again)
+		}
+	}
+	for _, addr := range addrs {
+		if perTarget[addr] < len(ips)/len(addrs)/2 {
+			t.Errorf("distribuição desigual: %v", perTarget)
+			break
+		}
+	}
+	if got := p.Snapshot().StickyClients; got != len(ips) {
+		t.Errorf("StickyClients = %d, esperado %d", got, len(ips))
+	}
+
+	// Destino cai: só os clientes dele mudam, e nenhum vai para ele
+	down := p.targetList()[1]
+	atomic.StoreInt32(&down.down, 1)
+	for _, ip := range ips {
+		got := first(p, ip)
+		if got == down.addr || home[ip] != down.addr && got != home[ip] {
+			t.Fatalf("com %s fora do ar, %s (de %s) foi para %s", down.addr, ip, home[ip], got)
+		}
+	}
+	// Volta: cada um volta para o seu
+	atomic.StoreInt32(&down.down, 0)
+	for _, ip := range ips {
+		if got := first(p, ip); got != home[ip] {
+			t.Fatalf("depois da volta de %s, %s foi para %s, esperado %s", down.addr, ip, got, home[ip])
+		}
+	}
+
+	// -sticky-stay: quem mudou fica no destino novo depois da volta
+	p = NewProxy(Config{Targets: addrs, Balance: balanceSticky, StickyStay: true})
+	for _, ip := range ips {
+		first(p, ip)
+	}
+	atomic.StoreInt32(&p.targetList()[1].down, 1)
+	moved := make(map[string]string)
+	for _, ip := range ips {
+		if home[ip] == down.addr {
+			moved[ip] = first(p, ip)
+		}
+	}
+	atomic.StoreInt32(&p.targetList()[1].down, 0)
+	for _, ip := range ips {
+		want := home[ip]
+		if m, ok := moved[ip]; ok {
+			want = m
+		}
+		if got := first(p, ip); got != want {
+			t.Fatalf("com -sticky-stay, %s foi para %s, esperado %s", ip, got, want)
+		}
+	}
+
+	// De ponta a ponta: as conexões do mesmo IP caem no mesmo TS
+	tsA, commandsA := startFakeTS(t)
+	tsB, commandsB := startFakeTS(t)
+	p, addr := startProxy(t, Config{Targets: []string{tsA, tsB}, Balance: balanceSticky})
+	for i := 0; i < 4; i++ {
+		c := dialProxy(t, addr)
+		c.banner(t)
+		if _, err := c.command("version"); err != nil {
+			t.Fatalf("version: %v", err)
+		}
+	}
+	if a, b := atomic.LoadInt64(commandsA), atomic.LoadInt64(commandsB); a+b != 4 || a != 0 && b != 0 {
+		t.Errorf("comandos por destino = %d, %d; esperado os 4 num só", a, b)
+	}
+	if got := p.Snapshot().StickyClients; got != 1 {
+		t.Errorf("StickyClients = %d, esperado 1", got)
+	}
+}
+
+func TestSRVTargets(t *testing.T) {
+	p := NewProxy(Config{Targets: []string{"127.0.0.1:10011", "srv://_ts3._tcp.example.com"}})
+	records := []*net.SRV{
+		{Target: "ts2.example.com.", Port: 10011, Priority: 10, Weight: 5},
+		{Target: "ts1.example.com.", Port: 10011, Priority: 20, Weight: 5},
+	}
+	var lookupErr error
+	p.lookupSRV = func(name string) ([]*net.SRV, error) {
+		if name != "_ts3._tcp.example.com" {
+			t.Errorf("lookupSRV(%q)", name)
+		}
+		return records, lookupErr
+	}
+	addrs := func(list []*target) []string {
+		var s []string
+		for _, t := range list {
+			s = append(s, t.addr)
+		}
+		return s
+	}
+
+	p.resolveSRV(false)
+	if got := strings.Join(addrs(p.targetList()), ","); got != "127.0.0.1:10011,ts2.example.com:10011,ts1.example.com:10011" {
+		t.Fatalf("destinos = %s", got)
+	}
+	// Prioridade 0 (o fixo) primeiro, depois 10 e 20 como reserva
+	if got := strings.Join(addrs(p.targetOrder(nil, "")), ","); got != "127.0.0.1:10011,ts2.example.com:10011,ts1.example.com:10011" {
+		t.Errorf("ordem = %s", got)
+	}
+
+	// ts1 sai, ts3 entra; ts2 continua o mesmo destino (pool, contadores)
+	ts2 := p.targetList()[1]
+	records = []*net.SRV{
+		{Target: "ts2.example.com.", Port: 10011, Priority: 10},
+		{Target: "ts3.example.com.", Port: 10012, Priority: 10},
+	}
+	p.resolveSRV(true)
+	list := p.targetList()
+	if got := strings.Join(addrs(list), ","); got != "127.0.0.1:10011,ts2.example.com:10011,ts3.example.com:10012" {
+		t.Fatalf("destinos depois da mudança = %s", got)
+	}
+	if list[1] != ts2 {
+		t.Error("ts2 virou um destino novo em vez de ser mantido")
+	}
+
+	// Falha na consulta mantém o último resultado
+	lookupErr = errors.New("SERVFAIL")
+	p.resolveSRV(true)
+	if got := len(p.targetList()); got != 3 {
+		t.Errorf("%d destinos depois da falha de DNS, esperado 3", got)
+	}
+}
+
+func TestCloseConnection(t *testing.T) {
+	tsAddr, _ := startFakeTS(t)
+	p, addr := startProxy(t, Config{Targets: []string{tsAddr}})
+
+	c := dialProxy(t, addr)
+	c.banner(t)
+	other := dialProxy(t, addr)
+	other.banner(t)
+	eventually(t, "2 conexões em /connections", func() bool { return len(p.Connections()) == 2 })
+	id := p.Connections()[0].ID
+
+	closeConn := func(path string) int {
+		w := httptest.NewRecorder()
+		p.handleCloseConnection(w, httptest.NewRequest(http.MethodPost, path, nil))
+		return w.Code
+	}
+	if code := closeConn("/connections/999/close"); code != http.StatusNotFound {
+		t.Errorf("id inexistente: %d, esperado 404", code)
+	}
+	if code := closeConn(fmt.Sprintf("/connections/%d/close", id)); code != http.StatusOK {
+		t.Fatalf("POST /connections/%d/close = %d", id, code)
+	}
+	if line := c.firstLine(t); line != `error id=1 msg=closed\sby\sadministrator` {
+		t.Fatalf("conexão fechada recebeu %q", line)
+	}
+	if _, err := c.reader.ReadByte(); err != io.EOF && !isConnReset(err) {
+		t.Errorf("conexão não foi fechada: %v", err)
+	}
+
+	// A outra segue normal
+	if _, err := other.command("version"); err != nil {
+		t.Fatalf("outra conexão: %v", err)
+	}
+	if got := p.Snapshot().ClosedByAdmin; got != 1 {
+		t.Errorf("ClosedByAdmin = %d, esperado 1", got)
+	}
+}
+
+func TestCloseGrace(t *testing.T) {
+	const (
+		grace = 300 * time.Millisecond
+		fast  = 50 * time.Millisecond // resposta que termina dentro do prazo
+		slow  = time.Second           // resposta que passa dele
+	)
+	tsAddr := startFakeTSWith(t, func(conn net.Conn) {
+		io.WriteString(conn, fakeBanner)
+		reader := bufio.NewReader(conn)
+		for {
+			line, err := readLine(reader)
+			if err != nil {
+				return
+			}
+			switch commandVerb(line) {
+			case "clientlist":
+				time.Sleep(fast)
+			case "logview":
+				time.Sleep(slow)
+			}
+			if _, err := io.WriteString(conn, "clid=1 client_nickname=serveradmin\n\rerror id=0 msg=ok\n\r"); err != nil {
+				return
+			}
+		}
+	})
+	p, addr := startProxy(t, Config{Targets: []string{tsAddr}, CloseGrace: grace})
+
+	// Fecha a conexão do cliente assim que o comando dele estiver pendente
+	kick := func(c *testClient, cmd string) time.Duration {
+		t.Helper()
+		c.banner(t)
+		io.WriteString(c.conn, cmd+"\n")
+		var ac *activeConn
+		eventually(t, cmd+" pendente", func() bool {
+			conns := p.Connections()
+			if len(conns) != 1 {
+				return false
+			}
+			ac = p.findConn(conns[0].ID)
+			return ac != nil && ac.pending.len() > 0
+		})
+		start := time.Now()
+		if !p.CloseConnection(ac.id) {
+			t.Fatalf("CloseConnection(%d) = false", ac.id)
+		}
+		eventually(t, "conexão fora de /connections", func() bool { return len(p.Connections()) == 0 })
+		return time.Since(start)
+	}
+
+	// Resposta dentro do prazo: chega inteira, e só depois o aviso
+	c := dialProxy(t, addr)
+	if took := kick(c, "clientlist"); took >= grace {
+		t.Errorf("fechamento levou %v, esperado fechar logo depois da resposta", took)
+	}
+	if response, err := c.response(); err != nil || len(response) != 2 {
+		t.Fatalf("clientlist = %q, %v; esperado a resposta inteira", response, err)
+	}
+	if line := c.firstLine(t); line != `error id=1 msg=closed\sby\sadministrator` {
+		t.Fatalf("depois da resposta veio %q", line)
+	}
+
+	// TS travado: o -close-grace é o teto, e a conexão fecha no meio
+	c = dialProxy(t, addr)
+	if took := kick(c, "logview"); took < grace || took >= slow {
+		t.Errorf("fechamento levou %v, esperado o -close-grace (%v)", took, grace)
+	}
+	if line := c.firstLine(t); line != `error id=1 msg=closed\sby\sadministrator` {
+		t.Fatalf("conexão forçada recebeu %q", line)
+	}
+	if got := p.Snapshot().ClosedByAdmin; got != 2 {
+		t.Errorf("ClosedByAdmin = %d, esperado 2", got)
+	}
+
+	// -idle-timeout com o TS lento: a resposta chega antes do fechamento
+	_, addr = startProxy(t, Config{Targets: []string{tsAddr}, IdleTimeout: 20 * time.Millisecond, CloseGrace: slow})
+	c = dialProxy(t, addr)
+	c.banner(t)
+	if response, err := c.command("clientlist"); err != nil || len(response) != 2 {
+		t.Fatalf("clientlist com -idle-timeout = %q, %v; esperado a resposta inteira", response, err)
+	}
+	if _, err := c.reader.ReadByte(); err != io.EOF && !isConnReset(err) {
+		t.Errorf("conexão ociosa não foi fechada: %v", err)
+	}
+}
+
+// Linhas vêm direto da rede: o parse não pode entrar em pânico com nada, e
+// o escape precisa voltar igual. go test -fuzz FuzzParseCommand para rodar
+// além das sementes.
+func FuzzParseCommand(f *testing.F) {
+	for _, seed := range []string{
+		"login serveradmin s3cr3t\n",
+		"login client_login_name=bot_musica client_login_password=a\\/b\\sc\n",
+		"use sid=1\n\r",
+		"clientlist -uid -away -voice\n",
+		"clientkick reasonid=5 reasonmsg=Saia\\sdaqui clid=1|clid=2\n",
+		"clientupdate client_nickname=Bot\\sde\\sM\\p\\s\\\\\n",
+		"servernotifyregister event=textchannel id=3\n",
+		"sendtextmessage targetmode=2 target=1 msg=linha1\\nlinha2\n",
+		"error id=0 msg=ok\n\r",
+		"quit",
+		"login a\\",
+		"login =x\n",
+		"ban\\x bad\\q\n",
+		"\r\rversion\x00\n",
+		"",
+	} {
+		f.Add([]byte(seed))
+	}
+
+	f.Fuzz(func(t *testing.T, line []byte) {
+		cmd, err := parseCommand(line)
+		if err != nil {
+			if !errors.Is(err, ErrMalformedCommand) {
+				t.Fatalf("parseCommand(%q): erro %v não envolve ErrMalformedCommand", line, err)
+			}
+		} else if cmd.Name == "" || cmd.Name != strings.ToLower(cmd.Name) {
+			t.Fatalf("parseCommand(%q): nome %q vazio ou fora de minúsculas", line, cmd.Name)
+		}
+		commandVerb(line)
+		clientIdentity(line)
+
+		s := string(line)
+		got, err := tsUnescape(tsEscape(s))
+		if err != nil || got != s {
+			t.Fatalf("tsUnescape(tsEscape(%q)) = %q, %v", s, got, err)
+		}
+	})
+}
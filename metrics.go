@@ -0,0 +1,241 @@
+// Métricas no formato de exposição texto do Prometheus (/metrics).
+// Escrito à mão para manter o binário sem dependências externas.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Limites superiores (segundos) dos buckets de latência por comando
+var latencyBuckets = []float64{
+	0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10,
+}
+
+// Histograma de latência sem lock: cada Observe só faz atomic.Add
+type latencyHistogram struct {
+	counts []uint64 // por bucket, não cumulativo (+Inf no último)
+	count  uint64
+	sumNs  uint64
+}
+
+func newLatencyHistogram() *latencyHistogram {
+	return &latencyHistogram{counts: make([]uint64, len(latencyBuckets)+1)}
+}
+
+func (h *latencyHistogram) Observe(d time.Duration) {
+	secs := d.Seconds()
+	i := 0
+	for i < len(latencyBuckets) && secs > latencyBuckets[i] {
+		i++
+	}
+	atomic.AddUint64(&h.counts[i], 1)
+	atomic.AddUint64(&h.count, 1)
+	atomic.AddUint64(&h.sumNs, uint64(d))
+}
+
+// Escreve o histograma com buckets cumulativos, como o Prometheus espera
+func (h *latencyHistogram) writeProm(w io.Writer, name, labels string) {
+	var cumulative uint64
+	for i, le := range latencyBuckets {
+		cumulative += atomic.LoadUint64(&h.counts[i])
+		fmt.Fprintf(w, "%s_bucket{%s,le=\"%g\"} %d\n", name, labels, le, cumulative)
+	}
+	cumulative += atomic.LoadUint64(&h.counts[len(latencyBuckets)])
+	fmt.Fprintf(w, "%s_bucket{%s,le=\"+Inf\"} %d\n", name, labels, cumulative)
+	fmt.Fprintf(w, "%s_sum{%s} %g\n", name, labels, time.Duration(atomic.LoadUint64(&h.sumNs)).Seconds())
+	fmt.Fprintf(w, "%s_count{%s} %d\n", name, labels, atomic.LoadUint64(&h.count))
+}
+
+// Limites superiores (bytes) dos buckets de tamanho de resposta
+var sizeBuckets = []float64{
+	256, 1 << 10, 4 << 10, 16 << 10, 64 << 10, 256 << 10, 1 << 20, 4 << 20, 16 << 20, 64 << 20,
+}
+
+// Histograma do tamanho das respostas do TS, como o de latência
+type sizeHistogram struct {
+	counts []uint64 // por bucket, não cumulativo (+Inf no último)
+	count  uint64
+	sum    uint64
+}
+
+func newSizeHistogram() *sizeHistogram {
+	return &sizeHistogram{counts: make([]uint64, len(sizeBuckets)+1)}
+}
+
+func (h *sizeHistogram) Observe(n int) {
+	i := 0
+	for i < len(sizeBuckets) && float64(n) > sizeBuckets[i] {
+		i++
+	}
+	atomic.AddUint64(&h.counts[i], 1)
+	atomic.AddUint64(&h.count, 1)
+	atomic.AddUint64(&h.sum, uint64(n))
+}
+
+func (h *sizeHistogram) writeProm(w io.Writer, name, labels string) {
+	var cumulative uint64
+	for i, le := range sizeBuckets {
+		cumulative += atomic.LoadUint64(&h.counts[i])
+		fmt.Fprintf(w, "%s_bucket{%s,le=\"%g\"} %d\n", name, labels, le, cumulative)
+	}
+	cumulative += atomic.LoadUint64(&h.counts[len(sizeBuckets)])
+	fmt.Fprintf(w, "%s_bucket{%s,le=\"+Inf\"} %d\n", name, labels, cumulative)
+	fmt.Fprintf(w, "%s_sum{%s} %d\n", name, labels, atomic.LoadUint64(&h.sum))
+	fmt.Fprintf(w, "%s_count{%s} %d\n", name, labels, atomic.LoadUint64(&h.count))
+}
+
+// Comando enviado ao TS ainda sem resposta
+type pendingCommand struct {
+	sent     time.Time
+	verb     string       // nome do comando, para o tempo por comando em /stats
+	cacheKey string       // resposta vai para o cache (vazio = não cacheável)
+	scope    *scopeChange // login ou "use": muda o escopo do cache se o TS aceitar
+	internal bool         // keepalive ou -origin-command do proxy: a resposta não vai para o cliente
+}
+
+// Comandos que ainda não tiveram resposta em uma conexão. O ServerQuery
+// responde em ordem e toda resposta termina com uma linha "error id=...",
+// então a resposta mais antiga é a do primeiro comando da fila.
+type pendingCommands struct {
+	mu    sync.Mutex
+	items []pendingCommand
+	empty chan struct{} // fechado quando a fila esvazia (criado sob demanda)
+}
+
+// Canal já fechado, para quem espera uma fila que já está vazia
+var closedChan = func() chan struct{} {
+	ch := make(chan struct{})
+	close(ch)
+	return ch
+}()
+
+func (q *pendingCommands) push(c pendingCommand) {
+	q.mu.Lock()
+	q.items = append(q.items, c)
+	q.mu.Unlock()
+}
+
+func (q *pendingCommands) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.items)
+}
+
+// Comando mais antigo da fila, sem tirar
+func (q *pendingCommands) peek() (pendingCommand, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.items) == 0 {
+		return pendingCommand{}, false
+	}
+	return q.items[0], true
+}
+
+func (q *pendingCommands) pop() (pendingCommand, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.items) == 0 {
+		return pendingCommand{}, false
+	}
+	c := q.items[0]
+	// Desloca em vez de fatiar, para o append reaproveitar o array
+	n := copy(q.items, q.items[1:])
+	q.items[n] = pendingCommand{}
+	q.items = q.items[:n]
+	if len(q.items) == 0 && q.empty != nil {
+		close(q.empty)
+		q.empty = nil
+	}
+	return c, true
+}
+
+// Canal que fecha quando todas as respostas pendentes tiverem chegado
+func (q *pendingCommands) whenEmpty() <-chan struct{} {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.items) == 0 {
+		return closedChan
+	}
+	if q.empty == nil {
+		q.empty = make(chan struct{})
+	}
+	return q.empty
+}
+
+// Linha que encerra a resposta de um comando
+func isErrorLine(line []byte) bool {
+	return bytes.HasPrefix(bytes.TrimLeft(line, "\r"), []byte("error id="))
+}
+
+// Evento assíncrono (servernotifyregister), fora da resposta de qualquer comando
+func isNotifyLine(line []byte) bool {
+	return bytes.HasPrefix(bytes.TrimLeft(line, "\r"), []byte("notify"))
+}
+
+// Escape de valores de label no formato texto do Prometheus
+var promLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func (p *Proxy) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "método não permitido", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+	// Uma série por destino, com target="host:porta": o label não muda com
+	// o -target nem com o SRV, e dá para somar ou filtrar no Prometheus
+	targets, snaps := p.targetList(), p.targetSnapshots()
+	label := func(addr string) string {
+		return fmt.Sprintf(`target="%s"`, promLabelEscaper.Replace(addr))
+	}
+	perTarget := func(name string, value func(TargetSnapshot) any) {
+		for _, t := range snaps {
+			fmt.Fprintf(w, "%s{%s} %v\n", name, label(t.Addr), value(t))
+		}
+	}
+
+	fmt.Fprintf(w, "# HELP batqa_connections_total Conexões de clientes repassadas ao destino.\n")
+	fmt.Fprintf(w, "# TYPE batqa_connections_total counter\n")
+	perTarget("batqa_connections_total", func(t TargetSnapshot) any { return t.TotalConnections })
+
+	fmt.Fprintf(w, "# HELP batqa_active_connections Conexões de clientes abertas agora, por destino.\n")
+	fmt.Fprintf(w, "# TYPE batqa_active_connections gauge\n")
+	perTarget("batqa_active_connections", func(t TargetSnapshot) any { return t.ActiveConnections })
+
+	fmt.Fprintf(w, "# HELP batqa_commands_total Comandos repassados ao TeamSpeak, por destino.\n")
+	fmt.Fprintf(w, "# TYPE batqa_commands_total counter\n")
+	perTarget("batqa_commands_total", func(t TargetSnapshot) any { return t.TotalCommands })
+
+	fmt.Fprintf(w, "# HELP batqa_bytes_total Bytes repassados nas duas direções, por destino.\n")
+	fmt.Fprintf(w, "# TYPE batqa_bytes_total counter\n")
+	perTarget("batqa_bytes_total", func(t TargetSnapshot) any { return t.TotalBytes })
+
+	fmt.Fprintf(w, "# HELP batqa_target_up Destino saudável no último health check (1) ou não (0).\n")
+	fmt.Fprintf(w, "# TYPE batqa_target_up gauge\n")
+	perTarget("batqa_target_up", func(t TargetSnapshot) any {
+		if t.Healthy {
+			return 1
+		}
+		return 0
+	})
+
+	fmt.Fprintf(w, "# HELP batqa_command_latency_seconds Tempo entre enviar o comando ao TeamSpeak e receber o \"error id=\" da resposta.\n")
+	fmt.Fprintf(w, "# TYPE batqa_command_latency_seconds histogram\n")
+	for _, t := range targets {
+		t.cmdHist.writeProm(w, "batqa_command_latency_seconds", label(t.addr))
+	}
+
+	fmt.Fprintf(w, "# HELP batqa_response_size_bytes Tamanho da resposta do TeamSpeak a cada comando, até o \"error id=\" (sem notificações).\n")
+	fmt.Fprintf(w, "# TYPE batqa_response_size_bytes histogram\n")
+	for _, t := range targets {
+		t.sizeHist.writeProm(w, "batqa_response_size_bytes", label(t.addr))
+	}
+}
@@ -0,0 +1,225 @@
+// Pool de conexões pré-abertas com o TeamSpeak (-pool-size). Cada conexão
+// do pool já passou pelo banner e, opcionalmente, pelo login e pelo use
+// configurados, então o cliente não espera nem o handshake TCP local.
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Comando do -ts-keepalive: inofensivo, não muda nada na sessão
+const keepaliveCommand = "version\n"
+
+// Conexão do pool junto com o banner que o TS enviou ao abri-la, reenviado
+// a cada cliente que a usar
+type pooledConn struct {
+	conn   net.Conn
+	banner []byte
+}
+
+type connPool struct {
+	dial    func() (net.Conn, error)
+	setup   []string // comandos do handshake (login, use), já escapados
+	timeout time.Duration
+	idle    chan *pooledConn
+	log     *Logger
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func newConnPool(size int, dial func() (net.Conn, error), setup []string, timeout time.Duration, logger *Logger) *connPool {
+	cp := &connPool{
+		dial:    dial,
+		setup:   setup,
+		timeout: timeout,
+		idle:    make(chan *pooledConn, size),
+		log:     logger,
+		closed:  make(chan struct{}),
+	}
+	return cp
+}
+
+// Enche o pool em background
+func (cp *connPool) fill() {
+	for i := 0; i < cap(cp.idle); i++ {
+		go cp.refill()
+	}
+}
+
+// Abre uma conexão nova e a coloca no pool, se houver espaço
+func (cp *connPool) refill() {
+	pc, err := cp.open()
+	if err != nil {
+		cp.log.Errorf("❌ Pool: %v", err)
+		return
+	}
+	cp.put(pc)
+}
+
+// Pega uma conexão do pool (ou abre uma na hora, se estiver vazio)
+func (cp *connPool) get() (*pooledConn, error) {
+	select {
+	case pc := <-cp.idle:
+		return pc, nil
+	default:
+		return cp.open()
+	}
+}
+
+// Descarta uma conexão que não pode voltar ao pool e repõe outra em
+// background
+func (cp *connPool) discard(pc *pooledConn) {
+	pc.conn.Close()
+	select {
+	case <-cp.closed:
+	default:
+		go cp.refill()
+	}
+}
+
+// Devolve uma conexão limpa ao pool; se estiver cheio ou fechado, descarta
+func (cp *connPool) put(pc *pooledConn) {
+	select {
+	case <-cp.closed:
+		pc.conn.Close()
+		return
+	default:
+	}
+
+	select {
+	case cp.idle <- pc:
+	default:
+		pc.conn.Close()
+	}
+}
+
+// Fecha o pool e as conexões ociosas
+func (cp *connPool) close() {
+	cp.closeOnce.Do(func() {
+		close(cp.closed)
+		for {
+			select {
+			case pc := <-cp.idle:
+				pc.conn.Close()
+			default:
+				return
+			}
+		}
+	})
+}
+
+// Conecta e faz o handshake configurado
+func (cp *connPool) open() (*pooledConn, error) {
+	conn, err := cp.dial()
+	if err != nil {
+		return nil, err
+	}
+	return handshake(conn, cp.timeout, cp.setup)
+}
+
+// Consome o banner e envia os comandos de setup (login, use), exigindo
+// "error id=0" em cada um; as respostas não chegam a nenhum cliente. Em
+// caso de falha a conexão é fechada.
+func handshake(conn net.Conn, timeout time.Duration, setup []string) (*pooledConn, error) {
+	conn.SetDeadline(time.Now().Add(timeout))
+	reader := bufio.NewReader(conn)
+
+	banner, err := readBanner(reader)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("erro ao ler banner: %w", err)
+	}
+
+	for _, cmd := range setup {
+		verb := commandVerb([]byte(cmd))
+		if _, err := conn.Write([]byte(cmd)); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("erro ao enviar %s: %w", verb, err)
+		}
+		response, err := readResponse(reader)
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("erro ao ler resposta do %s: %w", verb, err)
+		}
+		if last := response[len(response)-1]; !strings.HasPrefix(last, "error id=0 ") {
+			conn.Close()
+			return nil, fmt.Errorf("%s recusado: %s", verb, last)
+		}
+	}
+
+	// Nada pode ter sobrado no buffer: quem usar a conexão cria o próprio reader
+	if reader.Buffered() > 0 {
+		conn.Close()
+		return nil, errors.New("dados inesperados após o handshake")
+	}
+
+	conn.SetDeadline(time.Time{})
+	return &pooledConn{conn: conn, banner: banner}, nil
+}
+
+// -ts-keepalive: a cada intervalo, as conexões paradas no pool mandam um
+// "version" para o TS não derrubá-las por ociosidade. Uma por vez; a
+// conexão que não responder é trocada por outra. O intervalo varia em
+// ±jitterPct% a cada volta. Roda até o pool fechar.
+func (cp *connPool) keepalive(interval time.Duration, jitterPct int, sent *uint64) {
+	for {
+		select {
+		case <-time.After(jitter(interval, jitterPct)):
+		case <-cp.closed:
+			return
+		}
+
+		// Só as que já estavam no pool neste instante (as devolvidas durante
+		// a volta ficam para a próxima)
+		for n := len(cp.idle); n > 0; n-- {
+			var pc *pooledConn
+			select {
+			case pc = <-cp.idle:
+			default:
+			}
+			if pc == nil {
+				break
+			}
+			if err := cp.ping(pc); err != nil {
+				cp.log.Warnf("⚠️  Pool: keepalive falhou, trocando a conexão: %v", err)
+				cp.discard(pc)
+				continue
+			}
+			atomic.AddUint64(sent, 1)
+			cp.put(pc)
+		}
+	}
+}
+
+// Manda o comando do keepalive e consome a resposta, exigindo "error id=0"
+func (cp *connPool) ping(pc *pooledConn) error {
+	conn := pc.conn
+	conn.SetDeadline(time.Now().Add(cp.timeout))
+	reader := bufio.NewReader(conn)
+
+	if _, err := conn.Write([]byte(keepaliveCommand)); err != nil {
+		return err
+	}
+	response, err := readResponse(reader)
+	if err != nil {
+		return err
+	}
+	if last := response[len(response)-1]; !strings.HasPrefix(last, "error id=0 ") {
+		return fmt.Errorf("version recusado: %s", last)
+	}
+	if reader.Buffered() > 0 {
+		return errors.New("dados inesperados após o keepalive")
+	}
+
+	conn.SetDeadline(time.Time{})
+	return nil
+}
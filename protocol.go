@@ -0,0 +1,153 @@
+// Leitura de linhas e respostas no protocolo ServerQuery, compartilhada
+// pelo proxy, pelo pool e pelo modo replay.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// Quantas linhas de banner aceitar antes de desistir de achar o "Welcome"
+const maxBannerLines = 5
+
+// Linha maior que o limite (-max-command-size/-max-response-size)
+var ErrLineTooLong = errors.New("linha maior que o limite")
+
+// Lê uma linha do ServerQuery. O TS termina as linhas com "\n\r": o '\r'
+// depois do '\n' é consumido junto, se já estiver no buffer, para não
+// ficar preso esperando a próxima linha.
+func readLine(reader *bufio.Reader) ([]byte, error) {
+	return readLineBuf(reader, nil, 0)
+}
+
+// Como readLine, mas monta a linha em buf em vez de alocar uma nova a cada
+// chamada. A linha devolvida usa a memória de buf: só vale até a próxima
+// leitura com o mesmo buf. Com max > 0, uma linha maior que max bytes
+// (contando o terminador) dá ErrLineTooLong sem ser lida até o fim, e a
+// memória usada fica limitada a max mais o tamanho do buffer do reader.
+func readLineBuf(reader *bufio.Reader, buf []byte, max int) ([]byte, error) {
+	line := buf[:0]
+	for {
+		frag, err := reader.ReadSlice('\n')
+		line = append(line, frag...)
+		if max > 0 && len(line) > max {
+			return line, ErrLineTooLong
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			return line, err
+		}
+		break
+	}
+	if reader.Buffered() > 0 {
+		if next, _ := reader.Peek(1); next[0] == '\r' {
+			reader.ReadByte()
+			line = append(line, '\r')
+		}
+	}
+	return line, nil
+}
+
+// Consome o banner do ServerQuery e devolve os bytes lidos, para reenviar
+// a quem precisar. TeamSpeak e TeaSpeak mandam "TS3" e depois uma linha
+// "Welcome to the ... ServerQuery interface, ..."; o banner termina na
+// primeira linha que começa com "Welcome", procurada nas primeiras
+// maxBannerLines linhas. O TS não manda mais nada até o primeiro comando,
+// então um banner sem "Welcome" só dá erro no timeout da leitura.
+func readBanner(reader *bufio.Reader) ([]byte, error) {
+	var banner []byte
+	for i := 0; i < maxBannerLines; i++ {
+		line, err := readLine(reader)
+		if err != nil {
+			return nil, err
+		}
+		banner = append(banner, line...)
+		if strings.HasPrefix(trimLine(string(line)), "Welcome") {
+			return banner, nil
+		}
+	}
+	return nil, fmt.Errorf("banner não reconhecido")
+}
+
+// Lê as linhas de uma resposta até o "error id=..." que a encerra. Eventos
+// (notify*) que chegarem no meio não são parte da resposta e ficam de fora.
+func readResponse(reader *bufio.Reader) ([]string, error) {
+	var lines []string
+	for {
+		line, err := readLine(reader)
+		if err != nil {
+			return lines, err
+		}
+		text := trimLine(string(line))
+		if text == "" || isNotifyLine(line) {
+			continue
+		}
+		lines = append(lines, text)
+		if strings.HasPrefix(text, "error id=") {
+			return lines, nil
+		}
+	}
+}
+
+// Remove o terminador "\n\r" (e o '\r' que sobra da linha anterior)
+func trimLine(line string) string {
+	return strings.Trim(line, "\r\n")
+}
+
+// Nome do comando (o que vem antes do primeiro espaço), em minúsculas
+func commandVerb(line []byte) string {
+	line = bytes.TrimSpace(line)
+	if i := bytes.IndexByte(line, ' '); i >= 0 {
+		line = line[:i]
+	}
+
+	// Verbos curtos passam pelo cache, sem alocar uma string por comando
+	var lower [maxInternedVerb]byte
+	if len(line) > len(lower) {
+		return strings.ToLower(string(line))
+	}
+	for i, c := range line {
+		if 'A' <= c && c <= 'Z' {
+			c += 'a' - 'A'
+		}
+		lower[i] = c
+	}
+	return internVerb(lower[:len(line)])
+}
+
+// Tamanho máximo e quantidade de verbos guardados pelo internVerb
+const (
+	maxInternedVerb = 32
+	maxVerbs        = 1024
+)
+
+var (
+	verbsMu sync.RWMutex
+	verbs   = make(map[string]string)
+)
+
+// Devolve a string do verbo, reaproveitando a de chamadas anteriores. O
+// cache para de crescer em maxVerbs, para lixo do cliente não encher a memória.
+func internVerb(b []byte) string {
+	verbsMu.RLock()
+	verb, ok := verbs[string(b)]
+	verbsMu.RUnlock()
+	if ok {
+		return verb
+	}
+
+	verb = string(b)
+	verbsMu.Lock()
+	if len(verbs) < maxVerbs {
+		verbs[verb] = verb
+	}
+	verbsMu.Unlock()
+	return verb
+}
@@ -0,0 +1,143 @@
+// PROXY protocol (v1 texto e v2 binário) na ponta dos clientes
+// (-proxy-protocol), para quem usa HAProxy/nginx na frente do proxy: o
+// endereço real do cliente vem no cabeçalho, não no TCP.
+// Formato: https://www.haproxy.org/download/2.8/doc/proxy-protocol.txt
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var ErrProxyHeader = errors.New("cabeçalho PROXY inválido")
+
+// Assinatura do cabeçalho v2
+var proxyV2Sig = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// Tamanho máximo de um cabeçalho v1, com o "\r\n"
+const proxyV1MaxLen = 107
+
+// Conexão com o endereço do cliente tirado do cabeçalho PROXY. O que veio
+// no mesmo segmento depois do cabeçalho fica no reader.
+type proxyConn struct {
+	net.Conn
+	r      *bufio.Reader
+	remote net.Addr
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) { return c.r.Read(b) }
+func (c *proxyConn) RemoteAddr() net.Addr       { return c.remote }
+
+// Lê o cabeçalho PROXY do início da conexão, com prazo de timeout.
+// Sem cabeçalho ou com cabeçalho malformado, retorna erro.
+func readProxyHeader(conn net.Conn, timeout time.Duration) (*proxyConn, error) {
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	r := bufio.NewReader(conn)
+	sig, err := r.Peek(len(proxyV2Sig))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrProxyHeader, err)
+	}
+
+	var remote net.Addr
+	switch {
+	case bytes.Equal(sig, proxyV2Sig):
+		remote, err = parseProxyV2(r)
+	case bytes.HasPrefix(sig, []byte("PROXY ")):
+		remote, err = parseProxyV1(r)
+	default:
+		err = fmt.Errorf("%w: conexão sem cabeçalho", ErrProxyHeader)
+	}
+	if err != nil {
+		return nil, err
+	}
+	// LOCAL/UNKNOWN (health check do balanceador): fica o endereço do TCP
+	if remote == nil {
+		remote = conn.RemoteAddr()
+	}
+	return &proxyConn{Conn: conn, r: r, remote: remote}, nil
+}
+
+// "PROXY TCP4 192.0.2.1 198.51.100.1 51234 10012\r\n"
+func parseProxyV1(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for len(line) < proxyV1MaxLen {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrProxyHeader, err)
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, fmt.Errorf("%w: v1 sem \\r\\n em %d bytes", ErrProxyHeader, proxyV1MaxLen)
+	}
+
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("%w: v1 %q", ErrProxyHeader, line)
+	}
+	ip := net.ParseIP(fields[2])
+	if ip == nil || (fields[1] == "TCP4") != (ip.To4() != nil) {
+		return nil, fmt.Errorf("%w: v1 IP de origem %q", ErrProxyHeader, fields[2])
+	}
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("%w: v1 porta de origem %q", ErrProxyHeader, fields[4])
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// Assinatura, versão/comando, família/transporte, tamanho e endereços
+func parseProxyV2(r *bufio.Reader) (net.Addr, error) {
+	var hdr [16]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrProxyHeader, err)
+	}
+	if hdr[12]>>4 != 2 {
+		return nil, fmt.Errorf("%w: v2 versão %d", ErrProxyHeader, hdr[12]>>4)
+	}
+	cmd := hdr[12] & 0x0f
+	if cmd > 1 {
+		return nil, fmt.Errorf("%w: v2 comando %d", ErrProxyHeader, cmd)
+	}
+
+	body := make([]byte, binary.BigEndian.Uint16(hdr[14:16]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrProxyHeader, err)
+	}
+	if cmd == 0 { // LOCAL
+		return nil, nil
+	}
+
+	// Endereços de origem; o resto (destino, TLVs) não interessa
+	switch hdr[13] >> 4 {
+	case 1: // AF_INET
+		if len(body) < 12 {
+			return nil, fmt.Errorf("%w: v2 endereço IPv4 curto", ErrProxyHeader)
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(binary.BigEndian.Uint16(body[8:10]))}, nil
+	case 2: // AF_INET6
+		if len(body) < 36 {
+			return nil, fmt.Errorf("%w: v2 endereço IPv6 curto", ErrProxyHeader)
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(binary.BigEndian.Uint16(body[32:34]))}, nil
+	default: // AF_UNSPEC, AF_UNIX
+		return nil, nil
+	}
+}
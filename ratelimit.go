@@ -0,0 +1,205 @@
+// Rate limit de conexões por IP (-conn-rate): um token bucket por IP,
+// com limpeza periódica dos IPs que pararam de conectar (no runCleanup do
+// proxy, junto com os banimentos vencidos).
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// -rate-mode: o que acontece com a conexão acima do -conn-rate ou do
+// -global-conn-rate
+const (
+	rateModeDrop  = "drop"  // recusada na hora
+	rateModeDelay = "delay" // segurada até o próximo token (até -rate-max-wait)
+)
+
+// Janela padrão do -conn-rate (-rate-window): N conexões por segundo
+const defaultRateWindow = time.Second
+
+// -rate-limit é o nome antigo do -conn-rate e vale quando só ele foi
+// passado. Os dois com valores diferentes é erro: não dá para saber qual
+// o operador quis.
+func resolveConnRate(connRate, rateLimit int) (int, error) {
+	switch {
+	case rateLimit == 0:
+		return connRate, nil
+	case connRate == 0 || connRate == rateLimit:
+		return rateLimit, nil
+	default:
+		return 0, fmt.Errorf("-conn-rate %d e -rate-limit %d: use só o -conn-rate", connRate, rateLimit)
+	}
+}
+
+// Estado de um IP: tokens disponíveis e instante da última recarga
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// Limita cada IP a `limit` conexões por `window`, com rajada de `limit`
+type RateLimiter struct {
+	mu      sync.Mutex
+	limit   float64
+	rate    float64 // tokens por segundo
+	window  time.Duration
+	buckets map[string]*bucket
+}
+
+func NewRateLimiter(limit int, window time.Duration) *RateLimiter {
+	rl := &RateLimiter{
+		limit:   float64(limit),
+		rate:    float64(limit) / window.Seconds(),
+		window:  window,
+		buckets: make(map[string]*bucket),
+	}
+	return rl
+}
+
+// Consome um token do IP se houver. O(1) e sem alocação para IPs já
+// conhecidos; só um IP novo aloca o seu bucket.
+func (rl *RateLimiter) Allow(ip string) bool {
+	_, ok := rl.Reserve(ip, 0)
+	return ok
+}
+
+// Como Allow, mas sem token disponível reserva o próximo (o saldo do IP
+// fica negativo) e devolve quanto esperar por ele (-rate-mode delay). Se
+// a espera passar de maxWait, não reserva nada e devolve false.
+func (rl *RateLimiter) Reserve(ip string, maxWait time.Duration) (time.Duration, bool) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	now := time.Now()
+	b, ok := rl.buckets[ip]
+	if !ok {
+		b = &bucket{tokens: rl.limit, last: now}
+		rl.buckets[ip] = b
+	} else {
+		b.tokens += now.Sub(b.last).Seconds() * rl.rate
+		if b.tokens > rl.limit {
+			b.tokens = rl.limit
+		}
+		b.last = now
+	}
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return 0, true
+	}
+	wait := time.Duration((1 - b.tokens) / rl.rate * float64(time.Second))
+	if wait > maxWait {
+		return 0, false
+	}
+	b.tokens--
+	return wait, true
+}
+
+// Devolve o token de um Reserve que acabou não sendo usado (a conexão foi
+// recusada por outro limite depois de passar por este)
+func (rl *RateLimiter) Refund(ip string) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	if b, ok := rl.buckets[ip]; ok {
+		b.tokens++
+		if b.tokens > rl.limit {
+			b.tokens = rl.limit
+		}
+	}
+}
+
+// Remove os IPs parados há uma janela inteira: o bucket já estaria cheio,
+// então esquecê-lo não muda nada (um IP ainda pagando reservas do
+// -rate-mode delay fica até o saldo voltar)
+func (rl *RateLimiter) sweep() {
+	rl.mu.Lock()
+	now := time.Now()
+	for ip, b := range rl.buckets {
+		idle := now.Sub(b.last)
+		if idle >= rl.window && b.tokens+idle.Seconds()*rl.rate >= rl.limit {
+			delete(rl.buckets, ip)
+		}
+	}
+	rl.mu.Unlock()
+}
+
+// Limpeza periódica dos IPs do -conn-rate, dos banimentos vencidos do
+// -ban-threshold e dos IPs esquecidos do -balance sticky, num laço só: a cada janela do rate limit (ou do ban, se
+// for menor), com -jitter para instâncias iguais não limparem juntas.
+// Roda até o Stop().
+func (p *Proxy) runCleanup() {
+	interval := p.config.RateWindow
+	if p.bans != nil && p.config.BanWindow < interval {
+		interval = p.config.BanWindow
+	}
+	for {
+		select {
+		case <-time.After(jitter(interval, p.config.JitterPct)):
+		case <-p.shutdown:
+			return
+		}
+
+		// O limiter pode ter mudado num SIGHUP
+		if rl := p.live.Load().rateLimiter; rl != nil {
+			rl.sweep()
+		}
+		if p.bans != nil {
+			p.bans.sweep()
+		}
+		if p.sticky != nil {
+			p.sticky.sweep()
+		}
+	}
+}
+
+// Troca o limite mantendo o estado de cada IP (recarga por SIGHUP)
+func (rl *RateLimiter) SetLimit(limit int) {
+	rl.mu.Lock()
+	rl.limit = float64(limit)
+	rl.rate = float64(limit) / rl.window.Seconds()
+	rl.mu.Unlock()
+}
+
+// Agregação padrão dos endereços (-rate-ipv4-prefix/-rate-ipv6-prefix): o
+// IPv4 sozinho e o /64 do IPv6, que é o que um provedor entrega a um cliente
+const (
+	defaultIPv4Prefix = 32
+	defaultIPv6Prefix = 64
+)
+
+// Chave do rate limit e do -max-conns-per-ip: o IP de origem agregado na
+// rede /v4Prefix ou /v6Prefix. Sem isso, um cliente IPv6 troca de endereço
+// dentro do próprio /64 e ganha uma cota nova a cada troca. Com o prefixo
+// inteiro (/32, /128), é o próprio IP; em socket unix, vazio.
+func ipKey(addr net.Addr, v4Prefix, v6Prefix int) string {
+	a, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return remoteIP(addr)
+	}
+	if ip4 := a.IP.To4(); ip4 != nil {
+		if v4Prefix >= 8*net.IPv4len {
+			return ip4.String()
+		}
+		return fmt.Sprintf("%s/%d", ip4.Mask(net.CIDRMask(v4Prefix, 8*net.IPv4len)), v4Prefix)
+	}
+	if v6Prefix >= 8*net.IPv6len {
+		return a.IP.String()
+	}
+	return fmt.Sprintf("%s/%d", a.IP.Mask(net.CIDRMask(v6Prefix, 8*net.IPv6len)), v6Prefix)
+}
+
+// IP de origem usado como chave do rate limit
+func remoteIP(addr net.Addr) string {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP.String()
+	case *net.UnixAddr:
+		return "" // socket unix: não há IP
+	}
+	return addr.String()
+}
@@ -0,0 +1,157 @@
+// Recarga da configuração por SIGHUP: max-conns, conn-rate, allow e deny
+// são trocados com o proxy rodando, sem derrubar conexões. O resto só vale
+// depois de reiniciar.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+)
+
+// Parte da configuração que o SIGHUP troca com o proxy rodando. O Proxy
+// guarda um ponteiro atômico; cada recarga publica um liveConfig novo.
+type liveConfig struct {
+	MaxConns    int
+	ConnRate    int
+	Allow       []*net.IPNet
+	Deny        []*net.IPNet
+	rateLimiter *RateLimiter // nil = sem limite por IP
+}
+
+// Flags aplicadas pelo SIGHUP
+var liveFlags = map[string]bool{
+	"max-conns": true, "conn-rate": true, "rate-limit": true, "allow": true, "deny": true,
+}
+
+// Aplica os parâmetros recarregáveis. O RateLimiter existente só tem o
+// limite trocado, mantendo o estado de cada IP.
+func (p *Proxy) Reload(maxConns, connRate int, allow, deny []*net.IPNet) {
+	old := p.live.Load()
+	next := &liveConfig{
+		MaxConns:    maxConns,
+		ConnRate:    connRate,
+		Allow:       allow,
+		Deny:        deny,
+		rateLimiter: old.rateLimiter,
+	}
+
+	switch {
+	case connRate <= 0:
+		next.rateLimiter = nil
+	case old.rateLimiter != nil:
+		old.rateLimiter.SetLimit(connRate)
+	default:
+		next.rateLimiter = NewRateLimiter(connRate, p.config.RateWindow)
+	}
+
+	p.live.Store(next)
+
+	p.log.Infof("🔄 Configuração recarregada: max-conns=%d conn-rate=%d allow=%v deny=%v",
+		maxConns, connRate, allow, deny)
+}
+
+// Relê linha de comando e arquivo e aplica o que pode mudar ao vivo. Com
+// qualquer erro nada é aplicado.
+func (p *Proxy) reloadConfigFile(path string) {
+	values, err := readFlagValues(path)
+	if err != nil {
+		p.log.Errorf("❌ Recarga ignorada: %v", err)
+		return
+	}
+
+	maxConns, err := strconv.Atoi(values["max-conns"])
+	if err != nil || maxConns <= 0 {
+		p.log.Errorf("❌ Recarga ignorada: max-conns inválido %q", values["max-conns"])
+		return
+	}
+	connRate, err := strconv.Atoi(values["conn-rate"])
+	if err != nil || connRate < 0 {
+		p.log.Errorf("❌ Recarga ignorada: conn-rate inválido %q", values["conn-rate"])
+		return
+	}
+	rateLimit, err := strconv.Atoi(values["rate-limit"])
+	if err != nil || rateLimit < 0 {
+		p.log.Errorf("❌ Recarga ignorada: rate-limit inválido %q", values["rate-limit"])
+		return
+	}
+	if connRate, err = resolveConnRate(connRate, rateLimit); err != nil {
+		p.log.Errorf("❌ Recarga ignorada: %v", err)
+		return
+	}
+	allow, err := parseCIDRList(values["allow"])
+	if err != nil {
+		p.log.Errorf("❌ Recarga ignorada: allow: %v", err)
+		return
+	}
+	deny, err := parseCIDRList(values["deny"])
+	if err != nil {
+		p.log.Errorf("❌ Recarga ignorada: deny: %v", err)
+		return
+	}
+
+	// O valor de cada flag na inicialização continua em flag.CommandLine
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if liveFlags[name] {
+			continue
+		}
+		if f := flag.Lookup(name); f != nil && f.Value.String() != values[name] {
+			p.log.Warnf("⚠️  %s foi alterado, mas requer reinício (mantido o valor atual)", name)
+		}
+	}
+
+	p.Reload(maxConns, connRate, allow, deny)
+}
+
+// Valor de flag guardado como texto, para reler a configuração sem
+// alterar as flags do processo
+type textValue struct {
+	text   string
+	isBool bool
+}
+
+func (v *textValue) String() string {
+	if v == nil {
+		return ""
+	}
+	return v.text
+}
+
+func (v *textValue) Set(s string) error {
+	v.text = s
+	return nil
+}
+
+func (v *textValue) IsBoolFlag() bool { return v.isBool }
+
+// Faz de novo o parse da linha de comando e do arquivo num FlagSet espelho
+// de flag.CommandLine e retorna o texto final de cada flag
+func readFlagValues(path string) (map[string]string, error) {
+	fs := flag.NewFlagSet("reload", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	flag.CommandLine.VisitAll(func(f *flag.Flag) {
+		b, ok := f.Value.(interface{ IsBoolFlag() bool })
+		fs.Var(&textValue{text: f.DefValue, isBool: ok && b.IsBoolFlag()}, f.Name, f.Usage)
+	})
+
+	if err := fs.Parse(os.Args[1:]); err != nil {
+		return nil, fmt.Errorf("linha de comando: %w", err)
+	}
+	if err := loadConfigFile(fs, path); err != nil {
+		return nil, err
+	}
+
+	values := make(map[string]string)
+	fs.VisitAll(func(f *flag.Flag) { values[f.Name] = f.Value.String() })
+	return values, nil
+}
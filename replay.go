@@ -0,0 +1,103 @@
+// Modo replay: o binário age como cliente ServerQuery, envia os comandos
+// de um arquivo para o destino e mede a latência de cada um. Serve para
+// validar um servidor e comparar o tempo direto (-target na porta do TS)
+// com o tempo passando pelo proxy (-target na porta do proxy).
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// Configuração do modo replay
+type ReplayConfig struct {
+	File       string
+	TargetAddr string
+	Timeout    time.Duration
+	Delay      time.Duration
+}
+
+// Executa o replay e retorna o código de saída do processo
+func runReplay(cfg ReplayConfig) int {
+	commands, err := readReplayFile(cfg.File)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "❌ Erro ao ler %s: %v\n", cfg.File, err)
+		return 1
+	}
+
+	start := time.Now()
+	conn, err := net.DialTimeout("tcp", cfg.TargetAddr, cfg.Timeout)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "❌ %v: %v\n", ErrTargetUnreachable, err)
+		return 1
+	}
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+	conn.SetDeadline(time.Now().Add(cfg.Timeout))
+	if _, err := readBanner(reader); err != nil {
+		fmt.Fprintf(os.Stderr, "❌ Erro ao ler banner: %v\n", err)
+		return 1
+	}
+	fmt.Printf("🔌 Conectado em %s (%s)\n", cfg.TargetAddr, time.Since(start).Round(time.Microsecond))
+
+	var total time.Duration
+	for i, cmd := range commands {
+		if i > 0 && cfg.Delay > 0 {
+			time.Sleep(cfg.Delay)
+		}
+
+		conn.SetDeadline(time.Now().Add(cfg.Timeout))
+		sent := time.Now()
+		if _, err := fmt.Fprintf(conn, "%s\n", cmd); err != nil {
+			fmt.Fprintf(os.Stderr, "❌ Erro ao enviar %q: %v\n", cmd, err)
+			return 1
+		}
+
+		response, err := readResponse(reader)
+		elapsed := time.Since(sent)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "❌ Erro ao ler resposta de %q: %v\n", cmd, err)
+			return 1
+		}
+		total += elapsed
+
+		fmt.Printf("▶ %s (%s)\n", redactLine(cmd), elapsed.Round(time.Microsecond))
+		for _, line := range response {
+			fmt.Printf("  %s\n", line)
+		}
+	}
+
+	if len(commands) > 0 {
+		fmt.Printf("📊 %d comandos, total %s, média %s\n",
+			len(commands), total.Round(time.Microsecond),
+			(total / time.Duration(len(commands))).Round(time.Microsecond))
+	}
+	return 0
+}
+
+// Lê o arquivo de comandos, um por linha. Linhas vazias e comentários
+// (começando com #) são ignorados.
+func readReplayFile(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var commands []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		commands = append(commands, line)
+	}
+	return commands, scanner.Err()
+}
@@ -0,0 +1,69 @@
+// Descarte de carga por latência (-shed-latency): cada destino guarda uma
+// média móvel do tempo de resposta dos comandos dos clientes. Passando do
+// limite, uma fração das conexões novas para aquele destino é recusada
+// com "server busy", proporcional a quanto a média passou: 1,5x o limite
+// recusa 50%, 1,9x ou mais recusa o máximo de 90%. Os 10% que sempre
+// passam continuam medindo o destino, para o descarte parar quando ele
+// se recuperar.
+
+package main
+
+import (
+	"math/rand"
+	"sync/atomic"
+	"time"
+)
+
+// Fração máxima de conexões recusadas pelo -shed-latency
+const maxShedRate = 0.9
+
+// Sem resposta nenhuma por esse tempo, a média de comandos do destino é
+// considerada velha e não causa descarte
+const shedStaleAfter = 30 * time.Second
+
+// Média de latência dos comandos do destino (0 = sem medida recente)
+func (t *target) commandLatency() time.Duration {
+	if time.Since(time.Unix(0, atomic.LoadInt64(&t.cmdRTTAt))) > shedStaleAfter {
+		return 0
+	}
+	return time.Duration(atomic.LoadInt64(&t.cmdRTT))
+}
+
+// Soma o tempo de resposta de um comando à média (mesmo peso do health
+// check); uma média velha recomeça da medida nova. Várias conexões
+// escrevem ao mesmo tempo: CAS em vez de lock.
+func (t *target) observeCommandLatency(rtt time.Duration) {
+	stale := time.Since(time.Unix(0, atomic.LoadInt64(&t.cmdRTTAt))) > shedStaleAfter
+	for {
+		old := atomic.LoadInt64(&t.cmdRTT)
+		avg := time.Duration(old)
+		if avg > 0 && !stale {
+			avg += time.Duration(rttEWMAWeight * float64(rtt-avg))
+		} else {
+			avg = rtt
+		}
+		if atomic.CompareAndSwapInt64(&t.cmdRTT, old, int64(avg)) {
+			break
+		}
+	}
+	atomic.StoreInt64(&t.cmdRTTAt, time.Now().UnixNano())
+}
+
+// Fração das conexões novas que o destino recusa agora (0 = nenhuma)
+func (p *Proxy) shedRate(t *target) float64 {
+	limit := p.config.ShedLatency
+	if limit <= 0 {
+		return 0
+	}
+	avg := t.commandLatency()
+	if avg <= limit {
+		return 0
+	}
+	return min(float64(avg-limit)/float64(limit), maxShedRate)
+}
+
+// Sorteia se a conexão nova para o destino é descartada
+func (p *Proxy) shed(t *target) bool {
+	rate := p.shedRate(t)
+	return rate > 0 && rand.Float64() < rate
+}
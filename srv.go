@@ -0,0 +1,146 @@
+// Destinos por registro DNS SRV (-target srv://_ts3._tcp.example.com): o
+// nome é resolvido no Start() e de novo a cada -srv-refresh, e cada
+// registro vira um destino, junto com os fixos do -target. Destinos que
+// continuam na resposta mantêm pool, cache, circuito e contadores; os que
+// somem saem da escolha (as sessões abertas neles seguem até o fim).
+
+package main
+
+import (
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Prefixo do -target resolvido por SRV
+const srvScheme = "srv://"
+
+// Intervalo padrão entre resoluções (-srv-refresh)
+const defaultSRVRefresh = 30 * time.Second
+
+// Um registro SRV já convertido em destino
+type srvRecord struct {
+	addr     string
+	priority uint16
+	weight   uint16
+}
+
+// Consulta do nome completo (_ts3._tcp.example.com), sem montar serviço e
+// protocolo. O net.LookupSRV já devolve os registros em ordem de
+// prioridade, sorteados pelo peso dentro de cada prioridade.
+func lookupSRV(name string) ([]*net.SRV, error) {
+	_, addrs, err := net.LookupSRV("", "", name)
+	return addrs, err
+}
+
+// Resolve os nomes SRV e troca a lista de destinos se o resultado mudou.
+// Nome que falha fica com o último resultado bom. startPools sobe o pool
+// dos destinos novos (no Start() isso é feito depois, para todos).
+func (p *Proxy) resolveSRV(startPools bool) {
+	for _, name := range p.srvNames {
+		addrs, err := p.lookupSRV(name)
+		if err == nil && len(addrs) == 0 {
+			err = &net.DNSError{Err: "nenhum registro", Name: name}
+		}
+		if err != nil {
+			if _, ok := p.srvCache[name]; ok {
+				p.log.Warnf("⚠️  SRV %s: %v (mantendo o resultado anterior)", name, err)
+			} else {
+				p.log.Errorf("❌ SRV %s: %v", name, err)
+			}
+			continue
+		}
+		records := make([]srvRecord, 0, len(addrs))
+		for _, a := range addrs {
+			host := strings.TrimSuffix(a.Target, ".")
+			records = append(records, srvRecord{
+				addr:     net.JoinHostPort(host, strconv.Itoa(int(a.Port))),
+				priority: a.Priority,
+				weight:   a.Weight,
+			})
+		}
+		p.srvCache[name] = records
+	}
+
+	// Fixos primeiro, na ordem do -target, e depois os de cada nome SRV
+	old := make(map[string]*target)
+	for _, t := range p.targetList() {
+		old[t.addr] = t
+	}
+	var next, fresh []*target
+	seen := make(map[string]bool)
+	var added []string
+	add := func(addr string, priority, weight uint16) {
+		if seen[addr] {
+			return
+		}
+		seen[addr] = true
+		t, ok := old[addr]
+		if !ok {
+			t = p.newTarget(addr)
+			fresh = append(fresh, t)
+			added = append(added, addr)
+		}
+		atomic.StoreUint32(&t.priority, uint32(priority))
+		atomic.StoreUint32(&t.weight, uint32(weight))
+		next = append(next, t)
+	}
+	for _, addr := range p.config.Targets {
+		if !strings.HasPrefix(addr, srvScheme) {
+			add(addr, 0, 0)
+		}
+	}
+	for _, name := range p.srvNames {
+		for _, r := range p.srvCache[name] {
+			add(r.addr, r.priority, r.weight)
+		}
+	}
+
+	var removed []*target
+	for addr, t := range old {
+		if !seen[addr] {
+			removed = append(removed, t)
+		}
+	}
+	if len(added) == 0 && len(removed) == 0 || p.stopping() {
+		return
+	}
+	p.targets.Store(&next)
+	if startPools {
+		for _, t := range fresh {
+			p.startTarget(t)
+		}
+	}
+
+	var gone []string
+	for _, t := range removed {
+		if t.pool != nil {
+			t.pool.close()
+		}
+		gone = append(gone, t.addr)
+	}
+	sort.Strings(added)
+	sort.Strings(gone)
+	list := make([]string, len(next))
+	for i, t := range next {
+		list[i] = t.addr
+	}
+	p.log.With(logFields{"added": added, "removed": gone}).
+		Infof("🧭 Destinos do SRV: %s (novos: %v, removidos: %v)", strings.Join(list, ", "), added, gone)
+}
+
+// Resolve os nomes SRV de novo a cada SRVRefresh (±-jitter, para vários
+// proxies não consultarem o DNS juntos), até o Stop()
+func (p *Proxy) refreshSRV() {
+	for {
+		select {
+		case <-time.After(jitter(p.config.SRVRefresh, p.config.JitterPct)):
+			p.resolveSRV(true)
+		case <-p.shutdown:
+			return
+		}
+	}
+}
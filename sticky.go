@@ -0,0 +1,114 @@
+// -balance sticky: o mesmo cliente (IP, agregado como no -conn-rate) vai
+// sempre para o mesmo destino, para backends que guardam estado por
+// cliente. A escolha é por rendezvous hashing: entre os destinos no ar,
+// ganha o de maior hash(IP, destino). Quando um destino cai, só os
+// clientes dele mudam de lugar; quando volta, eles voltam (ou, com
+// -sticky-stay, ficam no destino novo).
+
+package main
+
+import (
+	"hash/fnv"
+	"sync"
+	"time"
+)
+
+// Por quanto tempo o destino de um IP é lembrado depois da última conexão
+// dele (para o -sticky-stay e o StickyClients do /stats)
+const stickyTTL = time.Hour
+
+// Destino de um IP e quando ele conectou pela última vez
+type stickyEntry struct {
+	addr string
+	last time.Time
+}
+
+// Destino atual de cada IP visto pelo -balance sticky
+type stickyTable struct {
+	mu      sync.Mutex
+	clients map[string]stickyEntry
+}
+
+func newStickyTable() *stickyTable {
+	return &stickyTable{clients: make(map[string]stickyEntry)}
+}
+
+// Destino em que o IP caiu da última vez ("" se não é conhecido)
+func (s *stickyTable) lookup(ip string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.clients[ip].addr
+}
+
+func (s *stickyTable) remember(ip, addr string) {
+	s.mu.Lock()
+	s.clients[ip] = stickyEntry{addr: addr, last: time.Now()}
+	s.mu.Unlock()
+}
+
+// IPs com destino lembrado agora
+func (s *stickyTable) len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.clients)
+}
+
+// Esquece os IPs que não conectam há mais que o stickyTTL (no runCleanup)
+func (s *stickyTable) sweep() {
+	s.mu.Lock()
+	now := time.Now()
+	for ip, e := range s.clients {
+		if now.Sub(e.last) > stickyTTL {
+			delete(s.clients, ip)
+		}
+	}
+	s.mu.Unlock()
+}
+
+// StickyClients do /stats (0 fora do -balance sticky)
+func (p *Proxy) stickyClients() int {
+	if p.sticky == nil {
+		return 0
+	}
+	return p.sticky.len()
+}
+
+// Peso do destino addr para o IP. O FNV sozinho espalha mal chaves que só
+// diferem no fim (as portas dos destinos); a mistura final do splitmix64
+// corrige.
+func stickyScore(ip, addr string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(ip))
+	h.Write([]byte{0})
+	h.Write([]byte(addr))
+	x := h.Sum64()
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+// Índice do destino do IP entre targets. Com -sticky-stay, o destino em
+// que o IP já está vence enquanto estiver na lista; senão, e para IPs
+// novos, vence o de maior stickyScore.
+func (p *Proxy) stickyTarget(targets []*target, ip string) int {
+	if p.config.StickyStay {
+		if addr := p.sticky.lookup(ip); addr != "" {
+			for i, t := range targets {
+				if t.addr == addr {
+					return i
+				}
+			}
+		}
+	}
+	best := 0
+	var max uint64
+	for i, t := range targets {
+		if score := stickyScore(ip, t.addr); i == 0 || score > max {
+			best, max = i, score
+		}
+	}
+	return best
+}
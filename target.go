@@ -0,0 +1,400 @@
+// Destinos do proxy (-target com vários endereços) e escolha do destino de
+// cada conexão nova (-balance).
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"net"
+	"slices"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Estratégias de -balance
+const (
+	balanceRoundRobin = "round-robin"
+	balanceRandom     = "random"
+	balanceLeastConn  = "least-conn"
+	balanceLatency    = "latency"
+	balanceSticky     = "sticky" // sticky.go
+)
+
+// Um servidor TS de destino, com o pool e o cache que são só dele
+type target struct {
+	addr     string
+	active   int64 // conexões de clientes ativas neste destino (atomic)
+	down     int32 // 1 = fora do ar no último health check (atomic)
+	draining int32 // 1 = fora da rotação pelo POST /targets/drain (atomic)
+	rtt      int64 // média móvel do tempo de resposta do health check, em ns (atomic)
+	cmdRTT   int64 // média móvel do tempo de resposta dos comandos, em ns (atomic, -shed-latency)
+	cmdRTTAt int64 // UnixNano da última medida de cmdRTT
+	// Como os de Stats, mas só do tráfego deste destino (atomic)
+	conns    uint64 // conexões de clientes repassadas a este destino
+	commands uint64
+	bytes    uint64
+	shed     uint64 // conexões novas desviadas ou recusadas pelo -shed-latency
+	pool     *connPool
+	cache    *responseCache
+	breaker  *breaker // nil sem -breaker-threshold
+	// Tempo de resposta dos comandos e tamanho das respostas, para o /metrics
+	cmdHist  *latencyHistogram
+	sizeHist *sizeHistogram
+	// Do registro SRV (-target srv://): prioridade menor é tentada antes e,
+	// no -balance random, o peso pesa no sorteio. Zero nos destinos fixos.
+	priority uint32 // atomic
+	weight   uint32 // atomic
+}
+
+// Destino novo, com pool, cache e circuit breaker conforme a configuração
+func (p *Proxy) newTarget(addr string) *target {
+	t := &target{addr: addr, cmdHist: newLatencyHistogram(), sizeHist: newSizeHistogram()}
+	if p.config.PoolSize > 0 {
+		dial := func() (net.Conn, error) { return p.dialTarget(addr) }
+		t.pool = newConnPool(p.config.PoolSize, dial, p.poolSetup, p.config.Timeout,
+			p.log.With(logFields{"target": addr}))
+	}
+	if p.config.CacheTTL > 0 {
+		t.cache = newResponseCache(p.config.CacheTTL, p.config.CacheErrorLine)
+	}
+	if p.config.BreakerThreshold > 0 {
+		t.breaker = newBreaker(p.config.BreakerThreshold, p.config.BreakerCooldown)
+	}
+	return t
+}
+
+// Sobe o pool do destino (e o keepalive dele), no Start() ou quando o
+// destino aparece numa nova resolução SRV
+func (p *Proxy) startTarget(t *target) {
+	if t.pool == nil {
+		return
+	}
+	t.pool.fill()
+	if p.config.TSKeepAlive > 0 {
+		go t.pool.keepalive(p.config.TSKeepAlive, p.config.JitterPct, &p.stats.TSKeepalives)
+	}
+}
+
+// Destinos atuais; a lista não é alterada, só trocada inteira
+func (p *Proxy) targetList() []*target {
+	if list := p.targets.Load(); list != nil {
+		return *list
+	}
+	return nil
+}
+
+// Separa a lista de -target ("host:porta,host:porta,srv://nome,...")
+func parseTargets(list string) ([]string, error) {
+	var targets []string
+	for _, addr := range strings.Split(list, ",") {
+		addr = strings.TrimSpace(addr)
+		if addr == "" {
+			continue
+		}
+		if name, ok := strings.CutPrefix(addr, srvScheme); ok {
+			if name == "" || strings.ContainsAny(name, ":/") {
+				return nil, fmt.Errorf("nome SRV inválido em %q (ex: %s_ts3._tcp.example.com)", addr, srvScheme)
+			}
+			targets = append(targets, addr)
+			continue
+		}
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return nil, fmt.Errorf("destino inválido %q: %w", addr, err)
+		}
+		targets = append(targets, addr)
+	}
+	if len(targets) == 0 {
+		return nil, fmt.Errorf("nenhum destino em %q", list)
+	}
+	return targets, nil
+}
+
+func validBalance(balance string) bool {
+	switch balance {
+	case balanceRoundRobin, balanceRandom, balanceLeastConn, balanceLatency, balanceSticky:
+		return true
+	}
+	return false
+}
+
+// Índice do destino com menos conexões ativas. Empates são decididos por
+// sorteio (reservoir sampling), para que uma rajada de conexões não vá
+// toda para o primeiro da lista. Os contadores são atomic, sem lock: numa
+// rajada dois accepts podem ver o mesmo número, o que só empata de novo.
+func leastConn(targets []*target) int {
+	best, ties := 0, 0
+	var min int64
+	for i, t := range targets {
+		active := atomic.LoadInt64(&t.active)
+		switch {
+		case i == 0 || active < min:
+			best, min, ties = i, active, 1
+		case active == min:
+			ties++
+			if rand.Intn(ties) == 0 {
+				best = i
+			}
+		}
+	}
+	return best
+}
+
+// Índice do destino com a menor média de latência. Destino ainda sem
+// medida fica por último; empates (inclusive todos sem medida) são
+// decididos por sorteio, como no leastConn.
+func lowestLatency(targets []*target) int {
+	best, ties := 0, 0
+	var min time.Duration
+	for i, t := range targets {
+		rtt := t.latency()
+		if rtt == 0 {
+			rtt = math.MaxInt64
+		}
+		switch {
+		case i == 0 || rtt < min:
+			best, min, ties = i, rtt, 1
+		case rtt == min:
+			ties++
+			if rand.Intn(ties) == 0 {
+				best = i
+			}
+		}
+	}
+	return best
+}
+
+// Índice sorteado pelo peso dos registros SRV; sem peso nenhum (destinos
+// fixos, ou SRV com peso 0), sorteio simples
+func weightedRandom(targets []*target) int {
+	var total uint64
+	for _, t := range targets {
+		total += uint64(atomic.LoadUint32(&t.weight))
+	}
+	if total == 0 {
+		return rand.Intn(len(targets))
+	}
+	pick := uint64(rand.Int63n(int64(total)))
+	for i, t := range targets {
+		w := uint64(atomic.LoadUint32(&t.weight))
+		if pick < w {
+			return i
+		}
+		pick -= w
+	}
+	return len(targets) - 1
+}
+
+// Estados de um destino em /stats e nas rotas /targets/drain e undrain
+const (
+	targetActive    = "active"
+	targetDraining  = "draining"  // sem conexões novas; as ativas seguem
+	targetUnhealthy = "unhealthy" // fora do ar no health check
+)
+
+func (t *target) isDraining() bool {
+	return atomic.LoadInt32(&t.draining) == 1
+}
+
+// Tira o destino da rotação (ou devolve); false se já estava assim
+func (t *target) setDraining(draining bool) bool {
+	var v int32
+	if draining {
+		v = 1
+	}
+	return atomic.SwapInt32(&t.draining, v) != v
+}
+
+// Draining vence unhealthy: é o que o operador pediu, e segue valendo
+// quando o destino volta no health check
+func (t *target) state() string {
+	switch {
+	case t.isDraining():
+		return targetDraining
+	case !t.isHealthy():
+		return targetUnhealthy
+	}
+	return targetActive
+}
+
+// Destino pelo endereço como aparece em /stats (nil se não existe)
+func (p *Proxy) findTarget(addr string) *target {
+	for _, t := range p.targetList() {
+		if t.addr == addr {
+			return t
+		}
+	}
+	return nil
+}
+
+// Destinos que podem receber uma conexão nova: no ar no health check, fora
+// de drain e sem o circuito aberto. Como o pool só é usado pelo destino
+// escolhido aqui, um destino em drain também não empresta conexões do
+// pool. Não mexe no -balance (o /ready também usa).
+func (p *Proxy) availableTargets() []*target {
+	var list []*target
+	for _, t := range p.targetList() {
+		if t.isHealthy() && !t.isDraining() && (t.breaker == nil || t.breaker.available()) {
+			list = append(list, t)
+		}
+	}
+	return list
+}
+
+// Ordem de tentativa para uma conexão nova: o destino escolhido pelo
+// -balance primeiro, depois os seguintes da lista (se o discado falhar).
+// Só entram os availableTargets e, com route (destinos do -sni-route),
+// só os que estão nela. Com SRV, o -balance vale entre os destinos da
+// menor prioridade no ar; os de prioridade maior vêm depois, como reserva.
+// clientKey é o IP do cliente para o -balance sticky (em socket unix é
+// vazio, e todos os clientes contam como um só).
+func (p *Proxy) targetOrder(route []string, clientKey string) []*target {
+	var healthy, fallback []*target
+	best := uint32(math.MaxUint32)
+	for _, t := range p.availableTargets() {
+		if route != nil && !slices.Contains(route, t.addr) {
+			continue
+		}
+		switch prio := atomic.LoadUint32(&t.priority); {
+		case prio < best:
+			fallback = append(fallback, healthy...)
+			healthy, best = []*target{t}, prio
+		case prio == best:
+			healthy = append(healthy, t)
+		default:
+			fallback = append(fallback, t)
+		}
+	}
+	n := len(healthy)
+	if n == 0 {
+		return nil
+	}
+	sort.SliceStable(fallback, func(i, j int) bool {
+		return atomic.LoadUint32(&fallback[i].priority) < atomic.LoadUint32(&fallback[j].priority)
+	})
+
+	var start int
+	switch p.config.Balance {
+	case balanceRandom:
+		start = weightedRandom(healthy)
+	case balanceLeastConn:
+		start = leastConn(healthy)
+	case balanceLatency:
+		start = lowestLatency(healthy)
+	case balanceSticky:
+		start = p.stickyTarget(healthy, clientKey)
+	default:
+		start = int((atomic.AddUint64(&p.nextTarget, 1) - 1) % uint64(n))
+	}
+
+	order := make([]*target, n, n+len(fallback))
+	for i := range order {
+		order[i] = healthy[(start+i)%n]
+	}
+	return append(order, fallback...)
+}
+
+// Espera antes da primeira nova tentativa do -dial-retries; dobra a cada uma
+const dialRetryBackoff = 100 * time.Millisecond
+
+// Tempo padrão gasto em novas tentativas por conexão (-dial-retry-max)
+const defaultDialRetryMax = 5 * time.Second
+
+// Conexão com um destino para um cliente: tenta os destinos na ordem do
+// balanceamento e retorna o primeiro que responder. route e clientKey
+// como no targetOrder.
+func (p *Proxy) acquireTarget(route []string, clientKey string) (*target, *pooledConn, error) {
+	order := p.targetOrder(route, clientKey)
+	if len(order) == 0 {
+		return nil, nil, ErrNoHealthyTarget
+	}
+
+	retryDeadline := time.Now().Add(p.config.DialRetryMax)
+	var lastErr error
+	shed := false
+	for _, t := range order {
+		// Destino lento (-shed-latency): parte das conexões novas vai para
+		// o próximo, ou é recusada se não houver outro
+		if p.shed(t) {
+			atomic.AddUint64(&t.shed, 1)
+			shed = true
+			continue
+		}
+		// Circuito meio aberto: só uma conexão testa o destino
+		if !p.breakerAllow(t) {
+			continue
+		}
+		pc, err := p.connectTargetRetry(t, retryDeadline)
+		p.breakerRecord(t, err)
+		if err == nil {
+			if p.sticky != nil {
+				p.sticky.remember(clientKey, t.addr)
+			}
+			return t, pc, nil
+		}
+		if len(p.targetList()) > 1 {
+			p.log.With(logFields{"target": t.addr}).Warnf("⚠️  Destino %s falhou, tentando o próximo: %v", t.addr, err)
+		}
+		lastErr = err
+	}
+	if lastErr == nil && shed {
+		return nil, nil, ErrServerBusy
+	}
+	if lastErr == nil {
+		return nil, nil, ErrNoHealthyTarget
+	}
+	return nil, nil, lastErr
+}
+
+// connectTarget com as novas tentativas do -dial-retries, esperando 100ms,
+// 200ms, 400ms... entre elas. Uma tentativa que terminaria depois do
+// deadline (-dial-retry-max, contado desde o início do acquireTarget) não
+// é feita: o cliente não fica esperando indefinidamente. O circuit breaker
+// vê só o resultado final.
+func (p *Proxy) connectTargetRetry(t *target, deadline time.Time) (*pooledConn, error) {
+	pc, err := p.connectTarget(t)
+	backoff := dialRetryBackoff
+	for retry := 1; err != nil && retry <= p.config.DialRetries; retry++ {
+		if time.Now().Add(backoff).After(deadline) {
+			break
+		}
+		p.log.With(logFields{"target": t.addr}).Debugf("🔁 Destino %s falhou (%v), nova tentativa %d/%d em %v",
+			t.addr, err, retry, p.config.DialRetries, backoff)
+		timer := time.NewTimer(backoff)
+		select {
+		case <-timer.C:
+		case <-p.shutdown:
+			timer.Stop()
+			return nil, err
+		}
+		atomic.AddUint64(&p.stats.DialRetries, 1)
+		pc, err = p.connectTarget(t)
+		backoff *= 2
+	}
+	return pc, err
+}
+
+// Conexão com um destino: do pool, se ativo, ou discada na hora
+func (p *Proxy) connectTarget(t *target) (*pooledConn, error) {
+	if t.pool != nil {
+		return t.pool.get()
+	}
+	conn, err := p.dialTarget(t.addr)
+	if err != nil {
+		return nil, err
+	}
+	// -auto-use: o proxy lê o banner e faz o use; o banner é reenviado ao
+	// cliente como numa conexão do pool. Com -strip-banner o proxy lê o
+	// banner mesmo sem use, e ele não é reenviado. Com -origin-command
+	// também: a resposta do comando não pode se misturar com o banner.
+	if p.useLine != "" {
+		return handshake(conn, p.config.Timeout, []string{p.useLine})
+	}
+	if p.config.StripBanner || p.config.OriginCommand != "" {
+		return handshake(conn, p.config.Timeout, nil)
+	}
+	return &pooledConn{conn: conn}, nil
+}
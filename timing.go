@@ -0,0 +1,123 @@
+// Tempo e tamanho de resposta por comando (pelo verbo: clientlist,
+// serverinfo, ...), servidos em /stats. Cada verbo guarda as últimas
+// amostras de tempo para o p50/p95.
+
+package main
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	timingSamples  = 512 // amostras guardadas por verbo
+	maxTimingVerbs = 200 // verbos distintos; o resto entra em otherVerb
+	otherVerb      = "(outros)"
+)
+
+type verbTiming struct {
+	count    uint64
+	min, max time.Duration
+	samples  []time.Duration // anel com as últimas timingSamples
+	next     int
+	bytes    uint64 // soma do tamanho das respostas
+	maxBytes int
+}
+
+type commandTimings struct {
+	mu    sync.Mutex
+	verbs map[string]*verbTiming
+}
+
+func newCommandTimings() *commandTimings {
+	return &commandTimings{verbs: make(map[string]*verbTiming)}
+}
+
+// Registra o tempo entre o envio do comando e o "error id=" da resposta,
+// e o tamanho dela em bytes
+func (ct *commandTimings) Observe(verb string, d time.Duration, size int) {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+
+	vt := ct.verbs[verb]
+	if vt == nil {
+		// Cliente mandando lixo não pode crescer o mapa sem limite
+		if len(ct.verbs) >= maxTimingVerbs {
+			verb = otherVerb
+			vt = ct.verbs[verb]
+		}
+		if vt == nil {
+			vt = &verbTiming{samples: make([]time.Duration, 0, timingSamples)}
+			ct.verbs[verb] = vt
+		}
+	}
+
+	vt.count++
+	if vt.count == 1 || d < vt.min {
+		vt.min = d
+	}
+	if d > vt.max {
+		vt.max = d
+	}
+	vt.bytes += uint64(size)
+	if size > vt.maxBytes {
+		vt.maxBytes = size
+	}
+	if len(vt.samples) < timingSamples {
+		vt.samples = append(vt.samples, d)
+	} else {
+		vt.samples[vt.next] = d
+		vt.next = (vt.next + 1) % timingSamples
+	}
+}
+
+// Resumo de um verbo em /stats, com os tempos em milissegundos. Min, Max e
+// os bytes valem desde o início; P50 e P95 são das últimas amostras.
+type CommandTiming struct {
+	Count    uint64
+	MinMs    float64
+	MaxMs    float64
+	P50Ms    float64
+	P95Ms    float64
+	Bytes    uint64 // soma do tamanho das respostas
+	MaxBytes int    // maior resposta
+}
+
+func (ct *commandTimings) Snapshot() map[string]CommandTiming {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+
+	snap := make(map[string]CommandTiming, len(ct.verbs))
+	for verb, vt := range ct.verbs {
+		sorted := append([]time.Duration(nil), vt.samples...)
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+		snap[verb] = CommandTiming{
+			Count:    vt.count,
+			MinMs:    durationMs(vt.min),
+			MaxMs:    durationMs(vt.max),
+			P50Ms:    durationMs(percentile(sorted, 0.50)),
+			P95Ms:    durationMs(percentile(sorted, 0.95)),
+			Bytes:    vt.bytes,
+			MaxBytes: vt.maxBytes,
+		}
+	}
+	return snap
+}
+
+// Percentil q (0..1) de amostras já ordenadas, pelo método nearest-rank
+func percentile(sorted []time.Duration, q float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := int(math.Ceil(q*float64(len(sorted)))) - 1
+	if i < 0 {
+		i = 0
+	}
+	return sorted[i]
+}
+
+func durationMs(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
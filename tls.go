@@ -0,0 +1,174 @@
+// TLS na ponta dos clientes (-tls-cert/-tls-key) e, com -target-tls, na
+// ponta do TeamSpeak (TeaSpeak com ServerQuery em SSL). As duas são
+// independentes.
+
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// Versão mínima de TLS (-tls-min-version e -target-tls-min-version)
+func parseTLSVersion(s string) (uint16, error) {
+	switch strings.TrimSpace(s) {
+	case "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	}
+	return 0, fmt.Errorf("versão TLS inválida %q (use 1.2 ou 1.3)", s)
+}
+
+// Suítes permitidas (-tls-ciphers e -target-tls-ciphers), pelo nome do
+// crypto/tls (ex: TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256). Só as que o Go
+// considera seguras e que valem até o TLS 1.2: as do TLS 1.3 são fixas no
+// Go e não dá para restringir. Lista vazia = padrão do Go.
+func parseCipherSuites(list string) ([]uint16, error) {
+	var ids []uint16
+	for _, name := range splitList(list) {
+		suite := findCipherSuite(tls.CipherSuites(), name)
+		if suite == nil {
+			if findCipherSuite(tls.InsecureCipherSuites(), name) != nil {
+				return nil, fmt.Errorf("suíte TLS insegura: %s", name)
+			}
+			return nil, fmt.Errorf("suíte TLS desconhecida: %s", name)
+		}
+		if !supportsTLS12(suite) {
+			return nil, fmt.Errorf("%s é do TLS 1.3, cujas suítes não são configuráveis", name)
+		}
+		ids = append(ids, suite.ID)
+	}
+	return ids, nil
+}
+
+func findCipherSuite(suites []*tls.CipherSuite, name string) *tls.CipherSuite {
+	for _, s := range suites {
+		if strings.EqualFold(s.Name, name) {
+			return s
+		}
+	}
+	return nil
+}
+
+func supportsTLS12(suite *tls.CipherSuite) bool {
+	for _, v := range suite.SupportedVersions {
+		if v == tls.VersionTLS12 {
+			return true
+		}
+	}
+	return false
+}
+
+// Versão mínima configurada, com TLS 1.2 quando não há nenhuma
+func minTLSVersion(v uint16) uint16 {
+	if v == 0 {
+		return tls.VersionTLS12
+	}
+	return v
+}
+
+// Política no log de início: "TLS 1.2+, suítes padrão", "TLS 1.3", ...
+func tlsPolicy(version uint16, ciphers []uint16) string {
+	version = minTLSVersion(version)
+	if version == tls.VersionTLS13 {
+		return "TLS 1.3"
+	}
+	if len(ciphers) == 0 {
+		return tls.VersionName(version) + "+, suítes padrão"
+	}
+	names := make([]string, len(ciphers))
+	for i, id := range ciphers {
+		names[i] = tls.CipherSuiteName(id)
+	}
+	return tls.VersionName(version) + "+, suítes " + strings.Join(names, ", ")
+}
+
+// Versão e suíte de uma conexão TLS, para o log em debug
+func describeTLS(state tls.ConnectionState) string {
+	return tls.VersionName(state.Version) + ", " + tls.CipherSuiteName(state.CipherSuite)
+}
+
+// Monta a configuração TLS do listener a partir do certificado e chave.
+// O certificado é lido a cada handshake de p.tlsCert, para o SIGHUP poder
+// trocá-lo (ReloadTLSCert); os session tickets ficam ligados (padrão do
+// crypto/tls), então clientes que reconectam retomam a sessão sem o
+// handshake completo.
+func (p *Proxy) serverTLSConfig() (*tls.Config, error) {
+	if p.config.TLSCert == "" || p.config.TLSKey == "" {
+		return nil, errors.New("-tls-cert e -tls-key devem ser usados juntos")
+	}
+	if err := p.loadTLSCert(); err != nil {
+		return nil, err
+	}
+
+	return &tls.Config{
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return p.tlsCert.Load(), nil
+		},
+		MinVersion:   minTLSVersion(p.config.TLSMinVersion),
+		CipherSuites: p.config.TLSCiphers,
+	}, nil
+}
+
+func (p *Proxy) loadTLSCert() error {
+	cert, err := tls.LoadX509KeyPair(p.config.TLSCert, p.config.TLSKey)
+	if err != nil {
+		return fmt.Errorf("erro ao carregar certificado TLS: %w", err)
+	}
+	p.tlsCert.Store(&cert)
+	return nil
+}
+
+// ReloadTLSCert relê -tls-cert/-tls-key (SIGHUP). Só os handshakes novos
+// usam o certificado novo: conexões TLS já abertas seguem com o antigo até
+// fecharem. Com erro (ex: chave que não bate), o certificado atual é
+// mantido. Sem -tls-cert não faz nada.
+func (p *Proxy) ReloadTLSCert() error {
+	if p.tlsCert.Load() == nil {
+		return nil
+	}
+	if err := p.loadTLSCert(); err != nil {
+		p.log.Errorf("❌ Certificado TLS mantido: %v", err)
+		return err
+	}
+	p.log.Infof("🔐 Certificado TLS recarregado de %s", p.config.TLSCert)
+	return nil
+}
+
+// Configuração TLS das conexões com o TS (nil sem -target-tls). O
+// ServerName entra em cada discagem, com o host do destino.
+func targetTLSConfig(config Config) *tls.Config {
+	if !config.TargetTLS {
+		return nil
+	}
+	return &tls.Config{
+		MinVersion:         minTLSVersion(config.TargetTLSMin),
+		CipherSuites:       config.TargetTLSCiphers,
+		InsecureSkipVerify: config.TargetTLSInsecure,
+	}
+}
+
+// Handshake TLS com o TS sobre a conexão TCP já aberta, no mesmo prazo da
+// discagem. O host do endereço vai no SNI e na verificação do certificado.
+func (p *Proxy) clientHandshake(conn net.Conn, addr string, deadline time.Time) (net.Conn, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	config := p.targetTLS.Clone()
+	config.ServerName = host
+
+	tlsConn := tls.Client(conn, config)
+	tlsConn.SetDeadline(deadline)
+	if err := tlsConn.Handshake(); err != nil {
+		return nil, fmt.Errorf("handshake TLS: %w", err)
+	}
+	tlsConn.SetDeadline(time.Time{})
+	p.log.Debugf("🔐 TLS com o TS %s: %s", addr, describeTLS(tlsConn.ConnectionState()))
+	return tlsConn, nil
+}
@@ -0,0 +1,65 @@
+// Rastreio de conexões escolhidas (-trace): as próximas N conexões ou as
+// de um IP/faixa têm cada linha registrada em debug, como no -trace-io
+// (que rastreia todas). A escolha é feita uma vez por conexão; nas outras
+// o custo por linha é só o teste de um bool.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// Interpreta o -trace: um número (rastreia as próximas N conexões) ou uma
+// lista de IPs/faixas CIDR, como no -allow
+func parseTraceSpec(spec string) (conns int, nets []*net.IPNet, err error) {
+	spec = strings.TrimSpace(spec)
+	if spec == "" {
+		return 0, nil, nil
+	}
+	if n, err := strconv.Atoi(spec); err == nil {
+		if n < 0 {
+			return 0, nil, fmt.Errorf("número de conexões negativo: %d", n)
+		}
+		return n, nil, nil
+	}
+	nets, err = parseCIDRList(spec)
+	return 0, nets, err
+}
+
+// Decide, no início da conexão, se as linhas dela vão para o log
+func (p *Proxy) traceConn(addr net.Addr) bool {
+	if p.config.TraceIO {
+		return true
+	}
+	if len(p.config.TraceNets) > 0 {
+		if tcpAddr, ok := addr.(*net.TCPAddr); ok && matchIP(p.config.TraceNets, tcpAddr.IP) {
+			return true
+		}
+	}
+	return atomic.LoadInt64(&p.traceLeft) > 0 && atomic.AddInt64(&p.traceLeft, -1) >= 0
+}
+
+// Escapa os caracteres de controle da linha rastreada (\r, \n, \t e os
+// demais como \xNN), para o log mostrar os bytes exatos em uma linha só
+func escapeTrace(line string) string {
+	var b strings.Builder
+	for i := 0; i < len(line); i++ {
+		switch c := line[i]; {
+		case c == '\r':
+			b.WriteString(`\r`)
+		case c == '\n':
+			b.WriteString(`\n`)
+		case c == '\t':
+			b.WriteString(`\t`)
+		case c < 0x20 || c == 0x7f:
+			fmt.Fprintf(&b, `\x%02x`, c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
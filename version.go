@@ -0,0 +1,78 @@
+// Versão e dados do build, injetados pelo -ldflags na compilação:
+//
+//	go build -ldflags "-X main.version=v1.2.0 -X main.commit=$(git rev-parse --short HEAD) -X main.buildDate=$(date -u +%Y-%m-%dT%H:%M:%SZ)" .
+//
+// Sem -ldflags, commit e data vêm do que o próprio go build grava do git
+// (debug.ReadBuildInfo), quando houver.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+)
+
+var (
+	version   = "v1.0.0-dev"
+	commit    = ""
+	buildDate = ""
+)
+
+// Dados do build em -version e GET /version
+type BuildInfo struct {
+	Version   string
+	Commit    string
+	BuildDate string
+	GoVersion string
+}
+
+func buildInfo() BuildInfo {
+	info := BuildInfo{
+		Version:   version,
+		Commit:    commit,
+		BuildDate: buildDate,
+		GoVersion: runtime.Version(),
+	}
+	if bi, ok := debug.ReadBuildInfo(); ok && commit == "" {
+		dirty := false
+		for _, s := range bi.Settings {
+			switch s.Key {
+			case "vcs.revision":
+				if len(s.Value) > 12 {
+					s.Value = s.Value[:12]
+				}
+				info.Commit = s.Value
+			case "vcs.time":
+				if info.BuildDate == "" {
+					info.BuildDate = s.Value
+				}
+			case "vcs.modified":
+				dirty = s.Value == "true"
+			}
+		}
+		if dirty && info.Commit != "" {
+			info.Commit += "-dirty"
+		}
+	}
+	if info.Commit == "" {
+		info.Commit = "desconhecido"
+	}
+	if info.BuildDate == "" {
+		info.BuildDate = "desconhecida"
+	}
+	return info
+}
+
+func (b BuildInfo) String() string {
+	return fmt.Sprintf("%s (commit %s, build %s, %s)", b.Version, b.Commit, b.BuildDate, b.GoVersion)
+}
+
+func (p *Proxy) handleVersion(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "método não permitido", http.StatusMethodNotAllowed)
+		return
+	}
+	p.writeJSON(w, buildInfo())
+}